@@ -0,0 +1,48 @@
+package awsconfig
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"strings"
+)
+
+// ResourceARN is the parsed ARN of the stream an output writes to.
+type ResourceARN struct {
+	ARN     string
+	Region  string
+	Account string
+	Name    string
+}
+
+// ParseResourceARN parses the ARN of a resource of the given service and type,
+// e.g. "arn:aws:kinesis:eu-central-1:123456789012:stream/foo".
+func ParseResourceARN(s, service, resourceType string) (ResourceARN, error) {
+	a, err := arn.Parse(s)
+	if err != nil {
+		return ResourceARN{}, fmt.Errorf("invalid ARN %q: %v", s, err)
+	}
+	if a.Service != service {
+		return ResourceARN{}, fmt.Errorf("%q is not a %s ARN", s, service)
+	}
+	name := strings.TrimPrefix(a.Resource, resourceType+"/")
+	if name == a.Resource || name == "" || strings.Contains(name, "/") {
+		return ResourceARN{}, fmt.Errorf("%q is not the ARN of a %s", s, resourceType)
+	}
+	if a.Region == "" || a.AccountID == "" {
+		return ResourceARN{}, fmt.Errorf("ARN %q lacks the region or account", s)
+	}
+	return ResourceARN{ARN: s, Region: a.Region, Account: a.AccountID, Name: name}, nil
+}
+
+// UseRegionOf makes the output talk to the region of the resource it writes to. The region is taken from the ARN when
+// it isn't set or set to `auto`, and must be the same otherwise.
+func (c *Config) UseRegionOf(r ResourceARN, setting string) error {
+	if c.Region == "" || c.Region == RegionAuto {
+		c.Region = r.Region
+		return nil
+	}
+	if c.Region != r.Region {
+		return fmt.Errorf("%s is in region %s, but region is set to %s", setting, r.Region, c.Region)
+	}
+	return nil
+}
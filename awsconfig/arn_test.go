@@ -0,0 +1,42 @@
+package awsconfig
+
+import (
+	"testing"
+)
+
+func TestParseResourceARN(t *testing.T) {
+	r, err := ParseResourceARN("arn:aws:kinesis:eu-central-1:123456789012:stream/foo", "kinesis", "stream")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Region != "eu-central-1" || r.Account != "123456789012" || r.Name != "foo" {
+		t.Errorf("unexpected ARN: %+v", r)
+	}
+
+	for _, s := range []string{
+		"foo",
+		"arn:aws:firehose:eu-central-1:123456789012:deliverystream/foo",
+		"arn:aws:kinesis:eu-central-1:123456789012:stream/foo/consumer/bar:1",
+		"arn:aws:kinesis:eu-central-1:123456789012:foo",
+		"arn:aws:kinesis::123456789012:stream/foo",
+	} {
+		if _, err := ParseResourceARN(s, "kinesis", "stream"); err == nil {
+			t.Errorf("expected an error for %s", s)
+		}
+	}
+}
+
+func TestUseRegionOf(t *testing.T) {
+	r := ResourceARN{Region: "eu-central-1"}
+	for _, region := range []string{"", RegionAuto, "eu-central-1"} {
+		c := Config{Region: region}
+		if err := c.UseRegionOf(r, "stream_arn"); err != nil || c.Region != "eu-central-1" {
+			t.Errorf("unexpected result for region %q: %v, %s", region, err, c.Region)
+		}
+	}
+
+	c := Config{Region: "us-east-1"}
+	if err := c.UseRegionOf(r, "stream_arn"); err == nil {
+		t.Errorf("expected an error for another region")
+	}
+}
@@ -0,0 +1,114 @@
+// Package awsconfig holds the AWS settings shared by all outputs, and builds the SDK session they talk to AWS with.
+// Output configs embed Config inline, so that its settings sit next to the output's own ones, e.g. `output.streams.region`.
+package awsconfig
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+var userAgentTagPattern = regexp.MustCompile(`^[A-Za-z0-9._:/=+-]+$`)
+
+// Config of the connection to AWS.
+type Config struct {
+	Region                 string        `config:"region"`
+	AccessKeyID            string        `config:"access_key_id"`
+	SecretAccessKey        string        `config:"secret_access_key"`
+	SessionToken           string        `config:"session_token"`
+	ProfileName            string        `config:"credential_profile_name"`
+	SharedCredentialFile   string        `config:"shared_credential_file"`
+	Endpoint               string        `config:"endpoint"`
+	FIPSEnabled            bool          `config:"fips_enabled"`
+	RoleARN                string        `config:"role_arn"`
+	ProxyURL               string        `config:"proxy_url"`
+	Timeout                time.Duration `config:"timeout"`
+	Backoff                Backoff       `config:"backoff"`
+	UserAgentTag           string        `config:"user_agent_tag"`
+	SDKMaxRetries          int           `config:"sdk_max_retries"`
+	SDKMinRetryDelay       time.Duration `config:"sdk_min_retry_delay"`
+	SDKMaxRetryDelay       time.Duration `config:"sdk_max_retry_delay"`
+	SDKMaxThrottleDelay    time.Duration `config:"sdk_max_throttle_delay"`
+	RegionDetectionTimeout time.Duration `config:"region_detection_timeout"`
+}
+
+// Backoff between reconnection attempts of an output, growing from Init to Max.
+type Backoff struct {
+	Init time.Duration
+	Max  time.Duration
+}
+
+// DefaultConfig is the AWS config of an output that doesn't set any of it.
+var DefaultConfig = Config{
+	Timeout: 90 * time.Second,
+	Backoff: Backoff{
+		Init: 1 * time.Second,
+		Max:  60 * time.Second,
+	},
+	SDKMaxRetries:          client.DefaultRetryerMaxNumRetries,
+	SDKMinRetryDelay:       client.DefaultRetryerMinRetryDelay,
+	SDKMaxRetryDelay:       client.DefaultRetryerMaxRetryDelay,
+	SDKMaxThrottleDelay:    client.DefaultRetryerMaxThrottleDelay,
+	RegionDetectionTimeout: defaultRegionDetectionTimeout,
+}
+
+const defaultRegionDetectionTimeout = 5 * time.Second
+
+func (c *Config) Validate() error {
+	if c.Region == "" {
+		return errors.New("region is not defined")
+	}
+
+	if (c.AccessKeyID == "") != (c.SecretAccessKey == "") {
+		return errors.New("access_key_id and secret_access_key must be set together")
+	}
+
+	if c.SessionToken != "" && c.AccessKeyID == "" {
+		return errors.New("session_token requires access_key_id and secret_access_key")
+	}
+
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid endpoint %q: must be a URL like https://kinesis.eu-central-1.amazonaws.com", c.Endpoint)
+		}
+	}
+
+	if c.ProxyURL != "" {
+		if u, err := url.Parse(c.ProxyURL); err != nil || u.Host == "" {
+			return fmt.Errorf("invalid proxy_url %q", c.ProxyURL)
+		}
+	}
+
+	if c.UserAgentTag != "" && !userAgentTagPattern.MatchString(c.UserAgentTag) {
+		return fmt.Errorf("invalid user_agent_tag %q: only letters, digits and ._:/=+- are allowed", c.UserAgentTag)
+	}
+
+	if c.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+
+	if c.RegionDetectionTimeout < 0 {
+		return errors.New("region_detection_timeout must not be negative")
+	}
+
+	if c.SDKMaxRetries < 0 {
+		return errors.New("sdk_max_retries must not be negative")
+	}
+
+	if c.SDKMinRetryDelay < 0 || c.SDKMaxRetryDelay < 0 || c.SDKMaxThrottleDelay < 0 {
+		return errors.New("sdk_min_retry_delay, sdk_max_retry_delay and sdk_max_throttle_delay must not be negative")
+	}
+
+	if c.SDKMaxRetryDelay > 0 && c.SDKMinRetryDelay > c.SDKMaxRetryDelay {
+		return errors.New("sdk_min_retry_delay must not be greater than sdk_max_retry_delay")
+	}
+
+	if c.SDKMaxThrottleDelay > 0 && c.SDKMaxThrottleDelay < client.DefaultRetryerMinThrottleDelay {
+		return fmt.Errorf("sdk_max_throttle_delay must be at least %v, the delay of the first retry after a throttling error", client.DefaultRetryerMinThrottleDelay)
+	}
+
+	return nil
+}
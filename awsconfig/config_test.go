@@ -0,0 +1,66 @@
+package awsconfig
+
+import (
+	"github.com/elastic/beats/libbeat/common"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	for _, c := range []struct {
+		config Config
+		valid  bool
+	}{
+		{Config{}, false},
+		{Config{Region: "eu-central-1"}, true},
+		{Config{Region: "eu-central-1", Endpoint: "https://vpce-123.kinesis.eu-central-1.vpce.amazonaws.com"}, true},
+		{Config{Region: "eu-central-1", Endpoint: "kinesis.eu-central-1.amazonaws.com"}, false},
+		{Config{Region: "eu-central-1", ProxyURL: "http://proxy:3128"}, true},
+		{Config{Region: "eu-central-1", ProxyURL: "proxy"}, false},
+		{Config{Region: "eu-central-1", Timeout: -time.Second}, false},
+		{Config{Region: "eu-central-1", AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}, true},
+		{Config{Region: "eu-central-1", AccessKeyID: "AKID"}, false},
+		{Config{Region: "eu-central-1", SecretAccessKey: "secret"}, false},
+		{Config{Region: "eu-central-1", SessionToken: "token"}, false},
+		{Config{Region: "eu-central-1", ProfileName: "shipper"}, true},
+		{Config{Region: "eu-central-1", UserAgentTag: "team=edge/eu-1"}, true},
+		{Config{Region: "eu-central-1", UserAgentTag: "edge eu"}, false},
+		{Config{Region: "eu-central-1", SDKMaxRetries: -1}, false},
+		{Config{Region: "eu-central-1", SDKMaxThrottleDelay: 100 * time.Millisecond}, false},
+		{Config{Region: "eu-central-1", SDKMinRetryDelay: time.Second, SDKMaxThrottleDelay: 500 * time.Millisecond}, true},
+		{Config{Region: "eu-central-1", SDKMinRetryDelay: time.Second, SDKMaxRetryDelay: time.Millisecond}, false},
+		{Config{Region: "eu-central-1", SDKMaxRetryDelay: -time.Second}, false},
+		{Config{Region: "eu-central-1", SDKMinRetryDelay: time.Second}, true},
+	} {
+		err := c.config.Validate()
+		if c.valid && err != nil {
+			t.Errorf("unexpected error for %+v: %v", c.config, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("expected an error for %+v", c.config)
+		}
+	}
+}
+
+func TestUnpackInline(t *testing.T) {
+	var config struct {
+		Config `config:",inline"`
+		Name   string `config:"stream_name"`
+	}
+	config.Config = DefaultConfig
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"region":      "eu-central-1",
+		"role_arn":    "arn:aws:iam::123456789012:role/shipper",
+		"stream_name": "foo",
+		"backoff":     map[string]interface{}{"max": "2m"},
+	})
+	if err := cfg.Unpack(&config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.Region != "eu-central-1" || config.RoleARN != "arn:aws:iam::123456789012:role/shipper" || config.Name != "foo" {
+		t.Errorf("unexpected config: %+v", config)
+	}
+	if config.Backoff.Init != time.Second || config.Backoff.Max != 2*time.Minute || config.Timeout != 90*time.Second {
+		t.Errorf("expected defaults to be kept: %+v", config)
+	}
+}
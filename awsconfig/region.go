@@ -0,0 +1,162 @@
+package awsconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/elastic/beats/libbeat/logp"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// RegionAuto makes the region be detected from the environment the beat runs in.
+const RegionAuto = "auto"
+
+var (
+	// Instance metadata service of EC2
+	imdsEndpoint = "http://169.254.169.254"
+	// Set by the ECS agent in the containers of a task
+	ecsMetadataEnv = []string{"ECS_CONTAINER_METADATA_URI_V4", "ECS_CONTAINER_METADATA_URI"}
+)
+
+// resolveRegion returns the region to talk to, detecting it when the config says `auto`.
+func resolveRegion(c Config, output string) (string, error) {
+	if c.Region != RegionAuto {
+		return c.Region, nil
+	}
+
+	timeout := c.RegionDetectionTimeout
+	if timeout <= 0 {
+		timeout = defaultRegionDetectionTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var errs []string
+	for _, detector := range []struct {
+		source string
+		detect func(ctx context.Context, c Config) (string, error)
+	}{
+		{"the environment", regionFromEnv},
+		{"the shared config", regionFromSharedConfig},
+		{"ECS task metadata", regionFromECS},
+		{"EC2 instance metadata", regionFromIMDS},
+	} {
+		region, err := detector.detect(ctx, c)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", detector.source, err))
+			continue
+		}
+		if region != "" {
+			logp.NewLogger(output).Infof("detected region %s from %s", region, detector.source)
+			return region, nil
+		}
+	}
+	if len(errs) == 0 {
+		return "", errors.New("failed to detect the region: not set in the environment or shared config, and not running on ECS or EC2")
+	}
+	return "", fmt.Errorf("failed to detect the region: %s", strings.Join(errs, "; "))
+}
+
+func regionFromEnv(_ context.Context, _ Config) (string, error) {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region, nil
+		}
+	}
+	return "", nil
+}
+
+func regionFromSharedConfig(_ context.Context, c Config) (string, error) {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Profile:           c.ProfileName,
+		SharedConfigState: session.SharedConfigEnable,
+		SharedConfigFiles: sharedConfigFiles(c),
+	})
+	if err != nil {
+		return "", err
+	}
+	if sess.Config.Region == nil {
+		return "", nil
+	}
+	return *sess.Config.Region, nil
+}
+
+// regionFromECS reads the region from the ARN of the task the beat runs in.
+func regionFromECS(ctx context.Context, _ Config) (string, error) {
+	var uri string
+	for _, name := range ecsMetadataEnv {
+		if uri = os.Getenv(name); uri != "" {
+			break
+		}
+	}
+	if uri == "" {
+		return "", nil
+	}
+
+	req, err := http.NewRequest("GET", uri+"/task", nil)
+	if err != nil {
+		return "", err
+	}
+	body, err := fetchMetadata(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	var task struct {
+		TaskARN string
+	}
+	if err := json.Unmarshal(body, &task); err != nil {
+		return "", fmt.Errorf("invalid task metadata: %v", err)
+	}
+	// arn:aws:ecs:<region>:<account>:task/...
+	parts := strings.SplitN(task.TaskARN, ":", 5)
+	if len(parts) < 5 || parts[3] == "" {
+		return "", fmt.Errorf("unexpected task ARN %q", task.TaskARN)
+	}
+	return parts[3], nil
+}
+
+// regionFromIMDS reads the region of the instance from the instance metadata service, with an IMDSv2 session token.
+func regionFromIMDS(ctx context.Context, _ Config) (string, error) {
+	req, err := http.NewRequest("PUT", imdsEndpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := fetchMetadata(ctx, req)
+	if err != nil {
+		return "", err
+	}
+
+	req, err = http.NewRequest("GET", imdsEndpoint+"/latest/meta-data/placement/region", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	region, err := fetchMetadata(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(region)), nil
+}
+
+func fetchMetadata(ctx context.Context, req *http.Request) ([]byte, error) {
+	// Metadata endpoints are link-local, and must not go through a proxy
+	client := &http.Client{Transport: &http.Transport{}}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, res.Status)
+	}
+	return body, nil
+}
@@ -0,0 +1,118 @@
+package awsconfig
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// setenv sets environment variables, an empty value unsetting it, and returns a function restoring them.
+func setenv(vars map[string]string) func() {
+	saved := map[string]*string{}
+	for name, value := range vars {
+		if old, ok := os.LookupEnv(name); ok {
+			saved[name] = &old
+		} else {
+			saved[name] = nil
+		}
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+	}
+	return func() {
+		for name, value := range saved {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+	}
+}
+
+// noRegionEnv leaves the region to be found in metadata only.
+func noRegionEnv(vars map[string]string) map[string]string {
+	env := map[string]string{
+		"AWS_REGION":                    "",
+		"AWS_DEFAULT_REGION":            "",
+		"AWS_PROFILE":                   "",
+		"AWS_CONFIG_FILE":               "/nonexistent",
+		"AWS_SHARED_CREDENTIALS_FILE":   "/nonexistent",
+		"ECS_CONTAINER_METADATA_URI_V4": "",
+		"ECS_CONTAINER_METADATA_URI":    "",
+	}
+	for name, value := range vars {
+		env[name] = value
+	}
+	return env
+}
+
+func TestResolveRegion(t *testing.T) {
+	if region, err := resolveRegion(Config{Region: "eu-central-1"}, "test"); err != nil || region != "eu-central-1" {
+		t.Errorf("unexpected region: %s, %v", region, err)
+	}
+
+	defer setenv(noRegionEnv(map[string]string{"AWS_REGION": "ap-northeast-1"}))()
+	if region, err := resolveRegion(Config{Region: RegionAuto}, "test"); err != nil || region != "ap-northeast-1" {
+		t.Errorf("unexpected region: %s, %v", region, err)
+	}
+}
+
+func TestResolveRegionFromECS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v4/task" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write([]byte(`{"Cluster":"default","TaskARN":"arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c"}`))
+	}))
+	defer server.Close()
+
+	defer setenv(noRegionEnv(map[string]string{"ECS_CONTAINER_METADATA_URI_V4": server.URL + "/v4"}))()
+	if region, err := resolveRegion(Config{Region: RegionAuto}, "test"); err != nil || region != "us-west-2" {
+		t.Errorf("unexpected region: %s, %v", region, err)
+	}
+}
+
+func TestResolveRegionFromIMDS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/latest/api/token" && r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") != "":
+			w.Write([]byte("token"))
+		case r.Method == "GET" && r.URL.Path == "/latest/meta-data/placement/region" && r.Header.Get("X-aws-ec2-metadata-token") == "token":
+			w.Write([]byte("sa-east-1"))
+		default:
+			w.WriteHeader(401)
+		}
+	}))
+	defer server.Close()
+	defer func(endpoint string) { imdsEndpoint = endpoint }(imdsEndpoint)
+	imdsEndpoint = server.URL
+
+	defer setenv(noRegionEnv(nil))()
+	if region, err := resolveRegion(Config{Region: RegionAuto}, "test"); err != nil || region != "sa-east-1" {
+		t.Errorf("unexpected region: %s, %v", region, err)
+	}
+}
+
+func TestResolveRegionTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer server.Close()
+	defer func(endpoint string) { imdsEndpoint = endpoint }(imdsEndpoint)
+	imdsEndpoint = server.URL
+
+	defer setenv(noRegionEnv(nil))()
+	start := time.Now()
+	if _, err := resolveRegion(Config{Region: RegionAuto, RegionDetectionTimeout: 50 * time.Millisecond}, "test"); err == nil {
+		t.Errorf("expected an error")
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("expected detection to time out, took %v", elapsed)
+	}
+}
@@ -0,0 +1,51 @@
+package awsconfig
+
+import (
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/s12v/awsbeats/metrics"
+	"time"
+)
+
+// retryer is the SDK's default retryer, with every retry logged at debug level and counted in the output metrics.
+type retryer struct {
+	client.DefaultRetryer
+	output  string
+	metrics *metrics.Metrics
+}
+
+func newRetryer(c Config, output string) retryer {
+	return retryer{
+		DefaultRetryer: newDefaultRetryer(c),
+		output:         output,
+		metrics:        metrics.Get(output),
+	}
+}
+
+// newDefaultRetryer is the SDK's default retryer with the retry settings of the config.
+func newDefaultRetryer(c Config) client.DefaultRetryer {
+	return client.DefaultRetryer{
+		NumMaxRetries:    c.SDKMaxRetries,
+		MinRetryDelay:    c.SDKMinRetryDelay,
+		MinThrottleDelay: client.DefaultRetryerMinThrottleDelay,
+		MaxRetryDelay:    c.SDKMaxRetryDelay,
+		MaxThrottleDelay: c.SDKMaxThrottleDelay,
+	}
+}
+
+// RetryRules is only called once the SDK has decided to retry a request, to know how long to wait before.
+func (r retryer) RetryRules(req *request.Request) time.Duration {
+	delay := r.DefaultRetryer.RetryRules(req)
+	code := "unknown"
+	if aerr, ok := req.Error.(awserr.Error); ok {
+		code = aerr.Code()
+	}
+	r.metrics.SDKRetry(code)
+	logp.NewLogger(r.output).Debugf(
+		"retrying %s in %v (retry %d/%d): %v",
+		req.Operation.Name, delay, req.RetryCount+1, r.MaxRetries(), req.Error,
+	)
+	return delay
+}
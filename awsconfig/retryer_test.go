@@ -0,0 +1,58 @@
+package awsconfig
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/monitoring"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryer(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(400)
+		w.Write([]byte(`{"__type":"LimitExceededException","message":"slow down"}`))
+	}))
+	defer server.Close()
+
+	sess, err := NewSession(Config{
+		Region:              "eu-central-1",
+		Endpoint:            server.URL,
+		AccessKeyID:         "AKID",
+		SecretAccessKey:     "secret",
+		SDKMaxRetries:       2,
+		SDKMinRetryDelay:    time.Millisecond,
+		SDKMaxThrottleDelay: 5 * time.Millisecond,
+	}, beat.Info{}, "test_retryer")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	retries := func() int64 {
+		reg := monitoring.Default.GetRegistry("libbeat.outputs.test_retryer")
+		return monitoring.CollectFlatSnapshot(reg, monitoring.Full, false).Ints["api.retries.LimitExceededException"]
+	}
+	before := retries()
+	_, err = kinesis.New(sess).DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{StreamName: aws.String("foo")})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if calls != 3 {
+		t.Errorf("expected 1 call and 2 retries, got %d calls", calls)
+	}
+	if n := retries() - before; n != 2 {
+		t.Errorf("unexpected number of retries: %d", n)
+	}
+}
+
+func TestRetryerDelays(t *testing.T) {
+	r := newRetryer(Config{SDKMinRetryDelay: time.Millisecond, SDKMaxRetryDelay: time.Second, SDKMaxThrottleDelay: time.Minute}, "test_retryer")
+	if r.MinRetryDelay != time.Millisecond || r.MaxRetryDelay != time.Second || r.MaxThrottleDelay != time.Minute {
+		t.Errorf("unexpected delays: %+v", r.DefaultRetryer)
+	}
+}
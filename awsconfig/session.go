@@ -0,0 +1,104 @@
+package awsconfig
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/s12v/awsbeats/version"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// NewSession builds the session that an output of the given beat creates its API client from.
+func NewSession(c Config, info beat.Info, output string) (*session.Session, error) {
+	region, err := resolveRegion(c, output)
+	if err != nil {
+		return nil, err
+	}
+	base, err := session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Region:      aws.String(region),
+			Credentials: newCredentials(c),
+			HTTPClient:  newHTTPClient(c),
+			Retryer:     newRetryer(c, output),
+			// Roles are assumed in the region of the output rather than through the global endpoint
+			STSRegionalEndpoint: endpoints.RegionalSTSEndpoint,
+		},
+		// Profiles of ~/.aws/config, e.g. with a role_arn, a credential_process or SSO, are used as well
+		Profile:           c.ProfileName,
+		SharedConfigState: session.SharedConfigEnable,
+		SharedConfigFiles: sharedConfigFiles(c),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	// Added first, so that it is copied into the STS client and the output's session below
+	base.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(userAgent(c, info)))
+
+	cfg := &aws.Config{}
+	if c.RoleARN != "" {
+		// STS is called through the base session, as the endpoint set below is that of the output's service, with a
+		// retryer of its own, so that its retries aren't counted as those of the output
+		sts := base.Copy(&aws.Config{Retryer: newDefaultRetryer(c)})
+		cfg.Credentials = stscreds.NewCredentials(sts, c.RoleARN)
+	}
+	if c.Endpoint != "" {
+		cfg.Endpoint = aws.String(c.Endpoint)
+	}
+	if c.FIPSEnabled {
+		cfg.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	return base.Copy(cfg), nil
+}
+
+// userAgent is appended to the SDK's User-Agent of every request, so that the requests of a fleet of beats can be told
+// apart in CloudTrail and VPC endpoint logs, e.g. "awsbeats/0.3.0 filebeat/7.5.0 edge-eu".
+func userAgent(c Config, info beat.Info) string {
+	ua := "awsbeats/" + version.Version
+	if info.Beat != "" {
+		ua += " " + info.Beat + "/" + info.Version
+	}
+	if c.UserAgentTag != "" {
+		ua += " " + c.UserAgentTag
+	}
+	return ua
+}
+
+// newCredentials returns the static credentials set in the config, or nil for the credentials of the session: those
+// of the environment, of the profile of the shared files, or of the instance or task role.
+func newCredentials(c Config) *credentials.Credentials {
+	if c.AccessKeyID != "" {
+		return credentials.NewStaticCredentials(c.AccessKeyID, c.SecretAccessKey, c.SessionToken)
+	}
+	return nil
+}
+
+// sharedConfigFiles returns the shared files that profiles are read from, or nil for the SDK's defaults:
+// AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials, and AWS_CONFIG_FILE or ~/.aws/config.
+func sharedConfigFiles(c Config) []string {
+	if c.SharedCredentialFile == "" {
+		return nil
+	}
+	config := os.Getenv("AWS_CONFIG_FILE")
+	if config == "" {
+		config = defaults.SharedConfigFilename()
+	}
+	return []string{c.SharedCredentialFile, config}
+}
+
+func newHTTPClient(c Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.ProxyURL != "" {
+		// Validated along with the config
+		proxy, _ := url.Parse(c.ProxyURL)
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	return &http.Client{Transport: transport, Timeout: c.Timeout}
+}
@@ -0,0 +1,143 @@
+package awsconfig
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/s12v/awsbeats/version"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSession(t *testing.T) {
+	sess, err := NewSession(Config{
+		Region:   "eu-central-1",
+		Endpoint: "http://localhost:4566",
+		RoleARN:  "arn:aws:iam::123456789012:role/shipper",
+		ProxyURL: "http://proxy:3128",
+		Timeout:  5 * time.Second,
+	}, beat.Info{}, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if aws.StringValue(sess.Config.Region) != "eu-central-1" || aws.StringValue(sess.Config.Endpoint) != "http://localhost:4566" {
+		t.Errorf("unexpected session config: %v", sess.Config)
+	}
+	if sess.Config.HTTPClient.Timeout != 5*time.Second {
+		t.Errorf("unexpected HTTP client timeout: %v", sess.Config.HTTPClient.Timeout)
+	}
+	req, _ := http.NewRequest("POST", "https://kinesis.eu-central-1.amazonaws.com", nil)
+	if proxy, _ := sess.Config.HTTPClient.Transport.(*http.Transport).Proxy(req); proxy == nil || proxy.Host != "proxy:3128" {
+		t.Errorf("unexpected proxy: %v", proxy)
+	}
+	if sess.Config.Credentials == nil {
+		t.Errorf("expected assume-role credentials")
+	}
+}
+
+func TestNewSessionWithDefaults(t *testing.T) {
+	sess, err := NewSession(Config{Region: "eu-central-1"}, beat.Info{}, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sess.Config.Endpoint != nil {
+		t.Errorf("unexpected endpoint: %s", aws.StringValue(sess.Config.Endpoint))
+	}
+	if endpoint := sts.New(sess).Endpoint; endpoint != "https://sts.eu-central-1.amazonaws.com" {
+		t.Errorf("expected the regional STS endpoint, got %s", endpoint)
+	}
+}
+
+func TestNewSessionWithStaticCredentials(t *testing.T) {
+	sess, err := NewSession(Config{Region: "eu-central-1", AccessKeyID: "AKID", SecretAccessKey: "secret", SessionToken: "token"}, beat.Info{}, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds.AccessKeyID != "AKID" || creds.SecretAccessKey != "secret" || creds.SessionToken != "token" {
+		t.Errorf("unexpected credentials: %v", creds)
+	}
+}
+
+func TestNewSessionWithSharedCredentials(t *testing.T) {
+	f, err := ioutil.TempFile("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("[default]\naws_access_key_id = DEFAULT\naws_secret_access_key = default\n\n[shipper]\naws_access_key_id = SHIPPER\naws_secret_access_key = shipper\n")
+	f.Close()
+
+	sess, err := NewSession(Config{Region: "eu-central-1", SharedCredentialFile: f.Name(), ProfileName: "shipper"}, beat.Info{}, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds.AccessKeyID != "SHIPPER" || creds.SecretAccessKey != "shipper" {
+		t.Errorf("unexpected credentials: %v", creds)
+	}
+}
+
+func TestNewSessionWithSharedConfigProfile(t *testing.T) {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("[profile shipper]\naws_access_key_id = SHIPPER\naws_secret_access_key = shipper\n")
+	f.Close()
+	for name, value := range map[string]string{"AWS_CONFIG_FILE": f.Name(), "AWS_SHARED_CREDENTIALS_FILE": f.Name() + ".none"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	sess, err := NewSession(Config{Region: "eu-central-1", ProfileName: "shipper"}, beat.Info{}, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creds.AccessKeyID != "SHIPPER" {
+		t.Errorf("expected the credentials of the profile of the config file, got %v", creds)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+
+	defer func(v string) { version.Version = v }(version.Version)
+	version.Version = "0.3.0"
+	sess, err := NewSession(Config{
+		Region:          "eu-central-1",
+		Endpoint:        server.URL,
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		UserAgentTag:    "edge-eu",
+	}, beat.Info{Beat: "filebeat", Version: "7.5.0"}, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	kinesis.New(sess, &aws.Config{MaxRetries: aws.Int(0)}).DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{StreamName: aws.String("foo")})
+	if !strings.HasSuffix(userAgent, " awsbeats/0.3.0 filebeat/7.5.0 edge-eu") || !strings.HasPrefix(userAgent, "aws-sdk-go/") {
+		t.Errorf("unexpected User-Agent: %s", userAgent)
+	}
+}
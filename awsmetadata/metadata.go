@@ -0,0 +1,276 @@
+// Package awsmetadata stamps records with where and when they were sent, so that consumers of a stream can measure the
+// latency from the beat and tell resent records apart.
+// Records are stamped just before being sent, on top of what their events were encoded to, which stays the same on
+// retries.
+package awsmetadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/rs/xid"
+	"github.com/s12v/awsbeats/version"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config of the `add_aws_metadata` setting of an output.
+type Config struct {
+	Enabled bool   `config:"enabled"`
+	Field   string `config:"field"`
+}
+
+// DefaultConfig is the config of an output that doesn't set `add_aws_metadata`.
+var DefaultConfig = Config{
+	Field: "awsbeats",
+}
+
+func (c *Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Field == "" || strings.HasPrefix(c.Field, "@") || strings.Contains(c.Field, ".") {
+		return errors.New("add_aws_metadata.field must be a top-level field, not starting with @")
+	}
+	return nil
+}
+
+// Stamper stamps the records of an output. A nil *Stamper stamps nothing.
+type Stamper struct {
+	// `,"<field>":{"stream":...,"region":...,"version":...`
+	prefix []byte
+	// `"<field>":`
+	key []byte
+	now func() time.Time
+}
+
+// New returns the stamper of an output sending to the given stream, or nil when `add_aws_metadata` isn't enabled.
+func New(c Config, stream, region string) *Stamper {
+	if !c.Enabled {
+		return nil
+	}
+	var b bytes.Buffer
+	b.WriteByte(',')
+	writeString(&b, c.Field)
+	b.WriteString(`:{"stream":`)
+	writeString(&b, stream)
+	b.WriteString(`,"region":`)
+	writeString(&b, region)
+	b.WriteString(`,"version":`)
+	writeString(&b, version.Version)
+	key := bytes.NewBuffer(nil)
+	writeString(key, c.Field)
+	key.WriteByte(':')
+	return &Stamper{prefix: b.Bytes(), key: key.Bytes(), now: time.Now}
+}
+
+// Batch is the stamp of the records sent together.
+type Batch struct {
+	// The prefix of the stamper, followed by `,"batch_id":...,"sent_at":...,"attempt":`
+	prefix []byte
+	key    []byte
+}
+
+// Batch returns the stamp of a new batch of records, identified by a unique ID and sent now.
+func (s *Stamper) Batch() *Batch {
+	if s == nil {
+		return nil
+	}
+	b := bytes.NewBuffer(append([]byte(nil), s.prefix...))
+	b.WriteString(`,"batch_id":`)
+	writeString(b, xid.New().String())
+	b.WriteString(`,"sent_at":`)
+	writeString(b, s.now().UTC().Format("2006-01-02T15:04:05.000Z"))
+	b.WriteString(`,"attempt":`)
+	return &Batch{prefix: b.Bytes(), key: s.key}
+}
+
+// Stamp returns a copy of the record, a JSON object followed by a new line, with the metadata added to the object.
+// attempt is the number of times the record has been sent, including this one. Records that aren't JSON objects are
+// returned as is, and so are records whose field of the metadata isn't an object, while the metadata is merged into
+// an object that is already there.
+func (b *Batch) Stamp(data []byte, attempt int) []byte {
+	if b == nil {
+		return data
+	}
+	end := bytes.LastIndexByte(data, '}')
+	if end < 1 || data[0] != '{' {
+		return data
+	}
+	if bytes.Contains(data[:end], b.key) {
+		if merged, ok := b.merge(data[:end+1], attempt); ok {
+			return append(merged, data[end+1:]...)
+		}
+	}
+	prefix := b.prefix
+	if len(bytes.TrimSpace(data[1:end])) == 0 {
+		// No comma after the opening brace of an empty object
+		prefix = prefix[1:]
+	}
+	out := make([]byte, 0, len(data)+len(prefix)+8)
+	out = append(out, data[:end]...)
+	out = append(out, prefix...)
+	out = strconv.AppendInt(out, int64(attempt), 10)
+	out = append(out, '}')
+	return append(out, data[end:]...)
+}
+
+// Keys of the stamp, which replace those of an existing field
+var stampKeys = map[string]bool{
+	"stream": true, "region": true, "version": true, "batch_id": true, "sent_at": true, "attempt": true,
+}
+
+// merge returns the record with the metadata merged into its field, or false if the record has no such field.
+// The record is spliced rather than encoded again, so that the order and escaping of the other fields are kept.
+func (b *Batch) merge(record []byte, attempt int) ([]byte, bool) {
+	fields, ok := members(record)
+	if !ok {
+		return nil, false
+	}
+	var field string
+	json.Unmarshal(b.key[:len(b.key)-1], &field)
+	for _, f := range fields {
+		if f.key != field {
+			continue
+		}
+		existing := record[f.value:f.end]
+		if existing[0] != '{' {
+			// Not an object, kept as is
+			return record, true
+		}
+		inner, ok := members(existing)
+		if !ok {
+			return nil, false
+		}
+		out := make([]byte, 0, len(record)+len(b.prefix)+8)
+		out = append(out, record[:f.value]...)
+		out = append(out, '{')
+		for _, m := range inner {
+			if !stampKeys[m.key] {
+				out = append(append(out, existing[m.start:m.end]...), ',')
+			}
+		}
+		// The members of the stamp, after `,"<field>":{`
+		out = append(out, b.prefix[len(b.key)+2:]...)
+		out = strconv.AppendInt(out, int64(attempt), 10)
+		out = append(out, '}')
+		return append(out, record[f.end:]...), true
+	}
+	// Only in a value, or nested
+	return nil, false
+}
+
+// member is a member of a JSON object, as offsets in the object.
+type member struct {
+	key        string
+	start, end int
+	// Start of the value, which ends with the member
+	value int
+}
+
+// members splits a JSON object into its members, without decoding their values.
+func members(obj []byte) ([]member, bool) {
+	i := skipSpace(obj, 1)
+	if i < len(obj) && obj[i] == '}' {
+		return nil, true
+	}
+	var ms []member
+	for i < len(obj) && obj[i] == '"' {
+		m := member{start: i}
+		end, ok := skipString(obj, i)
+		if !ok || json.Unmarshal(obj[i:end], &m.key) != nil {
+			return nil, false
+		}
+		i = skipSpace(obj, end)
+		if i >= len(obj) || obj[i] != ':' {
+			return nil, false
+		}
+		m.value = skipSpace(obj, i+1)
+		if m.end, ok = skipValue(obj, m.value); !ok {
+			return nil, false
+		}
+		ms = append(ms, m)
+		i = skipSpace(obj, m.end)
+		if i < len(obj) && obj[i] == '}' {
+			return ms, true
+		}
+		if i >= len(obj) || obj[i] != ',' {
+			return nil, false
+		}
+		i = skipSpace(obj, i+1)
+	}
+	return nil, false
+}
+
+// skipValue returns the end of the JSON value starting at i.
+func skipValue(b []byte, i int) (int, bool) {
+	if i >= len(b) {
+		return 0, false
+	}
+	switch b[i] {
+	case '"':
+		return skipString(b, i)
+	case '{', '[':
+		depth := 0
+		for i < len(b) {
+			switch b[i] {
+			case '"':
+				end, ok := skipString(b, i)
+				if !ok {
+					return 0, false
+				}
+				i = end
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1, true
+				}
+			}
+			i++
+		}
+		return 0, false
+	}
+	end := i
+	for end < len(b) && !isDelimiter(b[end]) {
+		end++
+	}
+	return end, end > i
+}
+
+// skipString returns the end of the JSON string starting at i.
+func skipString(b []byte, i int) (int, bool) {
+	for i++; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+func skipSpace(b []byte, i int) int {
+	for i < len(b) && isSpace(b[i]) {
+		i++
+	}
+	return i
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func isDelimiter(c byte) bool {
+	return c == ',' || c == '}' || c == ']' || isSpace(c)
+}
+
+func writeString(b *bytes.Buffer, s string) {
+	// Marshaling a string can't fail
+	encoded, _ := json.Marshal(s)
+	b.Write(encoded)
+}
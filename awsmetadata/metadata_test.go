@@ -0,0 +1,110 @@
+package awsmetadata
+
+import (
+	"encoding/json"
+	"github.com/s12v/awsbeats/version"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	for _, field := range []string{"", "@metadata", "aws.meta"} {
+		c := Config{Enabled: true, Field: field}
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected field %q to be invalid", field)
+		}
+	}
+	c := Config{Field: ""}
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error of a disabled config: %v", err)
+	}
+}
+
+func TestNewDisabled(t *testing.T) {
+	s := New(DefaultConfig, "foo", "eu-central-1")
+	if s != nil {
+		t.Fatalf("expected no stamper")
+	}
+	data := []byte("{\"a\":1}\n")
+	if got := s.Batch().Stamp(data, 1); string(got) != string(data) {
+		t.Errorf("expected the record as is, got %s", got)
+	}
+}
+
+func TestStamp(t *testing.T) {
+	s := New(Config{Enabled: true, Field: "meta"}, "fo\"o", "eu-central-1")
+	s.now = func() time.Time { return time.Date(2026, 10, 19, 12, 0, 0, 5e6, time.FixedZone("CEST", 7200)) }
+	b := s.Batch()
+
+	data := []byte("{\"message\":\"hello\"}\n")
+	stamped := b.Stamp(data, 2)
+	if string(data) != "{\"message\":\"hello\"}\n" {
+		t.Errorf("expected the record not to be modified")
+	}
+	if stamped[len(stamped)-1] != '\n' {
+		t.Errorf("expected a trailing new line: %q", stamped)
+	}
+	var event struct {
+		Message string
+		Meta    struct {
+			Stream, Region, Version string
+			BatchID                 string `json:"batch_id"`
+			SentAt                  string `json:"sent_at"`
+			Attempt                 int
+		}
+	}
+	if err := json.Unmarshal(stamped, &event); err != nil {
+		t.Fatalf("invalid JSON %s: %v", stamped, err)
+	}
+	m := event.Meta
+	if event.Message != "hello" || m.Stream != "fo\"o" || m.Region != "eu-central-1" || m.Version != version.Version ||
+		m.BatchID == "" || m.SentAt != "2026-10-19T10:00:00.005Z" || m.Attempt != 2 {
+		t.Errorf("unexpected stamp: %s", stamped)
+	}
+
+	if other := s.Batch(); string(other.prefix) == string(b.prefix) {
+		t.Errorf("expected batches to have their own ID")
+	}
+}
+
+func TestStampEmptyAndInvalidRecords(t *testing.T) {
+	b := New(Config{Enabled: true, Field: "meta"}, "foo", "eu-central-1").Batch()
+	var v map[string]interface{}
+	if err := json.Unmarshal(b.Stamp([]byte("{}\n"), 1), &v); err != nil || v["meta"] == nil {
+		t.Errorf("expected an empty object to be stamped: %v", err)
+	}
+	if got := b.Stamp([]byte("boom"), 1); string(got) != "boom" {
+		t.Errorf("expected a record that isn't an object as is, got %s", got)
+	}
+}
+
+func TestStampMergesIntoExistingField(t *testing.T) {
+	b := New(Config{Enabled: true, Field: "meta"}, "foo", "eu-central-1").Batch()
+	stamped := b.Stamp([]byte("{\"message\":\"hello\",\"meta\":{\"team\":\"a\",\"stream\":\"other\"}}\n"), 1)
+	if stamped[len(stamped)-1] != '\n' {
+		t.Errorf("expected a trailing new line: %q", stamped)
+	}
+	// Spliced, keeping the order and escaping of the other fields
+	spliced := string(b.Stamp([]byte("{\"z\":\"<a&b>\",\"meta\":{ \"y\" : [1, {\"}\":\"\\\"\"}] , \"stream\":\"other\"},\"a\":null}\n"), 2))
+	if !strings.HasPrefix(spliced, `{"z":"<a&b>","meta":{"y" : [1, {"}":"\""}],"stream":"foo","region":`) || !strings.HasSuffix(spliced, `,"attempt":2},"a":null}`+"\n") {
+		t.Errorf("expected the stamp to be spliced into the field, got %s", spliced)
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(stamped, &event); err != nil {
+		t.Fatalf("invalid JSON %s: %v", stamped, err)
+	}
+	meta, _ := event["meta"].(map[string]interface{})
+	if event["message"] != "hello" || meta["team"] != "a" || meta["stream"] != "foo" || meta["attempt"] != 1.0 {
+		t.Errorf("expected the stamp to be merged, got %s", stamped)
+	}
+
+	data := []byte("{\"meta\":\"x\"}\n")
+	if got := b.Stamp(data, 1); string(got) != string(data) {
+		t.Errorf("expected a field that isn't an object to be kept, got %s", got)
+	}
+	nested := b.Stamp([]byte("{\"a\":{\"meta\":1}}\n"), 1)
+	if err := json.Unmarshal(nested, &event); err != nil || event["meta"] == nil {
+		t.Errorf("expected a nested field not to be merged into, got %s: %v", nested, err)
+	}
+}
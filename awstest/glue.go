@@ -0,0 +1,119 @@
+package awstest
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type schema struct {
+	dataFormat string
+	versions   []schemaVersion
+}
+
+type schemaVersion struct {
+	id         string
+	number     int64
+	definition string
+}
+
+// CreateSchemaVersion adds a version with the given Avro definition to a schema of the Glue Schema Registry, creating
+// the schema if needed, and returns the ID of the version.
+func (s *Server) CreateSchemaVersion(registry, name, definition string) string {
+	return s.CreateSchemaVersionOfFormat(registry, name, "AVRO", definition)
+}
+
+// CreateSchemaVersionOfFormat is CreateSchemaVersion for another data format than Avro, e.g. "PROTOBUF". The data
+// format of a schema is the one of its first version.
+func (s *Server) CreateSchemaVersionOfFormat(registry, name, dataFormat, definition string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc, ok := s.schemas[registry+"/"+name]
+	if !ok {
+		sc = &schema{dataFormat: dataFormat}
+		s.schemas[registry+"/"+name] = sc
+	}
+	s.schemaVersions++
+	v := schemaVersion{
+		id:         fmt.Sprintf("%08x-0000-4000-8000-%012x", s.schemaVersions, s.schemaVersions),
+		number:     int64(len(sc.versions) + 1),
+		definition: definition,
+	}
+	sc.versions = append(sc.versions, v)
+	return v.id
+}
+
+type schemaIDInput struct {
+	RegistryName string
+	SchemaName   string
+}
+
+func (s *Server) getSchemaVersion(body []byte) (interface{}, string) {
+	var in struct {
+		SchemaId            *schemaIDInput
+		SchemaVersionId     string
+		SchemaVersionNumber *struct {
+			LatestVersion bool
+			VersionNumber int64
+		}
+	}
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, "InvalidInputException"
+	}
+	if in.SchemaVersionId != "" {
+		for _, sc := range s.schemas {
+			for _, v := range sc.versions {
+				if v.id == in.SchemaVersionId {
+					return schemaVersionOutput(sc, v), ""
+				}
+			}
+		}
+		return nil, "EntityNotFoundException"
+	}
+
+	if in.SchemaId == nil || in.SchemaVersionNumber == nil {
+		return nil, "InvalidInputException"
+	}
+	sc, ok := s.schemas[in.SchemaId.RegistryName+"/"+in.SchemaId.SchemaName]
+	if !ok {
+		return nil, "EntityNotFoundException"
+	}
+	if in.SchemaVersionNumber.LatestVersion {
+		return schemaVersionOutput(sc, sc.versions[len(sc.versions)-1]), ""
+	}
+	for _, v := range sc.versions {
+		if v.number == in.SchemaVersionNumber.VersionNumber {
+			return schemaVersionOutput(sc, v), ""
+		}
+	}
+	return nil, "EntityNotFoundException"
+}
+
+func (s *Server) getSchemaByDefinition(body []byte) (interface{}, string) {
+	var in struct {
+		SchemaId         schemaIDInput
+		SchemaDefinition string
+	}
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, "InvalidInputException"
+	}
+	sc, ok := s.schemas[in.SchemaId.RegistryName+"/"+in.SchemaId.SchemaName]
+	if !ok {
+		return nil, "EntityNotFoundException"
+	}
+	for _, v := range sc.versions {
+		if v.definition == in.SchemaDefinition {
+			return schemaVersionOutput(sc, v), ""
+		}
+	}
+	return nil, "EntityNotFoundException"
+}
+
+func schemaVersionOutput(sc *schema, v schemaVersion) map[string]interface{} {
+	return map[string]interface{}{
+		"SchemaVersionId":  v.id,
+		"VersionNumber":    v.number,
+		"SchemaDefinition": v.definition,
+		"DataFormat":       sc.dataFormat,
+		"Status":           "AVAILABLE",
+	}
+}
@@ -0,0 +1,402 @@
+// Package awstest runs a fake Kinesis Data Streams, Firehose and Glue Schema Registry endpoint in the test process,
+// speaking their JSON protocols well enough for the outputs to be tested end to end through the AWS SDK, without
+// network.
+// Faults like throttling, partial failures, timeouts and 5xx errors can be injected into its responses.
+package awstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/s12v/awsbeats/awsconfig"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Region and Account of the streams of the server
+	Region  = "eu-central-1"
+	Account = "123456789012"
+)
+
+// Record is a record accepted by the server.
+type Record struct {
+	PartitionKey string
+	Data         []byte
+}
+
+// Fault makes the next request of an action fail.
+type Fault struct {
+	// Action the fault applies to, e.g. "PutRecords", or any action when empty
+	Action string
+	// Delay before responding, e.g. longer than the client's timeout to make the request time out
+	Delay time.Duration
+	// Status and error code of a response failing the whole request, e.g. 500 and "InternalFailure"
+	Status int
+	Code   string
+	// Error codes of the records that fail, by their index in the request
+	RecordErrors map[int]string
+}
+
+// Throttled makes the next request of the action be throttled as a whole, the way the service does it.
+func Throttled(action string) Fault {
+	switch action {
+	case "PutRecords", "PutRecord":
+		return Fault{Action: action, Status: 400, Code: "ProvisionedThroughputExceededException"}
+	case "PutRecordBatch":
+		return Fault{Action: action, Status: 503, Code: "ServiceUnavailableException"}
+	}
+	return Fault{Action: action, Status: 400, Code: "LimitExceededException"}
+}
+
+// PartialFailure makes the records at the given indices of the next request of the action fail with the given code,
+// e.g. "ProvisionedThroughputExceededException" for records throttled by Kinesis Data Streams.
+func PartialFailure(action string, code string, indices ...int) Fault {
+	f := Fault{Action: action, RecordErrors: map[int]string{}}
+	for _, i := range indices {
+		f.RecordErrors[i] = code
+	}
+	return f
+}
+
+// Timeout delays the response to the next request of the action by d.
+func Timeout(action string, d time.Duration) Fault {
+	return Fault{Action: action, Delay: d}
+}
+
+// ServerError makes the next request of the action fail with the given 5xx status.
+func ServerError(action string, status int) Fault {
+	return Fault{Action: action, Status: status, Code: "InternalFailure"}
+}
+
+type stream struct {
+	name    string
+	arn     string
+	shards  int
+	records []Record
+}
+
+// Server is a fake Kinesis Data Streams, Firehose and Glue Schema Registry endpoint.
+type Server struct {
+	URL string
+
+	srv             *httptest.Server
+	closed          chan struct{}
+	mu              sync.Mutex
+	streams         map[string]*stream
+	deliveryStreams map[string]*stream
+	schemas         map[string]*schema
+	schemaVersions  int
+	faults          []Fault
+	requests        map[string]int
+	sequence        int
+}
+
+// NewServer starts a server without any stream. It must be closed once the test is done.
+func NewServer() *Server {
+	s := &Server{
+		closed:          make(chan struct{}),
+		streams:         map[string]*stream{},
+		deliveryStreams: map[string]*stream{},
+		schemas:         map[string]*schema{},
+		requests:        map[string]int{},
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close stops the server, and responds to the requests delayed by a fault right away.
+func (s *Server) Close() {
+	close(s.closed)
+	s.srv.Close()
+}
+
+// Config returns the AWS settings of an output talking to the server. The SDK doesn't retry failed requests, so that
+// injected faults reach the output.
+func (s *Server) Config() awsconfig.Config {
+	c := awsconfig.DefaultConfig
+	c.Region = Region
+	c.Endpoint = s.URL
+	c.AccessKeyID = "AKIDEXAMPLE"
+	c.SecretAccessKey = "secret"
+	c.Timeout = 5 * time.Second
+	c.SDKMaxRetries = 0
+	return c
+}
+
+// CreateStream creates an active provisioned Kinesis data stream, and returns its ARN.
+func (s *Server) CreateStream(name string, shards int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	arn := fmt.Sprintf("arn:aws:kinesis:%s:%s:stream/%s", Region, Account, name)
+	s.streams[name] = &stream{name: name, arn: arn, shards: shards}
+	return arn
+}
+
+// CreateDeliveryStream creates an active Firehose delivery stream, and returns its ARN.
+func (s *Server) CreateDeliveryStream(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	arn := fmt.Sprintf("arn:aws:firehose:%s:%s:deliverystream/%s", Region, Account, name)
+	s.deliveryStreams[name] = &stream{name: name, arn: arn}
+	return arn
+}
+
+// Records returns the records accepted by the stream or delivery stream of the given name, in order.
+func (s *Server) Records(name string) []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.streams[name]
+	if !ok {
+		st, ok = s.deliveryStreams[name]
+	}
+	if !ok {
+		return nil
+	}
+	return append([]Record(nil), st.records...)
+}
+
+// Inject queues a fault, applied to the next request of its action.
+func (s *Server) Inject(faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, faults...)
+}
+
+// Requests returns the number of requests received for the action, including failed ones.
+func (s *Server) Requests(action string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[action]
+}
+
+// fault dequeues the first fault of the action, if any.
+func (s *Server) fault(action string) (Fault, bool) {
+	for i, f := range s.faults {
+		if f.Action == "" || f.Action == action {
+			s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			return f, true
+		}
+	}
+	return Fault{}, false
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	// e.g. "Kinesis_20131202.PutRecords", "Firehose_20150804.PutRecordBatch" or "AWSGlue.GetSchemaVersion"
+	target := strings.SplitN(r.Header.Get("X-Amz-Target"), ".", 2)
+	if len(target) != 2 {
+		writeError(w, 400, "UnknownOperationException", "missing X-Amz-Target")
+		return
+	}
+	action := target[1]
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.requests[action]++
+	f, faulty := s.fault(action)
+	s.mu.Unlock()
+	if faulty && f.Delay > 0 {
+		select {
+		case <-time.After(f.Delay):
+		case <-s.closed:
+			return
+		}
+	}
+	if faulty && f.Status != 0 {
+		writeError(w, f.Status, f.Code, "injected fault")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out interface{}
+	var code string
+	switch action {
+	case "DescribeStreamSummary":
+		out, code = s.describeStreamSummary(body)
+	case "PutRecords":
+		out, code = s.putRecords(body, f.RecordErrors)
+	case "PutRecord":
+		out, code = s.putRecord(body, f.RecordErrors)
+	case "DescribeDeliveryStream":
+		out, code = s.describeDeliveryStream(body)
+	case "PutRecordBatch":
+		out, code = s.putRecordBatch(body, f.RecordErrors)
+	case "GetSchemaVersion":
+		out, code = s.getSchemaVersion(body)
+	case "GetSchemaByDefinition":
+		out, code = s.getSchemaByDefinition(body)
+	default:
+		writeError(w, 400, "UnknownOperationException", action+" isn't supported")
+		return
+	}
+	if code != "" {
+		writeError(w, 400, code, action+" failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(out)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"__type": code, "message": message})
+}
+
+// stream looks a data stream up by its name or ARN.
+func (s *Server) stream(name string, arn string) (*stream, bool) {
+	if name != "" {
+		st, ok := s.streams[name]
+		return st, ok && (arn == "" || arn == st.arn)
+	}
+	for _, st := range s.streams {
+		if st.arn == arn {
+			return st, true
+		}
+	}
+	return nil, false
+}
+
+func (s *Server) nextSequenceNumber() string {
+	s.sequence++
+	return strconv.Itoa(s.sequence)
+}
+
+type streamInput struct {
+	StreamName string
+	StreamARN  string
+}
+
+type recordInput struct {
+	Data         []byte
+	PartitionKey string
+}
+
+func (s *Server) describeStreamSummary(body []byte) (interface{}, string) {
+	var in streamInput
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, "SerializationException"
+	}
+	st, ok := s.stream(in.StreamName, in.StreamARN)
+	if !ok {
+		return nil, "ResourceNotFoundException"
+	}
+	return map[string]interface{}{
+		"StreamDescriptionSummary": map[string]interface{}{
+			"StreamName":              st.name,
+			"StreamARN":               st.arn,
+			"StreamStatus":            "ACTIVE",
+			"StreamModeDetails":       map[string]string{"StreamMode": "PROVISIONED"},
+			"OpenShardCount":          st.shards,
+			"RetentionPeriodHours":    24,
+			"EncryptionType":          "NONE",
+			"StreamCreationTimestamp": 1.5e9,
+		},
+	}, ""
+}
+
+func (s *Server) putRecords(body []byte, recordErrors map[int]string) (interface{}, string) {
+	var in struct {
+		streamInput
+		Records []recordInput
+	}
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, "SerializationException"
+	}
+	st, ok := s.stream(in.StreamName, in.StreamARN)
+	if !ok {
+		return nil, "ResourceNotFoundException"
+	}
+	failed := 0
+	entries := make([]map[string]string, len(in.Records))
+	for i, record := range in.Records {
+		if code, ok := recordErrors[i]; ok {
+			failed++
+			entries[i] = map[string]string{"ErrorCode": code, "ErrorMessage": "injected fault"}
+			continue
+		}
+		st.records = append(st.records, Record{PartitionKey: record.PartitionKey, Data: record.Data})
+		entries[i] = map[string]string{"SequenceNumber": s.nextSequenceNumber(), "ShardId": "shardId-000000000000"}
+	}
+	return map[string]interface{}{"FailedRecordCount": failed, "Records": entries}, ""
+}
+
+func (s *Server) putRecord(body []byte, recordErrors map[int]string) (interface{}, string) {
+	var in struct {
+		streamInput
+		recordInput
+	}
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, "SerializationException"
+	}
+	st, ok := s.stream(in.StreamName, in.StreamARN)
+	if !ok {
+		return nil, "ResourceNotFoundException"
+	}
+	if code, ok := recordErrors[0]; ok {
+		return nil, code
+	}
+	st.records = append(st.records, Record{PartitionKey: in.PartitionKey, Data: in.Data})
+	return map[string]string{"SequenceNumber": s.nextSequenceNumber(), "ShardId": "shardId-000000000000"}, ""
+}
+
+func (s *Server) describeDeliveryStream(body []byte) (interface{}, string) {
+	var in struct {
+		DeliveryStreamName string
+	}
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, "SerializationException"
+	}
+	st, ok := s.deliveryStreams[in.DeliveryStreamName]
+	if !ok {
+		return nil, "ResourceNotFoundException"
+	}
+	return map[string]interface{}{
+		"DeliveryStreamDescription": map[string]interface{}{
+			"DeliveryStreamName":   st.name,
+			"DeliveryStreamARN":    st.arn,
+			"DeliveryStreamStatus": "ACTIVE",
+			"DeliveryStreamType":   "DirectPut",
+			"VersionId":            "1",
+			"HasMoreDestinations":  false,
+			"Destinations":         []interface{}{},
+		},
+	}, ""
+}
+
+func (s *Server) putRecordBatch(body []byte, recordErrors map[int]string) (interface{}, string) {
+	var in struct {
+		DeliveryStreamName string
+		Records            []struct {
+			Data []byte
+		}
+	}
+	if err := json.Unmarshal(body, &in); err != nil {
+		return nil, "SerializationException"
+	}
+	st, ok := s.deliveryStreams[in.DeliveryStreamName]
+	if !ok {
+		return nil, "ResourceNotFoundException"
+	}
+	failed := 0
+	responses := make([]map[string]string, len(in.Records))
+	for i, record := range in.Records {
+		if code, ok := recordErrors[i]; ok {
+			failed++
+			responses[i] = map[string]string{"ErrorCode": code, "ErrorMessage": "injected fault"}
+			continue
+		}
+		st.records = append(st.records, Record{Data: record.Data})
+		responses[i] = map[string]string{"RecordId": s.nextSequenceNumber()}
+	}
+	return map[string]interface{}{"FailedPutCount": failed, "Encrypted": false, "RequestResponses": responses}, ""
+}
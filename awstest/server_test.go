@@ -0,0 +1,155 @@
+package awstest
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/s12v/awsbeats/awsconfig"
+	"testing"
+	"time"
+)
+
+func newKinesis(t *testing.T, c awsconfig.Config) *kinesis.Kinesis {
+	sess, err := awsconfig.NewSession(c, beat.Info{}, "awstest")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return kinesis.New(sess)
+}
+
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+func TestKinesis(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	arn := s.CreateStream("foo", 2)
+	client := newKinesis(t, s.Config())
+
+	res, err := client.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{StreamName: aws.String("foo")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if aws.StringValue(res.StreamDescriptionSummary.StreamARN) != arn || aws.Int64Value(res.StreamDescriptionSummary.OpenShardCount) != 2 {
+		t.Errorf("unexpected summary: %v", res)
+	}
+	if _, err := client.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{StreamName: aws.String("bar")}); errorCode(err) != kinesis.ErrCodeResourceNotFoundException {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	records := []*kinesis.PutRecordsRequestEntry{
+		{PartitionKey: aws.String("a"), Data: []byte("1")},
+		{PartitionKey: aws.String("b"), Data: []byte("2")},
+	}
+	s.Inject(PartialFailure("PutRecords", kinesis.ErrCodeProvisionedThroughputExceededException, 1))
+	out, err := client.PutRecords(&kinesis.PutRecordsInput{StreamARN: aws.String(arn), Records: records})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if aws.Int64Value(out.FailedRecordCount) != 1 || aws.StringValue(out.Records[1].ErrorCode) != kinesis.ErrCodeProvisionedThroughputExceededException {
+		t.Errorf("unexpected output: %v", out)
+	}
+	if got := s.Records("foo"); len(got) != 1 || got[0].PartitionKey != "a" || string(got[0].Data) != "1" {
+		t.Errorf("unexpected records: %v", got)
+	}
+
+	s.Inject(Throttled("PutRecord"))
+	if _, err := client.PutRecord(&kinesis.PutRecordInput{StreamName: aws.String("foo"), PartitionKey: aws.String("a"), Data: []byte("3")}); errorCode(err) != kinesis.ErrCodeProvisionedThroughputExceededException {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := client.PutRecord(&kinesis.PutRecordInput{StreamName: aws.String("foo"), PartitionKey: aws.String("a"), Data: []byte("3")}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if s.Requests("PutRecord") != 2 || len(s.Records("foo")) != 2 {
+		t.Errorf("unexpected state: %d requests, %d records", s.Requests("PutRecord"), len(s.Records("foo")))
+	}
+}
+
+func TestFirehose(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	arn := s.CreateDeliveryStream("foo")
+	sess, err := awsconfig.NewSession(s.Config(), beat.Info{}, "awstest")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := firehose.New(sess)
+
+	res, err := client.DescribeDeliveryStream(&firehose.DescribeDeliveryStreamInput{DeliveryStreamName: aws.String("foo")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if aws.StringValue(res.DeliveryStreamDescription.DeliveryStreamARN) != arn {
+		t.Errorf("unexpected description: %v", res)
+	}
+
+	records := []*firehose.Record{{Data: []byte("1")}, {Data: []byte("2")}}
+	s.Inject(ServerError("PutRecordBatch", 500), PartialFailure("PutRecordBatch", firehose.ErrCodeServiceUnavailableException, 0))
+	if _, err := client.PutRecordBatch(&firehose.PutRecordBatchInput{DeliveryStreamName: aws.String("foo"), Records: records}); errorCode(err) != "InternalFailure" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	out, err := client.PutRecordBatch(&firehose.PutRecordBatchInput{DeliveryStreamName: aws.String("foo"), Records: records})
+	if err != nil || aws.Int64Value(out.FailedPutCount) != 1 {
+		t.Errorf("unexpected result: %v, %v", out, err)
+	}
+	if got := s.Records("foo"); len(got) != 1 || string(got[0].Data) != "2" {
+		t.Errorf("unexpected records: %v", got)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.CreateStream("foo", 1)
+	c := s.Config()
+	c.Timeout = 50 * time.Millisecond
+	client := newKinesis(t, c)
+
+	s.Inject(Timeout("", time.Second))
+	if _, err := client.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{StreamName: aws.String("foo")}); err == nil {
+		t.Errorf("expected the request to time out")
+	}
+	if _, err := client.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{StreamName: aws.String("foo")}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestGlueSchemaRegistry(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	v1 := s.CreateSchemaVersion("reg", "events", `"string"`)
+	v2 := s.CreateSchemaVersion("reg", "events", `"long"`)
+	sess, err := awsconfig.NewSession(s.Config(), beat.Info{}, "awstest")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := glue.New(sess)
+	id := &glue.SchemaId{RegistryName: aws.String("reg"), SchemaName: aws.String("events")}
+
+	latest, err := client.GetSchemaVersion(&glue.GetSchemaVersionInput{SchemaId: id, SchemaVersionNumber: &glue.SchemaVersionNumber{LatestVersion: aws.Bool(true)}})
+	if err != nil || aws.StringValue(latest.SchemaVersionId) != v2 || aws.StringValue(latest.SchemaDefinition) != `"long"` {
+		t.Errorf("unexpected latest version: %v, %v", latest, err)
+	}
+	first, err := client.GetSchemaVersion(&glue.GetSchemaVersionInput{SchemaId: id, SchemaVersionNumber: &glue.SchemaVersionNumber{VersionNumber: aws.Int64(1)}})
+	if err != nil || aws.StringValue(first.SchemaVersionId) != v1 {
+		t.Errorf("unexpected first version: %v, %v", first, err)
+	}
+	byID, err := client.GetSchemaVersion(&glue.GetSchemaVersionInput{SchemaVersionId: aws.String(v1)})
+	if err != nil || aws.StringValue(byID.SchemaDefinition) != `"string"` {
+		t.Errorf("unexpected version: %v, %v", byID, err)
+	}
+	byDefinition, err := client.GetSchemaByDefinition(&glue.GetSchemaByDefinitionInput{SchemaId: id, SchemaDefinition: aws.String(`"long"`)})
+	if err != nil || aws.StringValue(byDefinition.SchemaVersionId) != v2 {
+		t.Errorf("unexpected version: %v, %v", byDefinition, err)
+	}
+	if _, err := client.GetSchemaByDefinition(&glue.GetSchemaByDefinitionInput{SchemaId: id, SchemaDefinition: aws.String(`"int"`)}); errorCode(err) != glue.ErrCodeEntityNotFoundException {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+// Package bufpool recycles the buffers that records are built in, so that busy outputs don't allocate a buffer per
+// event and keep the garbage collector of the beat busy.
+package bufpool
+
+import (
+	"sync"
+)
+
+const (
+	minClassBits = 8
+	// Records of both Kinesis Data Streams and Firehose are at most 1MiB
+	maxClassBits = 20
+)
+
+// Buffers are pooled by size classes of powers of two
+var pools [maxClassBits - minClassBits + 1]sync.Pool
+
+// Buffer holds the data of a record.
+type Buffer struct {
+	B     []byte
+	class int
+}
+
+// Get returns a buffer of n bytes, taken from the pool unless it's larger than a record can be.
+func Get(n int) *Buffer {
+	class := classOf(n)
+	if class < 0 {
+		return &Buffer{B: make([]byte, n), class: -1}
+	}
+	if b, ok := pools[class].Get().(*Buffer); ok {
+		b.B = b.B[:n]
+		return b
+	}
+	return &Buffer{B: make([]byte, n, 1<<(class+minClassBits)), class: class}
+}
+
+// Release returns the buffer to the pool. Neither the buffer nor slices of its data may be used afterwards.
+func (b *Buffer) Release() {
+	if b == nil || b.class < 0 {
+		return
+	}
+	pools[b.class].Put(b)
+}
+
+func classOf(n int) int {
+	for class := 0; class <= maxClassBits-minClassBits; class++ {
+		if n <= 1<<(class+minClassBits) {
+			return class
+		}
+	}
+	return -1
+}
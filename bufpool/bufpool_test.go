@@ -0,0 +1,38 @@
+package bufpool
+
+import (
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	for _, c := range []struct {
+		n, cap int
+	}{
+		{0, 256},
+		{1, 256},
+		{256, 256},
+		{257, 512},
+		{1 << 20, 1 << 20},
+		{1<<20 + 1, 1<<20 + 1},
+	} {
+		b := Get(c.n)
+		if len(b.B) != c.n || cap(b.B) != c.cap {
+			t.Errorf("unexpected buffer for %d bytes: len %d, cap %d", c.n, len(b.B), cap(b.B))
+		}
+		b.Release()
+	}
+}
+
+func TestReleasedBufferIsReused(t *testing.T) {
+	b := Get(300)
+	b.B[0] = 1
+	b.Release()
+	b2 := Get(400)
+	if b2 != b {
+		// The pool may drop buffers at any time, e.g. on GC
+		t.Skip("the released buffer wasn't handed out again")
+	}
+	if len(b2.B) != 400 {
+		t.Errorf("unexpected length of a reused buffer: %d", len(b2.B))
+	}
+}
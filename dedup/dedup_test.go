@@ -0,0 +1,86 @@
+package dedup
+
+import (
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"testing"
+	"time"
+)
+
+func TestEnsureID(t *testing.T) {
+	shared := common.MapStr{"pipeline": "p"}
+	a, b := beat.Event{Meta: shared}, beat.Event{Meta: shared}
+	id := EnsureID(&a)
+	if id == "" || a.Meta[IDKey] != id || a.Meta["pipeline"] != "p" {
+		t.Errorf("unexpected metadata: %v", a.Meta)
+	}
+	if _, ok := shared[IDKey]; ok {
+		t.Errorf("expected shared metadata not to be modified")
+	}
+	if EnsureID(&a) != id {
+		t.Errorf("expected the ID to be stable")
+	}
+	if EnsureID(&b) == id {
+		t.Errorf("expected events to have their own ID")
+	}
+
+	var none beat.Event
+	if EnsureID(&none) == "" || none.Meta[IDKey] == nil {
+		t.Errorf("expected an event without metadata to get an ID")
+	}
+
+	given := beat.Event{Meta: common.MapStr{IDKey: "given"}}
+	if EnsureID(&given) != "given" {
+		t.Errorf("expected @metadata._id to be kept")
+	}
+}
+
+func TestID(t *testing.T) {
+	id, err := ID([]byte(`{"@timestamp":"2026-10-19T10:00:00.000Z","@metadata":{"beat":"filebeat","_id":"abc"},"message":"a"}` + "\n"))
+	if err != nil || id != "abc" {
+		t.Errorf("unexpected ID %q: %v", id, err)
+	}
+	if _, err := ID([]byte(`{"@metadata":{"beat":"filebeat"}}`)); err == nil {
+		t.Errorf("expected an error for a record without an ID")
+	}
+	if _, err := ID([]byte("boom")); err == nil {
+		t.Errorf("expected an error for a record that isn't JSON")
+	}
+}
+
+func TestWindow(t *testing.T) {
+	now := time.Unix(0, 0)
+	w := NewWindow(time.Minute)
+	w.now = func() time.Time { return now }
+
+	if w.Seen("a") || w.Seen("b") {
+		t.Errorf("expected new IDs not to be seen")
+	}
+	now = now.Add(30 * time.Second)
+	if !w.Seen("a") {
+		t.Errorf("expected a to be seen")
+	}
+	if w.Seen("c") {
+		t.Errorf("expected c not to be seen")
+	}
+
+	// a and b expire, the window starting when they were first seen
+	now = now.Add(30 * time.Second)
+	if w.Seen("a") || w.Len() != 2 {
+		t.Errorf("expected a to have expired, %d IDs remembered", w.Len())
+	}
+	if !w.Seen("c") {
+		t.Errorf("expected c to be seen")
+	}
+}
+
+func TestWindowDuplicate(t *testing.T) {
+	w := NewWindow(time.Minute)
+	record := []byte(`{"@metadata":{"_id":"abc"},"message":"a"}` + "\n")
+	if w.Duplicate(record) || !w.Duplicate(record) {
+		t.Errorf("expected the second record to be a duplicate")
+	}
+	if w.Duplicate([]byte(`{"message":"a"}`)) || w.Duplicate([]byte(`{"message":"a"}`)) {
+		t.Errorf("expected records without an ID never to be duplicates")
+	}
+}
@@ -0,0 +1,45 @@
+// Package dedup gives events a stable ID, sent in the `@metadata._id` field of their records, and lets consumers of a
+// stream suppress the records they already got within a time window.
+// Outputs deliver at least once: an event is sent again when the response to its request was lost, although the
+// request may have succeeded.
+package dedup
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/rs/xid"
+)
+
+// IDKey is the key of the ID in the metadata of an event, as for the Elasticsearch output.
+const IDKey = "_id"
+
+// EnsureID gives the event an ID, unless it already has one, and returns it. The ID is kept in the metadata of the
+// event, which the pipeline hands back as is on retries, so that it's the same every time the event is sent.
+// The metadata is copied rather than modified, as it may be shared with other events.
+func EnsureID(event *beat.Event) string {
+	if id, ok := event.Meta[IDKey].(string); ok && id != "" {
+		return id
+	}
+	id := xid.New().String()
+	meta := event.Meta.Clone()
+	meta[IDKey] = id
+	event.Meta = meta
+	return id
+}
+
+// ID returns the ID of the event a record was encoded from.
+func ID(record []byte) (string, error) {
+	var event struct {
+		Meta struct {
+			ID string `json:"_id"`
+		} `json:"@metadata"`
+	}
+	if err := json.Unmarshal(record, &event); err != nil {
+		return "", err
+	}
+	if event.Meta.ID == "" {
+		return "", errors.New("record has no @metadata._id")
+	}
+	return event.Meta.ID, nil
+}
@@ -0,0 +1,75 @@
+package dedup
+
+import (
+	"sync"
+	"time"
+)
+
+// Window remembers the IDs seen within a time window, e.g. by the consumer of a shard.
+// It's safe for concurrent use.
+type Window struct {
+	mu     sync.Mutex
+	window time.Duration
+	seen   map[string]time.Time
+	// IDs in the order they were first seen, to expire them
+	order []seenID
+	now   func() time.Time
+}
+
+type seenID struct {
+	id string
+	at time.Time
+}
+
+// NewWindow returns a window remembering IDs for the given duration since they were first seen. It must be longer
+// than the time it takes an output to resend an event, which is bounded by the backoff and `max_retries` of the output.
+func NewWindow(window time.Duration) *Window {
+	return &Window{
+		window: window,
+		seen:   map[string]time.Time{},
+		now:    time.Now,
+	}
+}
+
+// Seen tells whether the ID was already seen within the window, and remembers it otherwise.
+func (w *Window) Seen(id string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	w.expire(now)
+	if _, ok := w.seen[id]; ok {
+		return true
+	}
+	w.seen[id] = now
+	w.order = append(w.order, seenID{id: id, at: now})
+	return false
+}
+
+// Duplicate tells whether the record is a duplicate of one seen within the window. Records without an ID are never
+// duplicates.
+func (w *Window) Duplicate(record []byte) bool {
+	id, err := ID(record)
+	if err != nil {
+		return false
+	}
+	return w.Seen(id)
+}
+
+// Len returns the number of IDs remembered.
+func (w *Window) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.seen)
+}
+
+func (w *Window) expire(now time.Time) {
+	i := 0
+	for ; i < len(w.order) && now.Sub(w.order[i].at) >= w.window; i++ {
+		delete(w.seen, w.order[i].id)
+	}
+	if i > 0 {
+		// Drops the references to the expired IDs
+		w.order = append(w.order[:0], w.order[i:]...)
+	}
+}
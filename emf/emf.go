@@ -0,0 +1,362 @@
+// Package emf encodes events to the CloudWatch Embedded Metric Format, so that CloudWatch Logs extracts metrics from
+// the records of metricbeat delivered to it, see
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+package emf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"math"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Encoding is the value of the `encoding` setting that selects this encoding.
+const Encoding = "emf"
+
+const (
+	// As per the specification
+	maxMetricsPerDirective = 100
+	maxDimensionsPerSet    = 30
+
+	timestampFormat = "2006-01-02T15:04:05.000Z"
+)
+
+// Top-level fields of the events of metricbeat, which metrics can't be named after, along with the members EMF records
+// have anyway
+var topLevelFields = map[string]bool{
+	"@metadata": true, "@timestamp": true, "_aws": true, "agent": true, "cloud": true, "container": true, "ecs": true,
+	"error": true, "event": true, "fields": true, "host": true, "kubernetes": true, "metricset": true, "service": true,
+	"tags": true,
+}
+
+var units = map[string]bool{
+	"Seconds": true, "Microseconds": true, "Milliseconds": true, "Bytes": true, "Kilobytes": true, "Megabytes": true,
+	"Gigabytes": true, "Terabytes": true, "Bits": true, "Kilobits": true, "Megabits": true, "Gigabits": true,
+	"Terabits": true, "Percent": true, "Count": true, "Bytes/Second": true, "Kilobytes/Second": true,
+	"Megabytes/Second": true, "Gigabytes/Second": true, "Terabytes/Second": true, "Bits/Second": true,
+	"Kilobits/Second": true, "Megabits/Second": true, "Gigabits/Second": true, "Terabits/Second": true,
+	"Count/Second": true, "None": true,
+}
+
+// Config of the `emf` setting of an output.
+type Config struct {
+	Namespace string `config:"namespace"`
+	// Sets of fields whose values the metrics are published by
+	Dimensions [][]string `config:"dimensions"`
+	Metrics    []Metric   `config:"metrics"`
+}
+
+// Metric selects the numeric fields published as metrics.
+type Metric struct {
+	// Path of the field, or a pattern of paths, e.g. "system.cpu.*.pct"
+	Field string `config:"field"`
+	// Name of the metric, default: the path of the field. Only allowed for a single field.
+	Name string `config:"name"`
+	Unit string `config:"unit"`
+}
+
+func (c *Config) Validate() error {
+	if len(c.Namespace) > 255 {
+		return errors.New("emf.namespace must be at most 255 characters")
+	}
+	// Members of the records that metrics would overwrite
+	taken := map[string]bool{}
+	for _, set := range c.Dimensions {
+		if len(set) == 0 || len(set) > maxDimensionsPerSet {
+			return fmt.Errorf("emf.dimensions sets must have 1 to %d dimensions", maxDimensionsPerSet)
+		}
+		for _, field := range set {
+			taken[field] = true
+			taken[topLevel(field)] = true
+		}
+	}
+	for _, m := range c.Metrics {
+		taken[topLevel(m.Field)] = true
+	}
+	for _, m := range c.Metrics {
+		if m.Field == "" {
+			return errors.New("emf.metrics need a field")
+		}
+		if _, err := path.Match(m.Field, ""); err != nil {
+			return fmt.Errorf("invalid emf.metrics field %q: %v", m.Field, err)
+		}
+		if m.Name != "" && isPattern(m.Field) {
+			return fmt.Errorf("emf.metrics field %q is a pattern, and can't have a name", m.Field)
+		}
+		if m.Unit != "" && !units[m.Unit] {
+			return fmt.Errorf("invalid unit %q of emf.metrics field %s", m.Unit, m.Field)
+		}
+		if m.Name != "" {
+			if topLevelFields[m.Name] || taken[m.Name] {
+				return fmt.Errorf("emf.metrics name %q of field %s collides with a field of the events", m.Name, m.Field)
+			}
+			taken[m.Name] = true
+		}
+	}
+	return nil
+}
+
+func topLevel(field string) string {
+	return strings.SplitN(field, ".", 2)[0]
+}
+
+// Required checks the settings the emf encoding can't do without.
+func (c *Config) Required() error {
+	if c.Namespace == "" {
+		return errors.New("emf encoding requires emf.namespace")
+	}
+	if len(c.Metrics) == 0 {
+		return errors.New("emf encoding requires emf.metrics")
+	}
+	return nil
+}
+
+func isPattern(field string) bool {
+	return strings.ContainsAny(field, `*?[\`)
+}
+
+// Encoder encodes events to EMF documents. It implements codec.Codec, and is safe for concurrent use.
+type Encoder struct {
+	config  Config
+	version string
+}
+
+// New returns the encoder of an output of the given beat.
+func New(c Config, info beat.Info) *Encoder {
+	return &Encoder{config: c, version: info.Version}
+}
+
+type directive struct {
+	Namespace  string     `json:"Namespace"`
+	Dimensions [][]string `json:"Dimensions"`
+	Metrics    []metric   `json:"Metrics"`
+}
+
+type metric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit,omitempty"`
+}
+
+// Encode encodes the event as the JSON encoding does, with the selected metrics and dimensions added as top-level
+// members, named by their path, and the `_aws` metadata telling CloudWatch about them. Events without any of the
+// metrics, or without any of the dimension sets, are encoded without metadata.
+func (e *Encoder) Encode(index string, event *beat.Event) ([]byte, error) {
+	doc := make(common.MapStr, len(event.Fields)+3)
+	for k, v := range event.Fields {
+		doc[k], _ = finite(v)
+	}
+	meta := common.MapStr{"beat": index, "type": "_doc", "version": e.version}
+	for k, v := range event.Meta {
+		meta[k] = v
+	}
+	doc["@metadata"] = meta
+	doc["@timestamp"] = event.Timestamp.UTC().Format(timestampFormat)
+
+	metrics := e.metrics(event, doc)
+	var dimensions [][]string
+	if len(metrics) > 0 {
+		dimensions = e.dimensions(event, doc)
+	}
+	if len(dimensions) > 0 {
+		var directives []directive
+		for start := 0; start < len(metrics); start += maxMetricsPerDirective {
+			end := start + maxMetricsPerDirective
+			if end > len(metrics) {
+				end = len(metrics)
+			}
+			directives = append(directives, directive{
+				Namespace:  e.config.Namespace,
+				Dimensions: dimensions,
+				Metrics:    metrics[start:end],
+			})
+		}
+		doc["_aws"] = map[string]interface{}{
+			"Timestamp":         event.Timestamp.UnixNano() / int64(time.Millisecond),
+			"CloudWatchMetrics": directives,
+		}
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	// As the JSON encoding of libbeat
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+// metrics adds the numeric values of the selected fields to the document, and returns them sorted by name.
+func (e *Encoder) metrics(event *beat.Event, doc common.MapStr) []metric {
+	selected := map[string]metric{}
+	for _, m := range e.config.Metrics {
+		if !isPattern(m.Field) {
+			if v, err := event.Fields.GetValue(m.Field); err == nil && isNumber(v) {
+				name := m.Name
+				if name == "" {
+					name = m.Field
+				} else if _, ok := event.Fields[name]; ok {
+					// Not to overwrite a field of the event
+					continue
+				}
+				doc[name] = v
+				selected[name] = metric{Name: name, Unit: m.Unit}
+			}
+			continue
+		}
+		for _, field := range leaves(event.Fields, "") {
+			if ok, _ := path.Match(m.Field, field); !ok {
+				continue
+			}
+			if _, done := selected[field]; done {
+				continue
+			}
+			if v, _ := event.Fields.GetValue(field); isNumber(v) {
+				doc[field] = v
+				selected[field] = metric{Name: field, Unit: m.Unit}
+			}
+		}
+	}
+
+	metrics := make([]metric, 0, len(selected))
+	for _, m := range selected {
+		metrics = append(metrics, m)
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Name < metrics[j].Name })
+	return metrics
+}
+
+// dimensions adds the values of the dimensions to the document, and returns the sets that the event has every
+// dimension of, or an empty set if there are no dimensions, to publish the metrics without dimensions.
+func (e *Encoder) dimensions(event *beat.Event, doc common.MapStr) [][]string {
+	sets := [][]string{}
+	for _, set := range e.config.Dimensions {
+		values := make(map[string]string, len(set))
+		for _, field := range set {
+			v, err := event.Fields.GetValue(field)
+			if err != nil || v == nil {
+				break
+			}
+			if s, ok := v.(string); ok {
+				values[field] = s
+			} else {
+				values[field] = fmt.Sprint(v)
+			}
+		}
+		if len(values) < len(set) {
+			continue
+		}
+		for field, value := range values {
+			doc[field] = value
+		}
+		sets = append(sets, set)
+	}
+	if len(e.config.Dimensions) == 0 {
+		sets = append(sets, []string{})
+	}
+	return sets
+}
+
+// leaves returns the paths of the values of the fields that aren't objects.
+func leaves(fields common.MapStr, prefix string) []string {
+	var paths []string
+	for k, v := range fields {
+		p := k
+		if prefix != "" {
+			p = prefix + "." + k
+		}
+		switch nested := v.(type) {
+		case common.MapStr:
+			paths = append(paths, leaves(nested, p)...)
+		case map[string]interface{}:
+			paths = append(paths, leaves(common.MapStr(nested), p)...)
+		default:
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// isNumber tells whether v is a number that can be published as a metric, which NaN and infinite numbers aren't.
+func isNumber(v interface{}) bool {
+	if v == nil {
+		return false
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Float32, reflect.Float64:
+		return isFinite(rv.Float())
+	}
+	return false
+}
+
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// finite returns v with its NaN and infinite numbers, which JSON can't represent, replaced by nil, and whether there
+// were any. Objects and arrays are only copied if they hold such numbers.
+func finite(v interface{}) (interface{}, bool) {
+	switch x := v.(type) {
+	case nil:
+		return nil, false
+	case common.MapStr:
+		if m, changed := finiteMap(x); changed {
+			return common.MapStr(m), true
+		}
+		return v, false
+	case map[string]interface{}:
+		return finiteMap(x)
+	case []interface{}:
+		var out []interface{}
+		for i, e := range x {
+			f, changed := finite(e)
+			if changed && out == nil {
+				out = append([]interface{}(nil), x...)
+			}
+			if out != nil {
+				out[i] = f
+			}
+		}
+		if out == nil {
+			return v, false
+		}
+		return out, true
+	}
+	rv := reflect.ValueOf(v)
+	if k := rv.Kind(); (k == reflect.Float32 || k == reflect.Float64) && !isFinite(rv.Float()) {
+		return nil, true
+	}
+	return v, false
+}
+
+func finiteMap(m map[string]interface{}) (map[string]interface{}, bool) {
+	var out map[string]interface{}
+	for k, e := range m {
+		f, changed := finite(e)
+		if !changed {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]interface{}, len(m))
+			for k, e := range m {
+				out[k] = e
+			}
+		}
+		out[k] = f
+	}
+	if out == nil {
+		return m, false
+	}
+	return out, true
+}
@@ -0,0 +1,171 @@
+package emf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"math"
+	"testing"
+	"time"
+)
+
+type document struct {
+	AWS *struct {
+		Timestamp         int64
+		CloudWatchMetrics []directive
+	} `json:"_aws"`
+	Members map[string]interface{} `json:"-"`
+}
+
+func encode(t *testing.T, c Config, event *beat.Event) document {
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := New(c, beat.Info{Version: "7.5.0"}).Encode("metricbeat", event)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var doc document
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("invalid JSON %s: %v", b, err)
+	}
+	json.Unmarshal(b, &doc.Members)
+	return doc
+}
+
+func metricEvent() *beat.Event {
+	return &beat.Event{
+		Timestamp: time.Unix(1, 0),
+		Fields: common.MapStr{
+			"host":      common.MapStr{"name": "a"},
+			"metricset": common.MapStr{"name": "cpu"},
+			"system": common.MapStr{"cpu": common.MapStr{
+				"cores": 4,
+				"total": common.MapStr{"pct": 0.5},
+				"user":  common.MapStr{"pct": common.Float(0.25)},
+				"model": "x",
+			}},
+		},
+	}
+}
+
+func TestEncode(t *testing.T) {
+	c := Config{
+		Namespace:  "metricbeat",
+		Dimensions: [][]string{{"host.name", "metricset.name"}, {"cloud.region"}},
+		Metrics: []Metric{
+			{Field: "system.cpu.*.pct", Unit: "Percent"},
+			{Field: "system.cpu.cores", Name: "cores", Unit: "Count"},
+			{Field: "system.cpu.model"},
+		},
+	}
+	doc := encode(t, c, metricEvent())
+	if doc.AWS == nil || doc.AWS.Timestamp != 1000 || len(doc.AWS.CloudWatchMetrics) != 1 {
+		t.Fatalf("unexpected metadata: %+v", doc.AWS)
+	}
+	d := doc.AWS.CloudWatchMetrics[0]
+	expected := []metric{{"cores", "Count"}, {"system.cpu.total.pct", "Percent"}, {"system.cpu.user.pct", "Percent"}}
+	if d.Namespace != "metricbeat" || fmt.Sprint(d.Metrics) != fmt.Sprint(expected) {
+		t.Errorf("unexpected directive: %+v", d)
+	}
+	if fmt.Sprint(d.Dimensions) != "[[host.name metricset.name]]" {
+		t.Errorf("expected only the dimensions of the event, got %v", d.Dimensions)
+	}
+	m := doc.Members
+	if m["cores"] != 4.0 || m["system.cpu.total.pct"] != 0.5 || m["host.name"] != "a" || m["system"] == nil || m["@timestamp"] != "1970-01-01T00:00:01.000Z" {
+		t.Errorf("unexpected members: %v", m)
+	}
+}
+
+func TestEncodeWithoutMetrics(t *testing.T) {
+	doc := encode(t, Config{Namespace: "metricbeat", Metrics: []Metric{{Field: "none"}}}, metricEvent())
+	if doc.AWS != nil {
+		t.Errorf("expected no metadata: %+v", doc.AWS)
+	}
+}
+
+func TestEncodeWithoutDimensions(t *testing.T) {
+	doc := encode(t, Config{Namespace: "metricbeat", Metrics: []Metric{{Field: "system.cpu.cores"}}}, metricEvent())
+	if doc.AWS == nil || fmt.Sprint(doc.AWS.CloudWatchMetrics[0].Dimensions) != "[[]]" {
+		t.Errorf("expected an empty dimension set: %+v", doc.AWS)
+	}
+}
+
+func TestEncodeWithoutMatchingDimensions(t *testing.T) {
+	c := Config{Namespace: "metricbeat", Dimensions: [][]string{{"cloud.region"}}, Metrics: []Metric{{Field: "system.cpu.cores"}}}
+	if doc := encode(t, c, metricEvent()); doc.AWS != nil {
+		t.Errorf("expected no metadata: %+v", doc.AWS)
+	}
+}
+
+func TestEncodeDoesntOverwriteFields(t *testing.T) {
+	c := Config{Namespace: "metricbeat", Metrics: []Metric{{Field: "system.cpu.cores", Name: "cores"}}}
+	event := metricEvent()
+	event.Fields["cores"] = "all"
+	doc := encode(t, c, event)
+	if doc.AWS != nil || doc.Members["cores"] != "all" {
+		t.Errorf("expected the field to be kept: %v", doc.Members)
+	}
+}
+
+func TestEncodeNonFiniteNumbers(t *testing.T) {
+	c := Config{Namespace: "metricbeat", Metrics: []Metric{{Field: "system.cpu.*.pct"}}}
+	event := metricEvent()
+	event.Fields.Put("system.cpu.total.pct", math.NaN())
+	event.Fields.Put("system.cpu.user.pct", common.Float(math.Inf(1)))
+	event.Fields.Put("system.cpu.idle.pct", 0.25)
+	event.Fields["values"] = []interface{}{1, math.Inf(-1)}
+	event.Fields["message"] = "<a&b>"
+	b, err := New(c, beat.Info{Version: "7.5.0"}).Encode("metricbeat", event)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Contains(b, []byte(`"message":"<a&b>"`)) || !bytes.Contains(b, []byte(`"values":[1,null]`)) {
+		t.Errorf("expected non-finite numbers as null, and HTML not to be escaped: %s", b)
+	}
+	doc := encode(t, c, event)
+	if doc.AWS == nil || fmt.Sprint(doc.AWS.CloudWatchMetrics[0].Metrics) != "[{system.cpu.idle.pct }]" {
+		t.Errorf("expected only the finite metric: %+v", doc.AWS)
+	}
+	if _, ok := event.Fields["values"].([]interface{})[1].(float64); !ok {
+		t.Errorf("expected the event to be left as is")
+	}
+}
+
+func TestEncodeSplitsDirectives(t *testing.T) {
+	fields := common.MapStr{}
+	for i := 0; i < 150; i++ {
+		fields[fmt.Sprintf("m%03d", i)] = i
+	}
+	doc := encode(t, Config{Namespace: "metricbeat", Metrics: []Metric{{Field: "m*"}}}, &beat.Event{Fields: fields})
+	if doc.AWS == nil || len(doc.AWS.CloudWatchMetrics) != 2 || len(doc.AWS.CloudWatchMetrics[1].Metrics) != 50 {
+		t.Errorf("expected 2 directives of at most 100 metrics: %+v", doc.AWS)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalid := []Config{
+		{Namespace: "n", Dimensions: [][]string{{}}},
+		{Namespace: "n", Metrics: []Metric{{}}},
+		{Namespace: "n", Metrics: []Metric{{Field: "a.*", Name: "a"}}},
+		{Namespace: "n", Metrics: []Metric{{Field: "a", Unit: "Furlongs"}}},
+		{Namespace: "n", Metrics: []Metric{{Field: "a["}}},
+		{Namespace: "n", Metrics: []Metric{{Field: "system.memory.used.bytes", Name: "host"}}},
+		{Namespace: "n", Metrics: []Metric{{Field: "system.cpu.cores", Name: "system"}}},
+		{Namespace: "n", Dimensions: [][]string{{"region"}}, Metrics: []Metric{{Field: "a", Name: "region"}}},
+		{Namespace: "n", Metrics: []Metric{{Field: "a", Name: "m"}, {Field: "b", Name: "m"}}},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", c)
+		}
+	}
+	if err := (&Config{}).Validate(); err != nil {
+		t.Errorf("unexpected error of an unset config: %v", err)
+	}
+	if err := (&Config{}).Required(); err == nil {
+		t.Errorf("expected an unset config to miss the namespace")
+	}
+}
@@ -0,0 +1,180 @@
+// Package eventcache keeps what the events in flight in an output were encoded to, so that retried events are sent
+// byte for byte as the first time, to the same shard, without being encoded again.
+// The cache owns the pooled buffers of the records, and returns them to the pool once their events leave the output.
+package eventcache
+
+import (
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/publisher"
+	"github.com/s12v/awsbeats/bufpool"
+	"github.com/s12v/awsbeats/metrics"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// TTL after which an event that wasn't sent again is evicted, e.g. when the pipeline dropped it after `max_retries`.
+const TTL = 10 * time.Minute
+
+// Record is what an event was encoded to.
+type Record struct {
+	PartitionKey string
+	Data         []byte
+	// Number of times the record has been sent, including this one. Set by Get.
+	Attempt int
+}
+
+// Cache of the records of the events in flight in an output. It is shared by the clients of the output, as any of them
+// may send a retried event.
+// Events are told apart by their Fields map, which the pipeline hands back as is on retries. A nil *Cache caches nothing.
+type Cache struct {
+	mu        sync.Mutex
+	entries   map[uintptr]*entry
+	ttl       time.Duration
+	lastSweep time.Time
+	metrics   *metrics.Metrics
+	now       func() time.Time
+}
+
+type entry struct {
+	// Keeps the map alive, so that its address isn't reused by another event while it's cached
+	fields    common.MapStr
+	timestamp time.Time
+	record    Record
+	buf       *bufpool.Buffer
+	expires   time.Time
+	// Number of requests being sent with the record, which must not expire while it's in use
+	inFlight int
+	attempts int
+}
+
+// New returns an empty cache reporting to the given metrics.
+func New(m *metrics.Metrics) *Cache {
+	return &Cache{
+		entries: map[uintptr]*entry{},
+		ttl:     TTL,
+		metrics: m,
+		now:     time.Now,
+	}
+}
+
+func key(event *beat.Event) (uintptr, bool) {
+	if event.Fields == nil {
+		return 0, false
+	}
+	return reflect.ValueOf(event.Fields).Pointer(), true
+}
+
+// Get returns the record the event was encoded to before, if any. The record is in use until the event is released.
+func (c *Cache) Get(event *beat.Event) (Record, bool) {
+	if c == nil {
+		return Record{}, false
+	}
+	k, ok := key(event)
+	if !ok {
+		return Record{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[k]
+	if !ok || !e.timestamp.Equal(event.Timestamp) {
+		return Record{}, false
+	}
+	e.expires = c.now().Add(c.ttl)
+	e.inFlight++
+	e.attempts++
+	c.metrics.EncodeCacheHit()
+	record := e.record
+	record.Attempt = e.attempts
+	return record, true
+}
+
+// Put caches the record the event was encoded to, along with the pooled buffer holding its data, if any. The record is
+// in use until the event is released, and its data must not be modified. Without a cache, buffers are left to the
+// garbage collector.
+func (c *Cache) Put(event *beat.Event, record Record, buf *bufpool.Buffer) {
+	if c == nil {
+		return
+	}
+	k, ok := key(event)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if old, ok := c.entries[k]; ok && old.inFlight == 0 {
+		old.buf.Release()
+	}
+	c.entries[k] = &entry{
+		fields:    event.Fields,
+		timestamp: event.Timestamp,
+		record:    record,
+		buf:       buf,
+		expires:   now.Add(c.ttl),
+		inFlight:  1,
+		attempts:  1,
+	}
+	if now.Sub(c.lastSweep) >= c.ttl {
+		c.sweep(now)
+	}
+	c.metrics.EncodeCacheEntries(len(c.entries))
+}
+
+// Release is called once the response to the given events has been handled. It evicts the events that leave the
+// output, which are all of them but those handed back to the pipeline to be retried, and recycles their buffers.
+func (c *Cache) Release(events []publisher.Event, retried []publisher.Event) {
+	if c == nil || len(events) == 0 {
+		return
+	}
+	keep := make(map[uintptr]bool, len(retried))
+	for i := range retried {
+		if k, ok := key(&retried[i].Content); ok {
+			keep[k] = true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range events {
+		k, ok := key(&events[i].Content)
+		if !ok {
+			continue
+		}
+		e, ok := c.entries[k]
+		if !ok {
+			continue
+		}
+		if e.inFlight > 0 {
+			e.inFlight--
+		}
+		if e.inFlight == 0 && !keep[k] {
+			delete(c.entries, k)
+			e.buf.Release()
+		}
+	}
+	c.metrics.EncodeCacheEntries(len(c.entries))
+}
+
+// Len returns the number of cached events.
+func (c *Cache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *Cache) sweep(now time.Time) {
+	for k, e := range c.entries {
+		if e.inFlight == 0 && now.After(e.expires) {
+			delete(c.entries, k)
+			e.buf.Release()
+		}
+	}
+	c.lastSweep = now
+}
@@ -0,0 +1,96 @@
+package eventcache
+
+import (
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/publisher"
+	"testing"
+	"time"
+)
+
+func event(msg string) publisher.Event {
+	return publisher.Event{Content: beat.Event{Timestamp: time.Unix(1, 0), Fields: common.MapStr{"message": msg}}}
+}
+
+func TestGetPut(t *testing.T) {
+	c := New(nil)
+	a, b := event("a"), event("b")
+	c.Put(&a.Content, Record{PartitionKey: "k", Data: []byte("a")}, nil)
+
+	// A retried event is a copy of the original one, sharing its fields
+	retried := a
+	if r, ok := c.Get(&retried.Content); !ok || r.PartitionKey != "k" || string(r.Data) != "a" || r.Attempt != 2 {
+		t.Errorf("unexpected record: %v, %v", r, ok)
+	}
+	if r, _ := c.Get(&retried.Content); r.Attempt != 3 {
+		t.Errorf("expected the third attempt, got %d", r.Attempt)
+	}
+	if _, ok := c.Get(&b.Content); ok {
+		t.Errorf("expected no record for another event")
+	}
+
+	// Same fields, but another event
+	retried.Content.Timestamp = time.Unix(2, 0)
+	if _, ok := c.Get(&retried.Content); ok {
+		t.Errorf("expected no record for another timestamp")
+	}
+
+	var none publisher.Event
+	c.Put(&none.Content, Record{}, nil)
+	if c.Len() != 1 {
+		t.Errorf("expected events without fields not to be cached")
+	}
+
+	var nilCache *Cache
+	nilCache.Put(&a.Content, Record{}, nil)
+	if _, ok := nilCache.Get(&a.Content); ok {
+		t.Errorf("expected a nil cache to cache nothing")
+	}
+}
+
+func TestRelease(t *testing.T) {
+	c := New(nil)
+	events := []publisher.Event{event("a"), event("b"), event("c")}
+	for i := range events {
+		c.Put(&events[i].Content, Record{}, nil)
+	}
+
+	c.Release(events, events[1:2])
+	if _, ok := c.Get(&events[1].Content); !ok || c.Len() != 1 {
+		t.Errorf("expected only the retried event to be kept, got %d", c.Len())
+	}
+	c.Release(events[1:2], nil)
+	if c.Len() != 0 {
+		t.Errorf("expected an empty cache, got %d", c.Len())
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New(nil)
+	c.now = func() time.Time { return now }
+	a, b, d := event("a"), event("b"), event("d")
+	retried := []publisher.Event{a}
+	c.Put(&a.Content, Record{}, nil)
+	c.Release(retried, retried)
+
+	// Events that are still retried don't expire
+	now = now.Add(TTL / 2)
+	c.Get(&a.Content)
+	c.Release(retried, retried)
+	now = now.Add(TTL)
+	c.Put(&b.Content, Record{}, nil)
+	if c.Len() != 2 {
+		t.Fatalf("expected 2 events, got %d", c.Len())
+	}
+
+	// Events being sent don't expire either
+	now = now.Add(2 * TTL)
+	c.Put(&d.Content, Record{}, nil)
+	if _, ok := c.Get(&a.Content); ok || c.Len() != 2 {
+		t.Errorf("expected the event that wasn't retried to expire, got %d", c.Len())
+	}
+	if _, ok := c.Get(&b.Content); !ok {
+		t.Errorf("expected the event in flight to be kept")
+	}
+}
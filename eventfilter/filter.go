@@ -0,0 +1,84 @@
+// Package eventfilter selects the events an output sends, and the fields it sends of them, independently of the
+// processors of the beat, which apply to all of its outputs.
+package eventfilter
+
+import (
+	"fmt"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/conditions"
+)
+
+// Config of an output's filter. Output configs embed it inline, e.g. `output.streams.include_fields`.
+type Config struct {
+	IncludeFields []string           `config:"include_fields"`
+	DropFields    []string           `config:"drop_fields"`
+	When          *conditions.Config `config:"when"`
+}
+
+func (c *Config) Validate() error {
+	if c.When != nil {
+		if _, err := conditions.NewCondition(c.When); err != nil {
+			return fmt.Errorf("invalid when condition: %v", err)
+		}
+	}
+	return nil
+}
+
+// Filter of the events of an output. A nil *Filter keeps all events as they are.
+type Filter struct {
+	include []string
+	drop    []string
+	when    conditions.Condition
+}
+
+// New returns the filter of the config, or nil if it doesn't filter anything.
+func New(c Config) (*Filter, error) {
+	if len(c.IncludeFields) == 0 && len(c.DropFields) == 0 && c.When == nil {
+		return nil, nil
+	}
+	f := &Filter{include: c.IncludeFields, drop: c.DropFields}
+	if c.When != nil {
+		when, err := conditions.NewCondition(c.When)
+		if err != nil {
+			return nil, fmt.Errorf("invalid when condition: %v", err)
+		}
+		f.when = when
+	}
+	return f, nil
+}
+
+// Match tells whether the event is to be sent, i.e. whether it meets the `when` condition, if any.
+func (f *Filter) Match(event *beat.Event) bool {
+	if f == nil || f.when == nil {
+		return true
+	}
+	return f.when.Check(event)
+}
+
+// Fields returns the event with only the fields to be sent. The event itself is left as it is, as it's shared with
+// the other outputs of the beat and may be retried.
+func (f *Filter) Fields(event *beat.Event) *beat.Event {
+	if f == nil || (len(f.include) == 0 && len(f.drop) == 0) {
+		return event
+	}
+
+	fields := event.Fields
+	if len(f.include) > 0 {
+		// Nested values are shared with the event, and only copied below if some of them are dropped
+		fields = common.MapStr{}
+		for _, key := range f.include {
+			// Missing fields are skipped
+			event.Fields.CopyFieldsTo(fields, key)
+		}
+	}
+	if len(f.drop) > 0 {
+		fields = fields.Clone()
+		for _, key := range f.drop {
+			fields.Delete(key)
+		}
+	}
+	filtered := *event
+	filtered.Fields = fields
+	return &filtered
+}
@@ -0,0 +1,89 @@
+package eventfilter
+
+import (
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"reflect"
+	"testing"
+)
+
+func newFilter(t *testing.T, settings map[string]interface{}) *Filter {
+	var config struct {
+		Filter Config `config:",inline"`
+		Name   string `config:"stream_name"`
+	}
+	if err := common.MustNewConfigFrom(settings).Unpack(&config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f, err := New(config.Filter)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return f
+}
+
+func testEvent() *beat.Event {
+	return &beat.Event{Fields: common.MapStr{
+		"message": "GET /",
+		"host":    common.MapStr{"name": "web-1", "ip": "10.0.0.1"},
+		"level":   "debug",
+	}}
+}
+
+func TestNoFilter(t *testing.T) {
+	f := newFilter(t, map[string]interface{}{"stream_name": "foo"})
+	if f != nil {
+		t.Fatalf("expected no filter")
+	}
+	event := testEvent()
+	if !f.Match(event) || f.Fields(event) != event {
+		t.Errorf("expected events to be sent as they are")
+	}
+}
+
+func TestWhen(t *testing.T) {
+	f := newFilter(t, map[string]interface{}{
+		"when": map[string]interface{}{"not": map[string]interface{}{"equals": map[string]interface{}{"level": "debug"}}},
+	})
+	event := testEvent()
+	if f.Match(event) {
+		t.Errorf("expected a debug event not to match")
+	}
+	event.Fields["level"] = "error"
+	if !f.Match(event) {
+		t.Errorf("expected an error event to match")
+	}
+
+	var config struct {
+		Filter Config `config:",inline"`
+	}
+	err := common.MustNewConfigFrom(map[string]interface{}{"when": map[string]interface{}{"foo": "bar"}}).Unpack(&config)
+	if err == nil {
+		if err = config.Filter.Validate(); err == nil {
+			t.Errorf("expected an invalid condition to fail")
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	event := testEvent()
+	original := event.Fields.Clone()
+
+	f := newFilter(t, map[string]interface{}{"include_fields": []string{"message", "host", "missing"}, "drop_fields": []string{"host.ip"}})
+	filtered := f.Fields(event)
+	expected := common.MapStr{"message": "GET /", "host": common.MapStr{"name": "web-1"}}
+	if !reflect.DeepEqual(filtered.Fields, expected) {
+		t.Errorf("unexpected fields: %v", filtered.Fields)
+	}
+	if !reflect.DeepEqual(event.Fields, original) {
+		t.Errorf("expected the event to be left as it is, got %v", event.Fields)
+	}
+
+	f = newFilter(t, map[string]interface{}{"drop_fields": []string{"level"}})
+	if _, err := f.Fields(event).GetValue("level"); err == nil {
+		t.Errorf("expected level to be dropped")
+	}
+	if !reflect.DeepEqual(event.Fields, original) {
+		t.Errorf("expected the event to be left as it is, got %v", event.Fields)
+	}
+}
@@ -0,0 +1,262 @@
+package fanout
+
+import (
+	"fmt"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/elastic/beats/libbeat/publisher"
+	"github.com/s12v/awsbeats/dedup"
+	"reflect"
+	"sync"
+)
+
+// client publishes the batches of a worker to a client of each sink.
+type client struct {
+	sinks    []*sink
+	observer outputs.Observer
+	// Whether a sink sends event IDs, which are then given to events before they're shared by the sinks
+	addEventIDs bool
+	closeOnce   sync.Once
+}
+
+// sink is a client of one of the outputs of the fanout output.
+type sink struct {
+	name     string
+	required bool
+	client   outputs.NetworkClient
+	observer outputs.Observer
+	log      *logp.Logger
+	// Holds a token while a batch is being sent to a best-effort sink
+	busy chan struct{}
+	// Whether a best-effort sink is connected. Only used while holding busy.
+	connected bool
+}
+
+func newSink(sc sinkConfig, c outputs.Client) *sink {
+	return &sink{
+		name:     sc.Name,
+		required: sc.FailurePolicy == policyRequired,
+		client:   c.(outputs.NetworkClient),
+		observer: sinkStats(sc.Name),
+		log:      logp.NewLogger("fanout"),
+		busy:     make(chan struct{}, 1),
+	}
+}
+
+func (c *client) String() string {
+	return "fanout"
+}
+
+// Connect connects the required sinks. Best-effort sinks are connected when publishing, so that they can't hold back
+// the others.
+func (c *client) Connect() error {
+	for _, s := range c.sinks {
+		if !s.required {
+			continue
+		}
+		if err := s.client.Connect(); err != nil {
+			return fmt.Errorf("failed to connect output %s: %v", s.name, err)
+		}
+	}
+	return nil
+}
+
+func (c *client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		for _, s := range c.sinks {
+			if !s.required {
+				// Waits for the batch being sent
+				s.busy <- struct{}{}
+			}
+			if cerr := s.client.Close(); cerr != nil && err == nil {
+				err = fmt.Errorf("failed to close output %s: %v", s.name, cerr)
+			}
+		}
+	})
+	return err
+}
+
+// Publish sends the batch to every sink. It is acked once every required sink has taken all of its events, and the
+// events that any required sink failed to send are retried, with every sink.
+func (c *client) Publish(batch publisher.Batch) error {
+	events := batch.Events()
+	c.observer.NewBatch(len(events))
+	if c.addEventIDs {
+		for i := range events {
+			dedup.EnsureID(&events[i].Content)
+		}
+	}
+
+	for _, s := range c.sinks {
+		if !s.required {
+			s.publishBestEffort(events)
+		}
+	}
+
+	failed := make([][]publisher.Event, len(c.sinks))
+	dropped := make([][]publisher.Event, len(c.sinks))
+	errs := make([]error, len(c.sinks))
+	var wg sync.WaitGroup
+	for i, s := range c.sinks {
+		if !s.required {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, s *sink) {
+			defer wg.Done()
+			b, err := s.publish(events)
+			failed[i], dropped[i], errs[i] = b.failed, b.dropped, err
+		}(i, s)
+	}
+	wg.Wait()
+
+	rest := union(events, failed)
+	// Events that a required sink dropped are acked to the beat too, unless another one failed them
+	drops := len(except(union(events, dropped), rest))
+	c.observer.Acked(len(events) - len(rest) - drops)
+	c.observer.Dropped(drops)
+	if len(rest) == 0 {
+		batch.ACK()
+	} else {
+		c.observer.Failed(len(rest))
+		batch.RetryEvents(rest)
+	}
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("output %s: %v", c.sinks[i].name, err)
+		}
+	}
+	return nil
+}
+
+// publish sends the events to the sink, returning the batch that tells which events it didn't take.
+func (s *sink) publish(events []publisher.Event) (*sinkBatch, error) {
+	b := &sinkBatch{events: events}
+	err := s.client.Publish(b)
+	return b, err
+}
+
+// publishBestEffort sends a copy of the events to the sink in the background. The batch is skipped while the sink is
+// still sending the previous one.
+func (s *sink) publishBestEffort(events []publisher.Event) {
+	select {
+	case s.busy <- struct{}{}:
+	default:
+		s.log.Debugf("Output %s is busy, skipping %d events", s.name, len(events))
+		s.observer.NewBatch(len(events))
+		s.observer.Dropped(len(events))
+		return
+	}
+
+	events = append([]publisher.Event(nil), events...)
+	go func() {
+		defer func() { <-s.busy }()
+
+		if !s.connected {
+			if err := s.client.Connect(); err != nil {
+				s.log.Warnf("Failed to connect output %s, skipping %d events: %v", s.name, len(events), err)
+				s.observer.NewBatch(len(events))
+				s.observer.Dropped(len(events))
+				return
+			}
+			s.connected = true
+		}
+
+		b, err := s.publish(events)
+		if err != nil {
+			s.log.Warnf("Failed to publish to output %s: %v", s.name, err)
+			s.connected = false
+		}
+		if len(b.failed) > 0 {
+			s.log.Warnf("Output %s failed to send %d events, which are not retried as it's best-effort", s.name, len(b.failed))
+		}
+	}()
+}
+
+// union returns the events that failed on any sink, in the order of the batch. Events are told apart by their Fields
+// map, as sinks hand back the events they were given.
+func union(events []publisher.Event, failed [][]publisher.Event) []publisher.Event {
+	keys := map[uintptr]bool{}
+	for _, f := range failed {
+		for i := range f {
+			keys[key(&f[i])] = true
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var rest []publisher.Event
+	for i := range events {
+		if keys[key(&events[i])] {
+			rest = append(rest, events[i])
+		}
+	}
+	return rest
+}
+
+// except returns the events that aren't in the others.
+func except(events []publisher.Event, others []publisher.Event) []publisher.Event {
+	keys := map[uintptr]bool{}
+	for i := range others {
+		keys[key(&others[i])] = true
+	}
+	var rest []publisher.Event
+	for i := range events {
+		if !keys[key(&events[i])] {
+			rest = append(rest, events[i])
+		}
+	}
+	return rest
+}
+
+// key returns the address of the Fields map of the event, which is 0 for all events without fields.
+func key(event *publisher.Event) uintptr {
+	if event.Content.Fields == nil {
+		return 0
+	}
+	return reflect.ValueOf(event.Content.Fields).Pointer()
+}
+
+// sinkBatch is the batch given to a sink, recording which events the sink didn't take, and which it dropped.
+type sinkBatch struct {
+	events  []publisher.Event
+	failed  []publisher.Event
+	dropped []publisher.Event
+}
+
+func (b *sinkBatch) Events() []publisher.Event {
+	return b.events
+}
+
+func (b *sinkBatch) DroppedEvent(event *publisher.Event) {
+	b.dropped = append(b.dropped, *event)
+}
+
+func (b *sinkBatch) ACK() {
+	b.failed = nil
+}
+
+// Drop is called for events that the sink won't ever take, which retrying doesn't help.
+func (b *sinkBatch) Drop() {
+	b.failed = nil
+	b.dropped = b.events
+}
+
+func (b *sinkBatch) Retry() {
+	b.failed = b.events
+}
+
+func (b *sinkBatch) RetryEvents(events []publisher.Event) {
+	b.failed = events
+}
+
+func (b *sinkBatch) Cancelled() {
+	b.failed = b.events
+}
+
+func (b *sinkBatch) CancelledEvents(events []publisher.Event) {
+	b.failed = events
+}
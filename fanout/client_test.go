@@ -0,0 +1,259 @@
+package fanout
+
+import (
+	"errors"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/elastic/beats/libbeat/publisher"
+	"github.com/s12v/awsbeats/dedup"
+	"github.com/s12v/awsbeats/metrics"
+	"sync"
+	"testing"
+)
+
+type stubBatch struct {
+	events  []publisher.Event
+	acked   bool
+	retried []publisher.Event
+}
+
+func (b *stubBatch) Events() []publisher.Event                { return b.events }
+func (b *stubBatch) ACK()                                     { b.acked = true }
+func (b *stubBatch) Drop()                                    {}
+func (b *stubBatch) Retry()                                   { b.retried = b.events }
+func (b *stubBatch) RetryEvents(events []publisher.Event)     { b.retried = events }
+func (b *stubBatch) Cancelled()                               {}
+func (b *stubBatch) CancelledEvents(events []publisher.Event) {}
+
+// stubClient fails, or drops, the events at the given indexes of every batch.
+type stubClient struct {
+	mu         sync.Mutex
+	fail       []int
+	drop       []int
+	publishErr error
+	connectErr error
+	block      chan struct{}
+	batches    int
+	connects   int
+	closed     bool
+}
+
+func (c *stubClient) String() string { return "stub" }
+
+func (c *stubClient) Connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connects++
+	return c.connectErr
+}
+
+func (c *stubClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *stubClient) Publish(batch publisher.Batch) error {
+	if c.block != nil {
+		<-c.block
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.batches++
+	for _, i := range c.drop {
+		batch.(metrics.DropObserver).DroppedEvent(&batch.Events()[i])
+	}
+	var failed []publisher.Event
+	for _, i := range c.fail {
+		failed = append(failed, batch.Events()[i])
+	}
+	if len(failed) > 0 {
+		batch.RetryEvents(failed)
+	} else {
+		batch.ACK()
+	}
+	return c.publishErr
+}
+
+func (c *stubClient) published() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.batches
+}
+
+func newStubFanout(policies map[string]string, clients map[string]*stubClient, names ...string) *client {
+	c := &client{observer: outputs.NewNilObserver()}
+	for _, name := range names {
+		c.sinks = append(c.sinks, newSink(sinkConfig{Name: name, FailurePolicy: policies[name]}, clients[name]))
+	}
+	return c
+}
+
+func events(n int) []publisher.Event {
+	events := make([]publisher.Event, n)
+	for i := range events {
+		events[i] = publisher.Event{Content: beat.Event{Fields: common.MapStr{"i": i}}}
+	}
+	return events
+}
+
+func TestPublishAcksWhenEveryRequiredSinkTookTheBatch(t *testing.T) {
+	a, b := &stubClient{}, &stubClient{}
+	c := newStubFanout(map[string]string{"a": policyRequired, "b": policyRequired}, map[string]*stubClient{"a": a, "b": b}, "a", "b")
+
+	batch := &stubBatch{events: events(3)}
+	if err := c.Publish(batch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !batch.acked || batch.retried != nil {
+		t.Errorf("expected the batch to be acked")
+	}
+	if a.published() != 1 || b.published() != 1 {
+		t.Errorf("expected every sink to get the batch")
+	}
+}
+
+func TestPublishRetriesEventsFailedByAnyRequiredSink(t *testing.T) {
+	a, b := &stubClient{fail: []int{2}}, &stubClient{fail: []int{0, 2}}
+	c := newStubFanout(map[string]string{"a": policyRequired, "b": policyRequired}, map[string]*stubClient{"a": a, "b": b}, "a", "b")
+
+	batch := &stubBatch{events: events(3)}
+	if err := c.Publish(batch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if batch.acked {
+		t.Errorf("expected the batch not to be acked")
+	}
+	if len(batch.retried) != 2 || batch.retried[0].Content.Fields["i"] != 0 || batch.retried[1].Content.Fields["i"] != 2 {
+		t.Errorf("unexpected retried events: %v", batch.retried)
+	}
+}
+
+// countingObserver counts the events reported to the beat's observer.
+type countingObserver struct {
+	outputs.Observer
+	acked, failed, dropped int
+}
+
+func (o *countingObserver) Acked(n int)   { o.acked += n }
+func (o *countingObserver) Failed(n int)  { o.failed += n }
+func (o *countingObserver) Dropped(n int) { o.dropped += n }
+
+func TestPublishReportsEventsDroppedByARequiredSink(t *testing.T) {
+	a, b, c := &stubClient{drop: []int{1}}, &stubClient{drop: []int{1, 2}, fail: []int{0, 2}}, &stubClient{drop: []int{3}}
+	f := newStubFanout(
+		map[string]string{"a": policyRequired, "b": policyRequired, "c": policyBestEffort},
+		map[string]*stubClient{"a": a, "b": b, "c": c},
+		"a", "b", "c",
+	)
+	observer := &countingObserver{Observer: outputs.NewNilObserver()}
+	f.observer = observer
+
+	// Event 2 is failed by b, which is retried rather than dropped, and best-effort sinks don't count
+	if err := f.Publish(&stubBatch{events: events(4)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if observer.acked != 1 || observer.dropped != 1 || observer.failed != 2 {
+		t.Errorf("unexpected observations: %+v", *observer)
+	}
+	f.Close()
+}
+
+func TestPublishReturnsTheErrorOfARequiredSink(t *testing.T) {
+	a := &stubClient{fail: []int{0}, publishErr: errors.New("unavailable")}
+	c := newStubFanout(map[string]string{"a": policyRequired}, map[string]*stubClient{"a": a}, "a")
+
+	batch := &stubBatch{events: events(1)}
+	if err := c.Publish(batch); err == nil {
+		t.Errorf("expected an error")
+	}
+	if len(batch.retried) != 1 {
+		t.Errorf("expected the event to be retried")
+	}
+}
+
+func TestPublishIgnoresFailuresOfBestEffortSinks(t *testing.T) {
+	a, b := &stubClient{}, &stubClient{fail: []int{0, 1}, publishErr: errors.New("unavailable")}
+	c := newStubFanout(map[string]string{"a": policyRequired, "b": policyBestEffort}, map[string]*stubClient{"a": a, "b": b}, "a", "b")
+
+	batch := &stubBatch{events: events(2)}
+	if err := c.Publish(batch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !batch.acked {
+		t.Errorf("expected the batch to be acked")
+	}
+	c.Close()
+	if b.published() != 1 || !b.closed {
+		t.Errorf("expected the best-effort sink to get the batch before being closed")
+	}
+}
+
+func TestPublishSkipsBatchesWhileABestEffortSinkIsBusy(t *testing.T) {
+	a, b := &stubClient{}, &stubClient{block: make(chan struct{})}
+	c := newStubFanout(map[string]string{"a": policyRequired, "b": policyBestEffort}, map[string]*stubClient{"a": a, "b": b}, "a", "b")
+
+	for i := 0; i < 3; i++ {
+		batch := &stubBatch{events: events(1)}
+		if err := c.Publish(batch); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !batch.acked {
+			t.Errorf("expected batch %d to be acked while the best-effort sink is busy", i)
+		}
+	}
+	close(b.block)
+	c.Close()
+	if a.published() != 3 || b.published() != 1 {
+		t.Errorf("expected the busy sink to skip 2 batches, got %d and %d", a.published(), b.published())
+	}
+}
+
+func TestPublishConnectsBestEffortSinksLazily(t *testing.T) {
+	a, b := &stubClient{}, &stubClient{connectErr: errors.New("unavailable")}
+	c := newStubFanout(map[string]string{"a": policyRequired, "b": policyBestEffort}, map[string]*stubClient{"a": a, "b": b}, "a", "b")
+
+	if err := c.Connect(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a.connects != 1 || b.connects != 0 {
+		t.Errorf("expected only the required sink to be connected")
+	}
+
+	batch := &stubBatch{events: events(1)}
+	if err := c.Publish(batch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Waits for the best-effort sink
+	c.Close()
+	if b.published() != 0 {
+		t.Errorf("expected no batch to be sent to a sink that failed to connect")
+	}
+}
+
+func TestConnectFailsWhenARequiredSinkFails(t *testing.T) {
+	a := &stubClient{connectErr: errors.New("unavailable")}
+	c := newStubFanout(map[string]string{"a": policyRequired}, map[string]*stubClient{"a": a}, "a")
+	if err := c.Connect(); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestPublishGivesEventsIDsSharedBySinks(t *testing.T) {
+	a, b := &stubClient{}, &stubClient{}
+	c := newStubFanout(map[string]string{"a": policyRequired, "b": policyBestEffort}, map[string]*stubClient{"a": a, "b": b}, "a", "b")
+	c.addEventIDs = true
+
+	batch := &stubBatch{events: events(2)}
+	if err := c.Publish(batch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.Close()
+	for i, event := range batch.events {
+		if event.Content.Meta[dedup.IDKey] == nil {
+			t.Errorf("expected event %d to have an ID", i)
+		}
+	}
+}
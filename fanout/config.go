@@ -0,0 +1,106 @@
+package fanout
+
+import (
+	"errors"
+	"fmt"
+	"github.com/elastic/beats/libbeat/common"
+	"regexp"
+)
+
+const (
+	policyRequired   = "required"
+	policyBestEffort = "best_effort"
+
+	defaultBatchSize = 50
+	// The most records a single request of both Kinesis Data Streams and Firehose takes
+	maxBatchSize = 500
+)
+
+var (
+	sinkNamePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	// Settings of the fanout output that its outputs share, as every batch is sent to all of them
+	groupSettings = []string{"batch_size", "max_retries", "workers"}
+)
+
+type FanoutConfig struct {
+	Outputs    []*common.Config `config:"outputs"`
+	BatchSize  int              `config:"batch_size"`
+	MaxRetries int              `config:"max_retries"`
+	Workers    int              `config:"workers"`
+}
+
+// sinkConfig is what the fanout output reads of the config of a sink. The rest of it is the config of the sink's
+// output, e.g. `stream_name`.
+type sinkConfig struct {
+	Name          string `config:"name"`
+	Type          string `config:"type"`
+	FailurePolicy string `config:"failure_policy"`
+	AddEventID    bool   `config:"add_event_id"`
+
+	config *common.Config
+}
+
+var (
+	defaultConfig = FanoutConfig{
+		BatchSize:  defaultBatchSize,
+		MaxRetries: 3,
+		Workers:    1,
+	}
+)
+
+func (c *FanoutConfig) Validate() error {
+	if len(c.Outputs) == 0 {
+		return errors.New("outputs are not defined")
+	}
+
+	if c.BatchSize > maxBatchSize || c.BatchSize < 1 {
+		return errors.New("invalid batch size")
+	}
+
+	if c.Workers < 0 {
+		return errors.New("workers must not be negative")
+	}
+
+	_, err := c.sinks()
+	return err
+}
+
+// sinks reads the name, type and failure policy of the outputs.
+func (c *FanoutConfig) sinks() ([]sinkConfig, error) {
+	sinks := make([]sinkConfig, len(c.Outputs))
+	names := map[string]bool{}
+	required := false
+	for i, cfg := range c.Outputs {
+		sink := sinkConfig{FailurePolicy: policyRequired, config: cfg}
+		if err := cfg.Unpack(&sink); err != nil {
+			return nil, err
+		}
+		if !sinkNamePattern.MatchString(sink.Name) {
+			return nil, fmt.Errorf("invalid name %q of output %d: only lowercase letters, digits, _ and - are allowed", sink.Name, i)
+		}
+		if names[sink.Name] {
+			return nil, fmt.Errorf("output %s is defined twice", sink.Name)
+		}
+		names[sink.Name] = true
+		for _, field := range groupSettings {
+			if cfg.HasField(field) {
+				return nil, fmt.Errorf("%s can't be set on output %s, only on the fanout output, for all outputs", field, sink.Name)
+			}
+		}
+		if _, ok := factories[sink.Type]; !ok {
+			return nil, fmt.Errorf("invalid type %q of output %s: only streams and firehose are supported", sink.Type, sink.Name)
+		}
+		switch sink.FailurePolicy {
+		case policyRequired:
+			required = true
+		case policyBestEffort:
+		default:
+			return nil, fmt.Errorf("invalid failure_policy %q of output %s: must be required or best_effort", sink.FailurePolicy, sink.Name)
+		}
+		sinks[i] = sink
+	}
+	if !required {
+		return nil, errors.New("at least one output must be required, or every event would be acked right away")
+	}
+	return sinks, nil
+}
@@ -0,0 +1,69 @@
+package fanout
+
+import (
+	"github.com/elastic/beats/libbeat/common"
+	"testing"
+)
+
+func configFrom(t *testing.T, v map[string]interface{}) *FanoutConfig {
+	config := defaultConfig
+	if err := common.MustNewConfigFrom(v).Unpack(&config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return &config
+}
+
+func TestValidateWithoutOutputs(t *testing.T) {
+	config := defaultConfig
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestValidateSinks(t *testing.T) {
+	config := configFrom(t, map[string]interface{}{
+		"outputs": []map[string]interface{}{
+			{"name": "firehose", "type": "firehose", "failure_policy": "best_effort"},
+			{"name": "streams", "type": "streams"},
+		},
+	})
+	sinks, err := config.sinks()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sinks) != 2 || sinks[0].FailurePolicy != policyBestEffort || sinks[1].FailurePolicy != policyRequired {
+		t.Errorf("unexpected sinks: %+v", sinks)
+	}
+}
+
+func TestValidateInvalidSinks(t *testing.T) {
+	cases := map[string][]map[string]interface{}{
+		"no name":        {{"type": "streams"}},
+		"invalid name":   {{"name": "Streams.A", "type": "streams"}},
+		"duplicate name": {{"name": "a", "type": "streams"}, {"name": "a", "type": "firehose"}},
+		"unknown type":   {{"name": "a", "type": "kafka"}},
+		"unknown policy": {{"name": "a", "type": "streams", "failure_policy": "sometimes"}},
+		"none required":  {{"name": "a", "type": "streams", "failure_policy": "best_effort"}},
+		"workers":        {{"name": "a", "type": "streams", "workers": 2}},
+		"batch size":     {{"name": "a", "type": "streams", "batch_size": 100}},
+		"max retries":    {{"name": "a", "type": "streams", "max_retries": 5}},
+	}
+	for name, outputs := range cases {
+		config := defaultConfig
+		err := common.MustNewConfigFrom(map[string]interface{}{"outputs": outputs}).Unpack(&config)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestValidateInvalidBatchSize(t *testing.T) {
+	config := defaultConfig
+	err := common.MustNewConfigFrom(map[string]interface{}{
+		"batch_size": 501,
+		"outputs":    []map[string]interface{}{{"name": "a", "type": "streams"}},
+	}).Unpack(&config)
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+}
@@ -0,0 +1,98 @@
+// Package fanout is an output that publishes every batch to several named outputs of this plugin, e.g. to both a
+// Firehose delivery stream and a Kinesis data stream while migrating from one to the other, as libbeat only allows a
+// single output per beat.
+package fanout
+
+import (
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/monitoring"
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/s12v/awsbeats/firehose"
+	"github.com/s12v/awsbeats/streams"
+	"sync"
+)
+
+var (
+	// Outputs that a sink can be
+	factories = map[string]outputs.Factory{
+		"firehose": firehose.New,
+		"streams":  streams.New,
+	}
+
+	statsMu sync.Mutex
+	stats   = map[string]*outputs.Stats{}
+)
+
+func New(
+	im outputs.IndexManager,
+	beat beat.Info,
+	observer outputs.Observer,
+	cfg *common.Config,
+) (outputs.Group, error) {
+	config := defaultConfig
+	if err := cfg.Unpack(&config); err != nil {
+		return outputs.Fail(err)
+	}
+	sinkConfigs, err := config.sinks()
+	if err != nil {
+		return outputs.Fail(err)
+	}
+
+	// Every worker publishes to a client of each sink, so that each sink runs as many workers as the fanout output
+	n := workers(config.Workers)
+	addEventIDs := false
+	for _, sc := range sinkConfigs {
+		addEventIDs = addEventIDs || sc.AddEventID
+	}
+	clients := make([]*client, n)
+	for i := range clients {
+		clients[i] = &client{observer: observer, addEventIDs: addEventIDs}
+	}
+	for _, sc := range sinkConfigs {
+		sc.config.SetInt("workers", -1, int64(n))
+		if !sc.config.HasField("spool.path") {
+			// Sinks of the same type must not share a spool
+			sc.config.SetString("spool.path", -1, "spool/fanout/"+sc.Name)
+		}
+		group, err := factories[sc.Type](im, beat, sinkStats(sc.Name), sc.config)
+		if err != nil {
+			return outputs.Fail(err)
+		}
+		for i, c := range clients {
+			c.sinks = append(c.sinks, newSink(sc, group.Clients[i]))
+		}
+	}
+
+	outputClients := make([]outputs.Client, n)
+	for i, c := range clients {
+		// Not wrapped with a backoff, as the clients of the sinks already are
+		outputClients[i] = c
+	}
+	return outputs.Success(config.BatchSize, config.MaxRetries, outputClients...)
+}
+
+// sinkStats returns the standard output metrics of a sink, registered under `libbeat.outputs.fanout.<name>` on first
+// use. They survive the output being reloaded, as libbeat doesn't allow registering a metric twice.
+func sinkStats(name string) *outputs.Stats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	if s, ok := stats[name]; ok {
+		return s
+	}
+	libbeat := monitoring.Default.GetRegistry("libbeat")
+	if libbeat == nil {
+		libbeat = monitoring.Default.NewRegistry("libbeat")
+	}
+	s := outputs.NewStats(libbeat.NewRegistry("outputs.fanout." + name))
+	stats[name] = s
+	return s
+}
+
+func workers(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,52 @@
+package fanout
+
+import (
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/outputs"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"workers": 2,
+		"outputs": []map[string]interface{}{
+			{"name": "old", "type": "firehose", "region": "eu-central-1", "stream_name": "foo"},
+			{"name": "new", "type": "streams", "region": "eu-central-1", "stream_name": "bar", "failure_policy": "best_effort"},
+		},
+	})
+	group, err := New(nil, beat.Info{Beat: "filebeat"}, outputs.NewNilObserver(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(group.Clients) != 2 {
+		t.Fatalf("expected 2 clients, got %d", len(group.Clients))
+	}
+	if group.BatchSize != defaultBatchSize {
+		t.Errorf("unexpected batch size: %d", group.BatchSize)
+	}
+	c := group.Clients[0].(*client)
+	if len(c.sinks) != 2 || c.sinks[0].name != "old" || !c.sinks[0].required || c.sinks[1].name != "new" || c.sinks[1].required {
+		t.Errorf("unexpected sinks: %+v", c.sinks)
+	}
+	if group.Clients[0].(*client).sinks[0].client == group.Clients[1].(*client).sinks[0].client {
+		t.Errorf("expected each worker to use its own client of a sink")
+	}
+}
+
+func TestNewWithInvalidSink(t *testing.T) {
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"outputs": []map[string]interface{}{
+			{"name": "a", "type": "streams", "region": "eu-central-1"},
+		},
+	})
+	if _, err := New(nil, beat.Info{Beat: "filebeat"}, outputs.NewNilObserver(), cfg); err == nil {
+		t.Errorf("expected a sink without a stream to fail")
+	}
+}
+
+func TestSinkStatsSurviveReloads(t *testing.T) {
+	if sinkStats("reloaded") != sinkStats("reloaded") {
+		t.Errorf("expected the stats of a sink to be registered once")
+	}
+}
@@ -1,6 +1,7 @@
 package firehose
 
 import (
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/firehose"
@@ -10,22 +11,65 @@ import (
 	"github.com/elastic/beats/libbeat/outputs/codec"
 	"github.com/elastic/beats/libbeat/outputs/codec/json"
 	"github.com/elastic/beats/libbeat/publisher"
+	"github.com/s12v/awsbeats/awsconfig"
+	"github.com/s12v/awsbeats/awsmetadata"
+	"github.com/s12v/awsbeats/bufpool"
+	"github.com/s12v/awsbeats/dedup"
+	"github.com/s12v/awsbeats/eventcache"
+	"github.com/s12v/awsbeats/eventfilter"
+	"github.com/s12v/awsbeats/metrics"
+	"github.com/s12v/awsbeats/schema"
+	"github.com/s12v/awsbeats/spool"
 	"time"
 )
 
+// describeRetryInterval is how often a delivery stream that couldn't be described on connect is described again.
+const describeRetryInterval = time.Minute
+
 type client struct {
-	firehose           *firehose.Firehose
+	firehose           API
 	deliveryStreamName string
+	deliveryStreamARN  string
+	configuredARN      *awsconfig.ResourceARN
+	described          bool
+	describedAt        time.Time
+	region             string
 	beatName           string
 	encoder            codec.Codec
 	timeout            time.Duration
 	observer           outputs.Observer
+	metrics            *metrics.Metrics
+	spool              *spool.Spool
+	spoolAcquired      bool
+	cache              *eventcache.Cache
+	filter             *eventfilter.Filter
+	metadata           *awsmetadata.Stamper
+	addEventID         bool
+	schema             *schema.Codec
+	schemaAcquired     bool
+	// Of the batch being published, if it keeps track of the events that are dropped
+	drops metrics.DropObserver
+}
+
+// API is the part of the Firehose API the output calls, implemented by *firehose.Firehose and wrapped by middlewares.
+type API interface {
+	PutRecordBatch(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error)
+	DescribeDeliveryStream(input *firehose.DescribeDeliveryStreamInput) (*firehose.DescribeDeliveryStreamOutput, error)
 }
 
 func newClient(sess *session.Session, config *FirehoseConfig, observer outputs.Observer, beat beat.Info) (*client, error) {
+	deliveryStreamName := config.DeliveryStreamName
+	var configuredARN *awsconfig.ResourceARN
+	if config.DeliveryStreamARN != "" {
+		// Validated along with the config
+		arn, _ := awsconfig.ParseResourceARN(config.DeliveryStreamARN, "firehose", "deliverystream")
+		deliveryStreamName, configuredARN = arn.Name, &arn
+	}
 	client := &client{
-		firehose:           firehose.New(sess),
-		deliveryStreamName: config.DeliveryStreamName,
+		firehose:           wrap(firehose.New(sess)),
+		deliveryStreamName: deliveryStreamName,
+		configuredARN:      configuredARN,
+		region:             aws.StringValue(sess.Config.Region),
 		beatName:           beat.Beat,
 		encoder: json.New(beat.Version, json.Config{
 			Pretty:     false,
@@ -33,7 +77,15 @@ func newClient(sess *session.Session, config *FirehoseConfig, observer outputs.O
 		}),
 		timeout:  config.Timeout,
 		observer: observer,
+		metrics:  metrics.Get("firehose"),
 	}
+	filter, err := eventfilter.New(config.Filter)
+	if err != nil {
+		return nil, err
+	}
+	client.filter = filter
+	client.addEventID = config.AddEventID
+	client.metadata = awsmetadata.New(config.AWSMetadata, client.deliveryStreamName, client.region)
 
 	return client, nil
 }
@@ -43,16 +95,114 @@ func (client *client) String() string {
 }
 
 func (client *client) Close() error {
-	return nil
+	err := client.releaseSpool()
+	if serr := client.releaseSchema(); err == nil {
+		err = serr
+	}
+	return err
 }
 
 func (client *client) Connect() error {
+	if err := client.acquireSpool(); err != nil {
+		return err
+	}
+	client.acquireSchema()
+	if err := client.schema.Resolve(); err != nil {
+		return err
+	}
+	err := client.describeDeliveryStream()
+	if _, ok := err.(*unavailableError); err != nil && !ok && client.spool != nil {
+		// Events are spooled until the delivery stream can be reached
+		logp.NewLogger("firehose").Warnf("spooling events until the delivery stream can be described: %v", err)
+		return nil
+	}
+	return err
+}
+
+// acquireSchema keeps the schema codec, and its dead letter file, open while the client is connected.
+func (client *client) acquireSchema() {
+	if client.schemaAcquired {
+		return
+	}
+	client.schema.Acquire()
+	client.schemaAcquired = true
+}
+
+func (client *client) releaseSchema() error {
+	if !client.schemaAcquired {
+		return nil
+	}
+	client.schemaAcquired = false
+	return client.schema.Close()
+}
+
+// describeDeliveryStream fails unless the delivery stream exists and is ready to receive records.
+func (client *client) describeDeliveryStream() error {
+	client.describedAt = time.Now()
+	res, err := client.firehose.DescribeDeliveryStream(&firehose.DescribeDeliveryStreamInput{
+		DeliveryStreamName: aws.String(client.deliveryStreamName),
+	})
+	if err != nil {
+		if err, ok := client.apiError("DescribeDeliveryStream", err).(*unavailableError); ok {
+			return err
+		}
+		return fmt.Errorf("failed to describe delivery stream %s: %v", client.deliveryStreamName, err)
+	}
+
+	description := res.DeliveryStreamDescription
+	status := aws.StringValue(description.DeliveryStreamStatus)
+	if status != firehose.DeliveryStreamStatusActive {
+		return fmt.Errorf("delivery stream %s is not active: %s", client.deliveryStreamName, status)
+	}
+	client.deliveryStreamARN = aws.StringValue(description.DeliveryStreamARN)
+	if client.configuredARN != nil && client.deliveryStreamARN != client.configuredARN.ARN {
+		// The Firehose API addresses delivery streams by name, in the account of the credentials
+		return &unavailableError{fmt.Sprintf(
+			"found %s instead of %s: set role_arn to a role of account %s",
+			client.deliveryStreamARN, client.configuredARN.ARN, client.configuredARN.Account,
+		)}
+	}
+
+	encryption := firehose.DeliveryStreamEncryptionStatusDisabled
+	if description.DeliveryStreamEncryptionConfiguration != nil {
+		encryption = aws.StringValue(description.DeliveryStreamEncryptionConfiguration.Status)
+	}
+	logp.NewLogger("firehose").Infof(
+		"delivery stream %s: status=%s type=%s encryption=%s",
+		client.deliveryStreamName, status, aws.StringValue(description.DeliveryStreamType), encryption,
+	)
+	client.described = true
 	return nil
 }
 
+// retryDescribe describes the delivery stream again every describeRetryInterval while it couldn't be, which only
+// happens with a spool.
+func (client *client) retryDescribe() error {
+	if client.described || time.Since(client.describedAt) < describeRetryInterval {
+		return nil
+	}
+	err := client.describeDeliveryStream()
+	if _, ok := err.(*unavailableError); err != nil && !ok {
+		logp.NewLogger("firehose").Warnf("failed to describe delivery stream: %v", err)
+		return nil
+	}
+	return err
+}
+
 func (client *client) Publish(batch publisher.Batch) error {
 	events := batch.Events()
-	rest, _ := client.publishEvents(events)
+	client.drops, _ = batch.(metrics.DropObserver)
+	defer func() { client.drops = nil }()
+	var rest []publisher.Event
+	err := client.retryDescribe()
+	if err != nil {
+		rest = client.failEvents(events, err)
+	} else if client.spool != nil {
+		rest, err = client.publishEventsSpooled(events)
+	} else {
+		rest, err = client.publishEvents(events)
+	}
+	client.cache.Release(events, rest)
 	if len(rest) == 0 {
 		// We have to ACK only when all the submission succeeded
 		// Ref: https://github.com/elastic/beats/blob/c4af03c51373c1de7daaca660f5d21b3f602771c/libbeat/outputs/elasticsearch/client.go#L232
@@ -62,56 +212,114 @@ func (client *client) Publish(batch publisher.Batch) error {
 		// Ref: https://github.com/elastic/beats/blob/c4af03c51373c1de7daaca660f5d21b3f602771c/libbeat/outputs/elasticsearch/client.go#L234
 		batch.RetryEvents(rest)
 	}
+	if _, ok := err.(*unavailableError); ok {
+		// Go back to connecting, which waits with backoff until the delivery stream is usable again
+		return err
+	}
 	// This shouldn't be an error object according to other official beats' implementations
 	// Ref: https://github.com/elastic/beats/blob/c4af03c51373c1de7daaca660f5d21b3f602771c/libbeat/outputs/kafka/client.go#L119
 	return nil
 }
 
 func (client *client) publishEvents(events []publisher.Event) ([]publisher.Event, error) {
-	observer := client.observer
-	observer.NewBatch(len(events))
+	client.observer.NewBatch(len(events))
 
 	logp.NewLogger("firehose").Debug("received events: %v", events)
-	okEvents, records, dropped := client.mapEvents(events)
+	records, carried, dropped := client.mapEvents(events)
+	logp.NewLogger("firehose").Debug("mapped to records: %v", records)
+	return client.publishRecords(records, carried, dropped)
+}
 
-	logp.NewLogger("firehose").Debug("sent %d records: %v", len(records), records)
-	observer.Dropped(dropped)
-	observer.Acked(len(okEvents))
+// failEvents retries all the events of a batch that can't be sent at all.
+func (client *client) failEvents(events []publisher.Event, err error) []publisher.Event {
+	client.observer.NewBatch(len(events))
+	metrics.Outcome{Failed: len(events), Err: err}.Report(client.observer, client.metrics)
+	return events
+}
+
+func (client *client) publishRecords(records []*firehose.Record, carried recordEvents, dropped int) ([]publisher.Event, error) {
+	outcome := metrics.Outcome{Dropped: dropped}
+	if len(records) == 0 {
+		outcome.Report(client.observer, client.metrics)
+		return []publisher.Event{}, nil
+	}
 
-	logp.NewLogger("firehose").Debug("mapped to records: %v", records)
 	res, err := client.sendRecords(records)
-	failed := collectFailedEvents(res, events)
+	failed := collectFailedEvents(res, carried)
+	outcome.Throttled = countThrottled(res, carried)
+	spooled := 0
 	if err != nil && len(failed) == 0 {
-		failed = events
+		failed = carried.all()
+		if isThrottled(errorCode(err)) {
+			outcome.Throttled = len(failed)
+		}
+		if _, ok := err.(*unavailableError); !ok && client.spool != nil && client.spoolRecords(records) {
+			// Sent later on, and only acked then
+			spooled, failed = len(failed), nil
+			outcome.Throttled = 0
+		}
+		outcome.Err = err
 	}
+	outcome.Acked = carried.count() - len(failed) - spooled
+	outcome.Failed = len(failed)
+	outcome.Bytes = recordsSize(records)
+	outcome.Report(client.observer, client.metrics)
 	if len(failed) > 0 {
 		logp.NewLogger("firehose").Info("retrying %d events on error: %v", len(failed), err)
 	}
 	return failed, err
 }
 
-func (client *client) mapEvents(events []publisher.Event) ([]publisher.Event, []*firehose.Record, int) {
+// dropped tells the batch being published that one of its events is dropped.
+func (client *client) dropped(event *publisher.Event) {
+	if client.drops != nil {
+		client.drops.DroppedEvent(event)
+	}
+}
+
+// mapEvents turns the events into records, along with the events each record carries. Events that can't be mapped are
+// dropped.
+func (client *client) mapEvents(events []publisher.Event) ([]*firehose.Record, recordEvents, int) {
 	dropped := 0
 	records := make([]*firehose.Record, 0, len(events))
-	okEvents := make([]publisher.Event, 0, len(events))
-	for _, event := range events {
-		record, err := client.mapEvent(&event)
+	carried := make(recordEvents, 0, len(events))
+	meta := client.metadata.Batch()
+	for i := range events {
+		if !client.filter.Match(&events[i].Content) {
+			// Acked as dropped, without being sent
+			client.metrics.FilteredEvent()
+			client.dropped(&events[i])
+			dropped++
+			continue
+		}
+		if client.addEventID {
+			// Encoded into the record, which retries reuse, along with the metadata it's kept in
+			dedup.EnsureID(&events[i].Content)
+		}
+		record, err := client.mapEvent(&events[i], meta)
 		if err != nil {
-			logp.NewLogger("firehose").Warn("failed to map event(%v): %v", event, err)
+			logp.NewLogger("firehose").Warn("failed to map event(%v): %v", events[i], err)
+			client.dropped(&events[i])
 			dropped++
 		} else {
-			okEvents = append(okEvents, event)
 			records = append(records, record)
+			// Sliced rather than copied, capped so that it can't be appended to
+			carried = append(carried, events[i:i+1:i+1])
 		}
 	}
 
-	return okEvents, records, dropped
+	return records, carried, dropped
 }
 
-func (client *client) mapEvent(event *publisher.Event) (*firehose.Record, error) {
-	var buf []byte
+func (client *client) mapEvent(event *publisher.Event, meta *awsmetadata.Batch) (*firehose.Record, error) {
+	if record, ok := client.cache.Get(&event.Content); ok {
+		// Retried events are sent as they were the first time
+		return &firehose.Record{Data: meta.Stamp(record.Data, record.Attempt)}, nil
+	}
+
+	var buf *bufpool.Buffer
 	{
-		serializedEvent, err := client.encoder.Encode(client.beatName, &event.Content)
+		serializedEvent, err := client.encoder.Encode(client.beatName, client.filter.Fields(&event.Content))
 		if err != nil {
 			if !event.Guaranteed() {
 				return nil, err
@@ -120,39 +328,86 @@ func (client *client) mapEvent(event *publisher.Event) (*firehose.Record, error)
 			logp.NewLogger("firehose").Error("Unable to encode event: %v", err)
 			return nil, err
 		}
+		// Binary records of a schema aren't delimited
+		delimited := client.schema == nil
+		size := len(serializedEvent)
+		if delimited {
+			size++
+		}
 		// See https://github.com/elastic/beats/blob/5a6630a8bc9b9caf312978f57d1d9193bdab1ac7/libbeat/outputs/kafka/client.go#L163-L164
 		// You need to copy the byte data like this. Otherwise you see strange issues like all the records sent in a same batch has the same Data.
-		buf = make([]byte, len(serializedEvent)+1)
-		copy(buf, serializedEvent)
+		buf = bufpool.Get(size)
+		copy(buf.B, serializedEvent)
 		// Firehose doesn't automatically add trailing new-line on after each record.
 		// This ends up a stream->firehose->s3 pipeline to produce useless s3 objects.
 		// No ndjson, but a sequence of json objects without separators...
 		// Fix it just adding a new-line.
 		//
 		// See https://stackoverflow.com/questions/43010117/writing-properly-formatted-json-to-s3-to-load-in-athena-redshift
-		buf[len(buf)-1] = byte('\n')
+		if delimited {
+			buf.B[len(buf.B)-1] = byte('\n')
+		}
 	}
 
-	return &firehose.Record{Data: buf}, nil
+	client.cache.Put(&event.Content, eventcache.Record{Data: buf.B}, buf)
+	return &firehose.Record{Data: meta.Stamp(buf.B, 1)}, nil
 }
 func (client *client) sendRecords(records []*firehose.Record) (*firehose.PutRecordBatchOutput, error) {
 	request := firehose.PutRecordBatchInput{
 		DeliveryStreamName: &client.deliveryStreamName,
 		Records:            records,
 	}
-	return client.firehose.PutRecordBatch(&request)
+	start := time.Now()
+	res, err := client.firehose.PutRecordBatch(&request)
+	client.observeRequest(time.Since(start), records, err)
+	if err != nil {
+		return res, client.apiError("PutRecordBatch", err)
+	}
+	client.observeFailedEntries(res)
+	return res, nil
 }
 
-func collectFailedEvents(res *firehose.PutRecordBatchOutput, events []publisher.Event) []publisher.Event {
-	if aws.Int64Value(res.FailedPutCount) > 0 {
+// collectFailedEvents returns the events carried by the records that PutRecordBatch failed to put.
+// Entries of the response are matched to records by their index in the request.
+func collectFailedEvents(res *firehose.PutRecordBatchOutput, carried recordEvents) []publisher.Event {
+	if res != nil && aws.Int64Value(res.FailedPutCount) > 0 {
 		failedEvents := make([]publisher.Event, 0)
 		responses := res.RequestResponses
+		if len(responses) != len(carried) {
+			logp.NewLogger("firehose").Warnf("firehose returned %d entries for %d records", len(responses), len(carried))
+		}
 		for i, r := range responses {
-			if aws.StringValue(r.ErrorCode) != "" {
-				failedEvents = append(failedEvents, events[i])
+			if i >= len(carried) {
+				break
+			}
+			if r != nil && aws.StringValue(r.ErrorCode) != "" {
+				failedEvents = append(failedEvents, carried[i]...)
 			}
 		}
 		return failedEvents
 	}
 	return []publisher.Event{}
 }
+
+// recordEvents holds the events carried by each record of a request, at the index of the record.
+// Responses refer to records by their index in the request, which only matches the index of the original events as long
+// as each event makes exactly one record.
+type recordEvents [][]publisher.Event
+
+// all returns the events carried by all the records, in order.
+func (r recordEvents) all() []publisher.Event {
+	events := make([]publisher.Event, 0, r.count())
+	for _, carried := range r {
+		events = append(events, carried...)
+	}
+	return events
+}
+
+// count returns the number of events carried by all the records.
+func (r recordEvents) count() int {
+	n := 0
+	for _, carried := range r {
+		n += len(carried)
+	}
+	return n
+}
@@ -1,22 +1,50 @@
 package firehose
 
 import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/firehose"
 	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/elastic/beats/libbeat/outputs/codec/json"
 	"github.com/elastic/beats/libbeat/publisher"
+	"github.com/s12v/awsbeats/awsconfig"
+	"github.com/s12v/awsbeats/awstest"
+	"github.com/s12v/awsbeats/eventcache"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 type MockCodec struct {
 }
 
+type stubBatch struct {
+	events  []publisher.Event
+	acked   bool
+	retried []publisher.Event
+}
+
+func (b *stubBatch) Events() []publisher.Event                { return b.events }
+func (b *stubBatch) ACK()                                     { b.acked = true }
+func (b *stubBatch) Drop()                                    {}
+func (b *stubBatch) Retry()                                   { b.retried = b.events }
+func (b *stubBatch) RetryEvents(events []publisher.Event)     { b.retried = events }
+func (b *stubBatch) Cancelled()                               {}
+func (b *stubBatch) CancelledEvents(events []publisher.Event) {}
+
 func (mock MockCodec) Encode(index string, event *beat.Event) ([]byte, error) {
 	return []byte("boom"), nil
 }
 
 func TestMapEvent(t *testing.T) {
 	client := client{encoder: MockCodec{}}
-	record, _ := client.mapEvent(&publisher.Event{})
+	record, _ := client.mapEvent(&publisher.Event{}, nil)
 
 	if string(record.Data) != "boom\n" {
 		t.Errorf("Unexpected data: %s", record.Data)
@@ -26,14 +54,14 @@ func TestMapEvent(t *testing.T) {
 func TestMapEvents(t *testing.T) {
 	client := client{encoder: MockCodec{}}
 	events := []publisher.Event{{}}
-	okEvents, records, _ := client.mapEvents(events)
+	records, carried, _ := client.mapEvents(events)
 
 	if len(records) != 1 {
 		t.Errorf("Expected 1 records, got %v", len(records))
 	}
 
-	if len(okEvents) != 1 {
-		t.Errorf("Expected 1 ok events, got %v", len(okEvents))
+	if carried.count() != 1 {
+		t.Errorf("Expected 1 ok events, got %v", carried.count())
 	}
 
 	if string(records[0].Data) != "boom\n" {
@@ -44,7 +72,7 @@ func TestMapEvents(t *testing.T) {
 func TestCollectFailedEvents(t *testing.T) {
 	client := client{encoder: MockCodec{}}
 	events := []publisher.Event{{}, {}}
-	okEvents, _, _ := client.mapEvents(events)
+	_, carried, _ := client.mapEvents(events)
 
 	res := firehose.PutRecordBatchOutput{}
 	entry1 := firehose.PutRecordBatchResponseEntry{}
@@ -53,7 +81,7 @@ func TestCollectFailedEvents(t *testing.T) {
 	res.SetRequestResponses(responses)
 
 	{
-		failed := collectFailedEvents(&res, okEvents)
+		failed := collectFailedEvents(&res, carried)
 
 		if len(failed) != 0 {
 			t.Errorf("Expected 0 failed, got %v", len(failed))
@@ -63,12 +91,79 @@ func TestCollectFailedEvents(t *testing.T) {
 		res.SetFailedPutCount(1)
 		entry2.SetErrorCode("boom")
 
-		failed := collectFailedEvents(&res, okEvents)
+		failed := collectFailedEvents(&res, carried)
 
 		if len(failed) != 1 {
 			t.Errorf("Expected 1 failed, got %v", len(failed))
 		}
 	}
+	{
+		// Every event carried by a failed record is failed
+		a := publisher.Event{Content: beat.Event{Meta: common.MapStr{"n": 1}}}
+		b := publisher.Event{Content: beat.Event{Meta: common.MapStr{"n": 2}}}
+		failed := collectFailedEvents(&res, recordEvents{{a}, {a, b}})
+
+		if len(failed) != 2 || failed[1].Content.Meta["n"] != 2 {
+			t.Errorf("unexpected failed events: %v", failed)
+		}
+	}
+}
+
+// failingCodec fails to encode events with the `fail` field set.
+type failingCodec struct{}
+
+func (failingCodec) Encode(index string, event *beat.Event) ([]byte, error) {
+	if _, ok := event.Fields["fail"]; ok {
+		return nil, errors.New("can't encode")
+	}
+	return []byte(event.Fields.String()), nil
+}
+
+func TestPublishEventsRetriesEventsOfFailedRecords(t *testing.T) {
+	client := client{deliveryStreamName: "foo", encoder: failingCodec{}, observer: outputs.NewNilObserver()}
+	var server *httptest.Server
+	client.firehose, server = newTestFirehose(200, `{"FailedPutCount":1,"RequestResponses":[{"RecordId":"1"},{"ErrorCode":"InternalFailure"}]}`)
+	defer server.Close()
+
+	// The second event can't be encoded, so the second record carries the third event
+	events := []publisher.Event{
+		{Content: beat.Event{Fields: common.MapStr{"n": 1}}},
+		{Content: beat.Event{Fields: common.MapStr{"fail": true}}},
+		{Content: beat.Event{Fields: common.MapStr{"n": 3}}},
+	}
+	rest, err := client.publishEvents(events)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rest) != 1 || rest[0].Content.Fields["n"] != 3 {
+		t.Errorf("unexpected events to retry: %v", rest)
+	}
+}
+
+// droppingBatch is a batch that keeps track of the events that are dropped.
+type droppingBatch struct {
+	stubBatch
+	dropped []publisher.Event
+}
+
+func (b *droppingBatch) DroppedEvent(event *publisher.Event) { b.dropped = append(b.dropped, *event) }
+
+func TestPublishTellsTheBatchOfDroppedEvents(t *testing.T) {
+	client := client{deliveryStreamName: "foo", encoder: failingCodec{}, observer: outputs.NewNilObserver(), described: true}
+	var server *httptest.Server
+	client.firehose, server = newTestFirehose(200, `{"FailedPutCount":0,"RequestResponses":[{"RecordId":"1"}]}`)
+	defer server.Close()
+
+	batch := &droppingBatch{stubBatch: stubBatch{events: []publisher.Event{
+		{Content: beat.Event{Fields: common.MapStr{"n": 1}}},
+		{Content: beat.Event{Fields: common.MapStr{"fail": true}}},
+	}}}
+	if err := client.Publish(batch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !batch.acked || len(batch.dropped) != 1 || batch.dropped[0].Content.Fields["fail"] != true {
+		t.Errorf("unexpected dropped events: %v", batch.dropped)
+	}
 }
 
 func TestClient_String(t *testing.T) {
@@ -78,3 +173,206 @@ func TestClient_String(t *testing.T) {
 		t.Errorf("unexpected value '%v'", v)
 	}
 }
+
+// newTestFirehose returns a Firehose API client talking to a server that answers every call with the given status
+// and body.
+func newTestFirehose(status int, body string) (*firehose.Firehose, *httptest.Server) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-central-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	return firehose.New(sess), server
+}
+
+func TestConnect(t *testing.T) {
+	{
+		client := client{deliveryStreamName: "foo", region: "eu-central-1"}
+		var server *httptest.Server
+		client.firehose, server = newTestFirehose(200, `{"DeliveryStreamDescription":{"DeliveryStreamName":"foo","DeliveryStreamARN":"arn:aws:firehose:eu-central-1:123456789012:deliverystream/foo","DeliveryStreamStatus":"ACTIVE"}}`)
+		defer server.Close()
+		if err := client.Connect(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if client.deliveryStreamARN != "arn:aws:firehose:eu-central-1:123456789012:deliverystream/foo" {
+			t.Errorf("unexpected ARN: %s", client.deliveryStreamARN)
+		}
+	}
+
+	{
+		client := client{deliveryStreamName: "foo", region: "eu-central-1"}
+		var server *httptest.Server
+		client.firehose, server = newTestFirehose(200, `{"DeliveryStreamDescription":{"DeliveryStreamName":"foo","DeliveryStreamStatus":"CREATING"}}`)
+		defer server.Close()
+		if err := client.Connect(); err == nil {
+			t.Errorf("expected an error for a delivery stream being created")
+		}
+	}
+
+	{
+		client := client{deliveryStreamName: "foo", region: "eu-central-1"}
+		var server *httptest.Server
+		client.firehose, server = newTestFirehose(400, `{"__type":"ResourceNotFoundException","message":"Firehose foo not found"}`)
+		defer server.Close()
+		err := client.Connect()
+		if err == nil || err.Error() != "delivery stream foo does not exist in region eu-central-1" {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	{
+		// Delivery streams are addressed by name, which finds the one of the account of the credentials
+		arn, _ := awsconfig.ParseResourceARN("arn:aws:firehose:eu-central-1:210987654321:deliverystream/foo", "firehose", "deliverystream")
+		client := client{deliveryStreamName: "foo", configuredARN: &arn, region: "eu-central-1"}
+		var server *httptest.Server
+		client.firehose, server = newTestFirehose(200, `{"DeliveryStreamDescription":{"DeliveryStreamName":"foo","DeliveryStreamARN":"arn:aws:firehose:eu-central-1:123456789012:deliverystream/foo","DeliveryStreamStatus":"ACTIVE"}}`)
+		defer server.Close()
+		err := client.Connect()
+		if _, ok := err.(*unavailableError); !ok {
+			t.Errorf("expected the delivery stream of another account to be unavailable, got %v", err)
+		}
+	}
+}
+
+// countingObserver counts the events reported to the beat's observer.
+type countingObserver struct {
+	outputs.Observer
+	acked, failed, tooMany, bytes int
+}
+
+func (o *countingObserver) Acked(n int)      { o.acked += n }
+func (o *countingObserver) Failed(n int)     { o.failed += n }
+func (o *countingObserver) ErrTooMany(n int) { o.tooMany += n }
+func (o *countingObserver) WriteBytes(n int) { o.bytes += n }
+
+func TestPublishEventsAccounting(t *testing.T) {
+	events := []publisher.Event{{}, {}, {}}
+
+	{
+		// Partial failure: one record throttled
+		observer := &countingObserver{Observer: outputs.NewNilObserver()}
+		client := client{deliveryStreamName: "foo", encoder: MockCodec{}, observer: observer}
+		var server *httptest.Server
+		client.firehose, server = newTestFirehose(200, `{"FailedPutCount":1,"RequestResponses":[{"RecordId":"1"},{"ErrorCode":"ServiceUnavailableException"},{"RecordId":"3"}]}`)
+		defer server.Close()
+		rest, err := client.publishEvents(events)
+		if err != nil || len(rest) != 1 {
+			t.Errorf("unexpected result: %d events, %v", len(rest), err)
+		}
+		expected := countingObserver{Observer: observer.Observer, acked: 2, failed: 1, tooMany: 1, bytes: 3 * len("boom\n")}
+		if *observer != expected {
+			t.Errorf("unexpected observations: %+v", *observer)
+		}
+	}
+
+	{
+		// The whole request fails
+		observer := &countingObserver{Observer: outputs.NewNilObserver()}
+		client := client{deliveryStreamName: "foo", encoder: MockCodec{}, observer: observer}
+		var server *httptest.Server
+		client.firehose, server = newTestFirehose(500, `{"__type":"InternalFailure","message":"boom"}`)
+		defer server.Close()
+		rest, err := client.publishEvents(events)
+		if err == nil || len(rest) != 3 {
+			t.Errorf("unexpected result: %d events, %v", len(rest), err)
+		}
+		expected := countingObserver{Observer: observer.Observer, failed: 3, bytes: 3 * len("boom\n")}
+		if *observer != expected {
+			t.Errorf("unexpected observations: %+v", *observer)
+		}
+	}
+}
+
+// benchmarkEvents returns a batch of the default size of filebeat-like events. At 10k events/s, 200 of them are
+// mapped every second.
+func benchmarkEvents() []publisher.Event {
+	events := make([]publisher.Event, defaultBatchSize)
+	for i := range events {
+		events[i] = publisher.Event{Content: beat.Event{
+			Timestamp: time.Now(),
+			Fields: common.MapStr{
+				"message": fmt.Sprintf(`10.0.0.%d - - [19/Oct/2026:10:00:00 +0000] "GET /api/v1/items?page=2 HTTP/1.1" 200 5120 "-" "Mozilla/5.0"`, i),
+				"host":    common.MapStr{"name": "ip-10-0-0-1"},
+				"log":     common.MapStr{"file": common.MapStr{"path": "/var/log/nginx/access.log"}, "offset": i * 120},
+			},
+		}}
+	}
+	return events
+}
+
+// BenchmarkMapEvents maps batches of events that are acked right away, with the record buffers recycled by the cache,
+// or left to the garbage collector without it.
+func BenchmarkMapEvents(b *testing.B) {
+	for _, bench := range []struct {
+		name  string
+		cache *eventcache.Cache
+	}{
+		{"pooled", eventcache.New(nil)},
+		{"unpooled", nil},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			client := client{
+				encoder:  json.New("7.5.0", json.Config{}),
+				observer: outputs.NewNilObserver(),
+				cache:    bench.cache,
+			}
+			events := benchmarkEvents()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client.mapEvents(events)
+				client.cache.Release(events, nil)
+			}
+		})
+	}
+}
+
+func TestPublishEndToEnd(t *testing.T) {
+	server := awstest.NewServer()
+	defer server.Close()
+	server.CreateDeliveryStream("foo")
+	config := defaultConfig
+	config.Config = server.Config()
+	config.DeliveryStreamName = "foo"
+	sess, err := awsconfig.NewSession(config.Config, beat.Info{}, "firehose")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	observer := &countingObserver{Observer: outputs.NewNilObserver()}
+	client, err := newClient(sess, &config, observer, beat.Info{Beat: "filebeat"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client.encoder = MockCodec{}
+	if err := client.Connect(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The whole request is throttled, then the first record fails
+	server.Inject(
+		awstest.Throttled("PutRecordBatch"),
+		awstest.PartialFailure("PutRecordBatch", firehose.ErrCodeServiceUnavailableException, 0),
+	)
+	batch := &stubBatch{events: []publisher.Event{{}, {}}}
+	for i := 0; i < 3 && !batch.acked; i++ {
+		client.Publish(batch)
+		if len(batch.retried) > 0 {
+			batch = &stubBatch{events: batch.retried}
+		}
+	}
+	if !batch.acked {
+		t.Fatalf("expected the events to be acked eventually")
+	}
+	if records := server.Records("foo"); len(records) != 2 || string(records[0].Data) != "boom\n" {
+		t.Errorf("unexpected records: %v", records)
+	}
+	if observer.acked != 2 || observer.failed != 3 || observer.tooMany != 3 {
+		t.Errorf("unexpected observations: %+v", *observer)
+	}
+}
@@ -2,21 +2,31 @@ package firehose
 
 import (
 	"errors"
-	"time"
+	"fmt"
+	"github.com/s12v/awsbeats/awsconfig"
+	"github.com/s12v/awsbeats/awsmetadata"
+	"github.com/s12v/awsbeats/emf"
+	"github.com/s12v/awsbeats/eventfilter"
+	"github.com/s12v/awsbeats/flatten"
+	"github.com/s12v/awsbeats/schema"
+	"github.com/s12v/awsbeats/spool"
 )
 
 type FirehoseConfig struct {
-	Region             string        `config:"region"`
-	DeliveryStreamName string        `config:"stream_name"`
-	BatchSize          int           `config:"batch_size"`
-	MaxRetries         int           `config:"max_retries"`
-	Timeout            time.Duration `config:"timeout"`
-	Backoff            backoff       `config:"backoff"`
-}
+	awsconfig.Config `config:",inline"`
+	Filter           eventfilter.Config `config:",inline"`
+	Codec            schema.Config      `config:",inline"`
 
-type backoff struct {
-	Init time.Duration
-	Max  time.Duration
+	DeliveryStreamName string             `config:"stream_name"`
+	DeliveryStreamARN  string             `config:"delivery_stream_arn"`
+	BatchSize          int                `config:"batch_size"`
+	MaxRetries         int                `config:"max_retries"`
+	Workers            int                `config:"workers"`
+	Spool              spool.Config       `config:"spool"`
+	AWSMetadata        awsmetadata.Config `config:"add_aws_metadata"`
+	AddEventID         bool               `config:"add_event_id"`
+	Flatten            flatten.Config     `config:"flatten"`
+	EMF                emf.Config         `config:"emf"`
 }
 
 const (
@@ -25,27 +35,74 @@ const (
 
 var (
 	defaultConfig = FirehoseConfig{
-		Timeout:    90 * time.Second,
-		MaxRetries: 3,
-		Backoff: backoff{
-			Init: 1 * time.Second,
-			Max:  60 * time.Second,
-		},
+		Codec:       schema.DefaultConfig,
+		Flatten:     flatten.DefaultConfig,
+		Config:      awsconfig.DefaultConfig,
+		MaxRetries:  3,
+		Workers:     1,
+		Spool:       spool.DefaultConfig,
+		AWSMetadata: awsmetadata.DefaultConfig,
 	}
 )
 
 func (c *FirehoseConfig) Validate() error {
-	if c.Region == "" {
-		return errors.New("region is not defined")
+	if c.DeliveryStreamARN != "" {
+		if c.DeliveryStreamName != "" {
+			return errors.New("stream_name and delivery_stream_arn can't be set together")
+		}
+		arn, err := awsconfig.ParseResourceARN(c.DeliveryStreamARN, "firehose", "deliverystream")
+		if err != nil {
+			return fmt.Errorf("invalid delivery_stream_arn: %v", err)
+		}
+		if err := c.Config.UseRegionOf(arn, "delivery_stream_arn"); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Filter.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Codec.Validate(); err != nil {
+		return err
 	}
 
-	if c.DeliveryStreamName == "" {
-		return errors.New("stream_name is not defined")
+	switch c.Codec.Encoding {
+	case "", schema.EncodingJSON, schema.EncodingAvro, schema.EncodingProtobuf:
+	case flatten.Encoding:
+		if err := c.Flatten.Validate(); err != nil {
+			return err
+		}
+	case emf.Encoding:
+		if err := c.EMF.Validate(); err != nil {
+			return err
+		}
+		if err := c.EMF.Required(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid encoding %q: must be json, avro, protobuf, flatten or emf", c.Codec.Encoding)
+	}
+
+	if (c.Codec.Binary() || c.Codec.Encoding == flatten.Encoding) && c.AWSMetadata.Enabled {
+		return errors.New("add_aws_metadata requires the json encoding")
+	}
+
+	if c.DeliveryStreamName == "" && c.DeliveryStreamARN == "" {
+		return errors.New("stream_name or delivery_stream_arn is not defined")
 	}
 
 	if c.BatchSize > 500 || c.BatchSize < 1 {
 		return errors.New("invalid batch size")
 	}
 
+	if c.Workers < 0 {
+		return errors.New("workers must not be negative")
+	}
+
 	return nil
 }
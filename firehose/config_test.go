@@ -1,6 +1,9 @@
 package firehose
 
-import "testing"
+import (
+	"github.com/s12v/awsbeats/awsconfig"
+	"testing"
+)
 
 func TestValidate(t *testing.T) {
 	config := &FirehoseConfig{}
@@ -11,7 +14,7 @@ func TestValidate(t *testing.T) {
 }
 
 func TestValidateWithRegion(t *testing.T) {
-	config := &FirehoseConfig{Region: "eu-central-1"}
+	config := &FirehoseConfig{Config: awsconfig.Config{Region: "eu-central-1"}}
 	err := config.Validate()
 	if err == nil {
 		t.Errorf("Expected an error")
@@ -19,7 +22,7 @@ func TestValidateWithRegion(t *testing.T) {
 }
 
 func TestValidateWithRegionAndStreamNameAndBatchSize(t *testing.T) {
-	config := &FirehoseConfig{Region: "eu-central-1", DeliveryStreamName: "foo", BatchSize: 50}
+	config := &FirehoseConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 50}
 	err := config.Validate()
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
@@ -27,7 +30,7 @@ func TestValidateWithRegionAndStreamNameAndBatchSize(t *testing.T) {
 }
 
 func TestValidateWithRegionAndStreamNameAndInvalidBatchSize501(t *testing.T) {
-	config := &FirehoseConfig{Region: "eu-central-1", DeliveryStreamName: "foo", BatchSize: 501}
+	config := &FirehoseConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 501}
 	err := config.Validate()
 	if err == nil {
 		t.Errorf("Expected an error")
@@ -35,9 +38,45 @@ func TestValidateWithRegionAndStreamNameAndInvalidBatchSize501(t *testing.T) {
 }
 
 func TestValidateWithRegionAndStreamNameAndInvalidBatchSize0(t *testing.T) {
-	config := &FirehoseConfig{Region: "eu-central-1", DeliveryStreamName: "foo", BatchSize: 0}
+	config := &FirehoseConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 0}
 	err := config.Validate()
 	if err == nil {
 		t.Errorf("Expected an error")
 	}
 }
+
+func TestValidateWithNegativeWorkers(t *testing.T) {
+	config := &FirehoseConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 50, Workers: -1}
+	err := config.Validate()
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestValidateWithDeliveryStreamARN(t *testing.T) {
+	config := &FirehoseConfig{DeliveryStreamARN: "arn:aws:firehose:eu-west-1:123456789012:deliverystream/foo", BatchSize: 50}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.Region != "eu-west-1" {
+		t.Errorf("Expected the region of the ARN, got %s", config.Region)
+	}
+
+	for _, config := range []*FirehoseConfig{
+		{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamARN: "arn:aws:firehose:eu-west-1:123456789012:deliverystream/foo", BatchSize: 50},
+		{DeliveryStreamARN: "arn:aws:firehose:eu-west-1:123456789012:deliverystream/foo", DeliveryStreamName: "foo", BatchSize: 50},
+		{DeliveryStreamARN: "arn:aws:kinesis:eu-west-1:123456789012:stream/foo", BatchSize: 50},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected an error for %+v", config)
+		}
+	}
+}
+
+func TestValidateWithUnknownEncoding(t *testing.T) {
+	config := &FirehoseConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 50}
+	config.Codec.Encoding = "xml"
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
@@ -0,0 +1,55 @@
+package firehose
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"regexp"
+)
+
+var resourceARNPattern = regexp.MustCompile(`on resource: (arn:\S+)`)
+
+// unavailableError means that the delivery stream can't take any record, because it is missing or we aren't allowed
+// to write to it. It makes the client go back to connecting instead of retrying the batch over and over.
+type unavailableError struct {
+	msg string
+}
+
+func (e *unavailableError) Error() string {
+	return e.msg
+}
+
+// apiError turns an error returned by a Firehose API call into one that tells which call failed on which delivery
+// stream, e.g. "AccessDenied on firehose:PutRecordBatch for arn:aws:firehose:eu-central-1:123456789012:deliverystream/foo".
+func (client *client) apiError(action string, err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	switch aerr.Code() {
+	case firehose.ErrCodeResourceNotFoundException:
+		if client.configuredARN != nil {
+			return &unavailableError{fmt.Sprintf(
+				"delivery stream %s does not exist in the account of the credentials: set role_arn to a role of account %s",
+				client.configuredARN.ARN, client.configuredARN.Account,
+			)}
+		}
+		return &unavailableError{fmt.Sprintf("delivery stream %s does not exist in region %s", client.deliveryStreamName, client.region)}
+	case "AccessDeniedException", "AccessDenied":
+		return &unavailableError{fmt.Sprintf("AccessDenied on firehose:%s for %s", action, client.deliveryStreamResource(aerr))}
+	case "UnrecognizedClientException", "InvalidSignatureException", "ExpiredTokenException":
+		return &unavailableError{fmt.Sprintf("%s on firehose:%s: check the AWS credentials: %s", aerr.Code(), action, aerr.Message())}
+	}
+	return err
+}
+
+// deliveryStreamResource names the delivery stream in an error message, preferably by the ARN.
+func (client *client) deliveryStreamResource(aerr awserr.Error) string {
+	if m := resourceARNPattern.FindStringSubmatch(aerr.Message()); m != nil {
+		return m[1]
+	}
+	if client.deliveryStreamARN != "" {
+		return client.deliveryStreamARN
+	}
+	return fmt.Sprintf("delivery stream %s in region %s", client.deliveryStreamName, client.region)
+}
@@ -0,0 +1,43 @@
+package firehose
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"testing"
+)
+
+func TestAPIError(t *testing.T) {
+	client := client{deliveryStreamName: "foo", region: "eu-central-1"}
+
+	{
+		err := client.apiError("PutRecordBatch", awserr.New("AccessDeniedException", "User: arn:aws:iam::123456789012:user/bar is not authorized to perform: firehose:PutRecordBatch on resource: arn:aws:firehose:eu-central-1:123456789012:deliverystream/foo", nil))
+		if _, ok := err.(*unavailableError); !ok {
+			t.Errorf("unexpected error type: %T", err)
+		}
+		if err.Error() != "AccessDenied on firehose:PutRecordBatch for arn:aws:firehose:eu-central-1:123456789012:deliverystream/foo" {
+			t.Errorf("unexpected message: %v", err)
+		}
+	}
+
+	{
+		err := client.apiError("PutRecordBatch", awserr.New(firehose.ErrCodeResourceNotFoundException, "not found", nil))
+		if err.Error() != "delivery stream foo does not exist in region eu-central-1" {
+			t.Errorf("unexpected message: %v", err)
+		}
+	}
+
+	{
+		original := awserr.New(firehose.ErrCodeServiceUnavailableException, "slow down", nil)
+		if err := client.apiError("PutRecordBatch", original); err != original {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	{
+		original := errors.New("connection reset by peer")
+		if err := client.apiError("PutRecordBatch", original); err != original {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
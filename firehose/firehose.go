@@ -1,16 +1,21 @@
 package firehose
 
 import (
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/elastic/beats/libbeat/beat"
 	"github.com/elastic/beats/libbeat/common"
 	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/s12v/awsbeats/awsconfig"
+	"github.com/s12v/awsbeats/emf"
+	"github.com/s12v/awsbeats/eventcache"
+	"github.com/s12v/awsbeats/flatten"
+	"github.com/s12v/awsbeats/metrics"
+	"github.com/s12v/awsbeats/schema"
+	"github.com/s12v/awsbeats/spool"
 )
 
 var (
 	newClientFunc = newClient
-	awsNewSession = session.NewSession
+	awsNewSession = awsconfig.NewSession
 )
 
 func New(
@@ -28,13 +33,61 @@ func New(
 		return outputs.Fail(err)
 	}
 
-	var client outputs.NetworkClient
-	sess := session.Must(awsNewSession(&aws.Config{Region: aws.String(config.Region)}))
-	client, err := newClientFunc(sess, &config, stats, beat)
+	sess, err := awsNewSession(config.Config, beat, "firehose")
 	if err != nil {
 		return outputs.Fail(err)
 	}
 
-	client = outputs.WithBackoff(client, config.Backoff.Init, config.Backoff.Max)
-	return outputs.Success(config.BatchSize, config.MaxRetries, client)
+	// Every worker sends its own batches concurrently with the others, while sharing the spool and the encoded events,
+	// as a retried event may be sent by another worker
+	cache := eventcache.New(metrics.Get("firehose"))
+	codec, err := schema.New(config.Codec, sess, beat, metrics.Get("firehose"))
+	if err != nil {
+		return outputs.Fail(err)
+	}
+	var sp *spool.Spool
+	if config.Spool.Enabled {
+		if sp, err = spool.Open(config.Spool, "firehose", metrics.Get("firehose")); err != nil {
+			return outputs.Fail(err)
+		}
+	}
+	clients := make([]outputs.Client, workers(config.Workers))
+	for i := range clients {
+		client, err := newClientFunc(sess, &config, stats, beat)
+		if err == nil {
+			client.spool = sp
+			err = client.acquireSpool()
+		}
+		if err != nil {
+			for _, c := range clients[:i] {
+				c.Close()
+			}
+			sp.Close()
+			return outputs.Fail(err)
+		}
+		client.cache = cache
+		if codec != nil {
+			client.encoder = codec
+			client.schema = codec
+		}
+		if config.Codec.Encoding == emf.Encoding {
+			client.encoder = emf.New(config.EMF, beat)
+		}
+		if config.Codec.Encoding == flatten.Encoding {
+			client.encoder = flatten.New(config.Flatten, metrics.Get("firehose"))
+		}
+		clients[i] = outputs.WithBackoff(client, config.Backoff.Init, config.Backoff.Max)
+	}
+
+	// From now on the spool is only kept open by the clients
+	sp.Close()
+
+	return outputs.Success(config.BatchSize, config.MaxRetries, clients...)
+}
+
+func workers(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
 }
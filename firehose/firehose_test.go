@@ -0,0 +1,91 @@
+package firehose
+
+import (
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/s12v/awsbeats/flatten"
+	"testing"
+)
+
+func TestNewWithWorkers(t *testing.T) {
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"region":      "eu-central-1",
+		"stream_name": "foo",
+		"workers":     3,
+	})
+	group, err := New(nil, beat.Info{Beat: "filebeat"}, outputs.NewNilObserver(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(group.Clients) != 3 {
+		t.Errorf("expected 3 clients, got %d", len(group.Clients))
+	}
+	if group.BatchSize != defaultBatchSize {
+		t.Errorf("unexpected batch size: %d", group.BatchSize)
+	}
+}
+
+func TestNewWithDefaultWorkers(t *testing.T) {
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"region":      "eu-central-1",
+		"stream_name": "foo",
+	})
+	group, err := New(nil, beat.Info{Beat: "filebeat"}, outputs.NewNilObserver(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(group.Clients) != 1 {
+		t.Errorf("expected 1 client, got %d", len(group.Clients))
+	}
+}
+
+func TestNewWithFilter(t *testing.T) {
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"region":         "eu-central-1",
+		"stream_name":    "foo",
+		"include_fields": []string{"message"},
+		"when":           map[string]interface{}{"equals": map[string]interface{}{"level": "error"}},
+	})
+	if _, err := New(nil, beat.Info{Beat: "filebeat"}, outputs.NewNilObserver(), cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg = common.MustNewConfigFrom(map[string]interface{}{
+		"region":      "eu-central-1",
+		"stream_name": "foo",
+		"when":        map[string]interface{}{"level": "error"},
+	})
+	if _, err := New(nil, beat.Info{Beat: "filebeat"}, outputs.NewNilObserver(), cfg); err == nil {
+		t.Errorf("expected an invalid condition to fail")
+	}
+}
+
+func TestNewWithFlatten(t *testing.T) {
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"region":      "eu-central-1",
+		"stream_name": "foo",
+		"encoding":    "flatten",
+		"flatten": map[string]interface{}{
+			"types": []map[string]interface{}{{"field": "http.response.status_code", "type": "int"}},
+		},
+	})
+	group, err := New(nil, beat.Info{Beat: "filebeat"}, outputs.NewNilObserver(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := group.Clients[0].(interface{ Client() outputs.NetworkClient }).Client().(*client)
+	if _, ok := client.encoder.(*flatten.Encoder); !ok {
+		t.Errorf("unexpected encoder %T", client.encoder)
+	}
+
+	cfg = common.MustNewConfigFrom(map[string]interface{}{
+		"region":           "eu-central-1",
+		"stream_name":      "foo",
+		"encoding":         "flatten",
+		"add_aws_metadata": map[string]interface{}{"enabled": true},
+	})
+	if _, err := New(nil, beat.Info{Beat: "filebeat"}, outputs.NewNilObserver(), cfg); err == nil {
+		t.Errorf("expected add_aws_metadata to be rejected")
+	}
+}
@@ -0,0 +1,74 @@
+package firehose
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"time"
+)
+
+// observeRequest records a PutRecordBatch call in the output metrics, including the records it failed for as a whole.
+func (client *client) observeRequest(latency time.Duration, records []*firehose.Record, err error) {
+	client.metrics.Request(latency, len(records), recordsSize(records))
+	if err != nil {
+		client.observeFailedRecords(errorCode(err), len(records))
+	}
+}
+
+// observeFailedEntries records the records that a successful PutRecordBatch call reported as failed.
+func (client *client) observeFailedEntries(res *firehose.PutRecordBatchOutput) {
+	if res == nil || aws.Int64Value(res.FailedPutCount) == 0 {
+		return
+	}
+	for _, r := range res.RequestResponses {
+		if r != nil && aws.StringValue(r.ErrorCode) != "" {
+			client.observeFailedRecords(aws.StringValue(r.ErrorCode), 1)
+		}
+	}
+}
+
+func (client *client) observeFailedRecords(code string, n int) {
+	client.metrics.FailedRecords(code, n)
+	if isThrottled(code) {
+		client.metrics.ThrottledRecords(n)
+	}
+}
+
+// countThrottled counts the events carried by the records that a PutRecordBatch call rejected because the delivery
+// stream was over its throughput limits.
+func countThrottled(res *firehose.PutRecordBatchOutput, carried recordEvents) int {
+	n := 0
+	if res == nil {
+		return n
+	}
+	for i, r := range res.RequestResponses {
+		if i < len(carried) && r != nil && isThrottled(aws.StringValue(r.ErrorCode)) {
+			n += len(carried[i])
+		}
+	}
+	return n
+}
+
+func recordsSize(records []*firehose.Record) int {
+	size := 0
+	for _, record := range records {
+		size += len(record.Data)
+	}
+	return size
+}
+
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return "unknown"
+}
+
+// Firehose rejects records with ServiceUnavailableException once a delivery stream exceeds its throughput limits.
+func isThrottled(code string) bool {
+	switch code {
+	case firehose.ErrCodeServiceUnavailableException, firehose.ErrCodeLimitExceededException, "ThrottlingException":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package firehose
+
+import (
+	"sync"
+)
+
+// Middleware wraps the API client of the output, e.g. to trace its calls or inject faults into them. The client it
+// returns is called instead, and should delegate to the wrapped one.
+type Middleware func(API) API
+
+var (
+	middlewaresMu sync.Mutex
+	middlewares   []Middleware
+)
+
+// Use adds a middleware to the API clients of the outputs created afterwards. The middleware added first is the
+// outermost one, called first. Call it from the init function of the plugin bundling the output, e.g.
+//
+//	func init() {
+//		firehose.Use(func(api firehose.API) firehose.API { return &tracingAPI{api} })
+//	}
+func Use(m Middleware) {
+	middlewaresMu.Lock()
+	defer middlewaresMu.Unlock()
+	middlewares = append(middlewares, m)
+}
+
+// wrap applies the middlewares to the API client of a new output client.
+func wrap(api API) API {
+	middlewaresMu.Lock()
+	defer middlewaresMu.Unlock()
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		api = middlewares[i](api)
+	}
+	return api
+}
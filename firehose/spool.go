@@ -0,0 +1,94 @@
+package firehose
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/publisher"
+	"github.com/s12v/awsbeats/metrics"
+	"github.com/s12v/awsbeats/spool"
+)
+
+// publishEventsSpooled sends the spooled records before the events of the batch. As long as some are left, the batch
+// is spooled behind them instead of being sent, so that records reach the delivery stream in the order they were read.
+func (client *client) publishEventsSpooled(events []publisher.Event) ([]publisher.Event, error) {
+	if err := client.spool.Drain(client.sendSpooled); err != nil {
+		if _, ok := err.(*unavailableError); ok {
+			// Rather than spooling the batch behind records that can't be sent, go back to connecting
+			return client.failEvents(events, err), err
+		}
+		logp.NewLogger("firehose").Warnf("failed to send spooled records: %v", err)
+	}
+
+	client.observer.NewBatch(len(events))
+	records, carried, dropped := client.mapEvents(events)
+	if len(records) > 0 && !client.spool.Empty() && client.spoolRecords(records) {
+		metrics.Outcome{Dropped: dropped}.Report(client.observer, client.metrics)
+		return []publisher.Event{}, nil
+	}
+	return client.publishRecords(records, carried, dropped)
+}
+
+// spoolRecords appends the records to the spool, and tells whether they have been.
+// Once the spool is full, records are retried in memory as if there were no spool.
+func (client *client) spoolRecords(records []*firehose.Record) bool {
+	spooled := make([]spool.Record, len(records))
+	for i, record := range records {
+		spooled[i] = spool.Record{Data: record.Data}
+	}
+	if err := client.spool.Append(spooled); err != nil {
+		logp.NewLogger("firehose").Warnf("failed to spool %d records: %v", len(records), err)
+		return false
+	}
+	logp.NewLogger("firehose").Debugf("spooled %d records", len(records))
+	return true
+}
+
+// sendSpooled puts spooled records to the delivery stream, and returns those that failed.
+func (client *client) sendSpooled(spooled []spool.Record) ([]spool.Record, error) {
+	records := make([]*firehose.Record, len(spooled))
+	for i, record := range spooled {
+		records[i] = &firehose.Record{Data: record.Data}
+	}
+
+	res, err := client.sendRecords(records)
+	failed := make([]spool.Record, 0)
+	if err != nil {
+		failed = spooled
+	} else {
+		for i, r := range res.RequestResponses {
+			if i < len(spooled) && r != nil && aws.StringValue(r.ErrorCode) != "" {
+				failed = append(failed, spooled[i])
+			}
+		}
+	}
+	// Events of spooled records are only acked once they reach the delivery stream, while those that failed stay in
+	// the spool
+	metrics.Outcome{
+		Acked: len(spooled) - len(failed),
+		Bytes: recordsSize(records),
+		Err:   err,
+	}.Report(client.observer, nil)
+	return failed, err
+}
+
+// acquireSpool keeps the spool open while the client uses it. As clients are closed and connected again on errors,
+// the spool is only unlocked once every client has been closed for good.
+func (client *client) acquireSpool() error {
+	if client.spool == nil || client.spoolAcquired {
+		return nil
+	}
+	if err := client.spool.Acquire(); err != nil {
+		return err
+	}
+	client.spoolAcquired = true
+	return nil
+}
+
+func (client *client) releaseSpool() error {
+	if !client.spoolAcquired {
+		return nil
+	}
+	client.spoolAcquired = false
+	return client.spool.Close()
+}
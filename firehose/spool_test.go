@@ -0,0 +1,50 @@
+package firehose
+
+import (
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/elastic/beats/libbeat/publisher"
+	"github.com/s12v/awsbeats/awsconfig"
+	"github.com/s12v/awsbeats/spool"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDescribeDeliveryStreamAfterSpooledConnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp, err := spool.Open(spool.Config{Enabled: true, Path: dir, MaxSize: 1 << 20, RetryInterval: time.Second}, "firehose_test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arn, _ := awsconfig.ParseResourceARN("arn:aws:firehose:eu-central-1:210987654321:deliverystream/foo", "firehose", "deliverystream")
+	observer := &countingObserver{Observer: outputs.NewNilObserver()}
+	client := client{deliveryStreamName: "foo", configuredARN: &arn, region: "eu-central-1", observer: observer, spool: sp}
+	var server *httptest.Server
+	client.firehose, server = newTestFirehose(500, `{"__type":"ServiceUnavailableException","message":"Slow down."}`)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("expected to spool until the delivery stream can be described, got %v", err)
+	}
+	server.Close()
+
+	// Described again once describeRetryInterval elapsed, which finds the delivery stream of another account
+	client.firehose, server = newTestFirehose(200, `{"DeliveryStreamDescription":{"DeliveryStreamName":"foo","DeliveryStreamARN":"arn:aws:firehose:eu-central-1:123456789012:deliverystream/foo","DeliveryStreamStatus":"ACTIVE"}}`)
+	defer server.Close()
+	client.describedAt = time.Now().Add(-2 * describeRetryInterval)
+	batch := &stubBatch{events: []publisher.Event{{}, {}}}
+	if _, ok := client.Publish(batch).(*unavailableError); !ok {
+		t.Errorf("expected the delivery stream of another account to be unavailable")
+	}
+	if batch.acked || len(batch.retried) != 2 || observer.failed != 2 {
+		t.Errorf("expected the events to be retried, got acked=%v retried=%d", batch.acked, len(batch.retried))
+	}
+	if !sp.Empty() {
+		t.Errorf("expected nothing to be spooled")
+	}
+}
@@ -0,0 +1,407 @@
+// Package flatten encodes events to flat JSON objects, with a stable type per key, as Firehose needs to convert
+// records to Parquet or ORC against a table of the Glue Data Catalog.
+package flatten
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/s12v/awsbeats/metrics"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Encoding is the value of the `encoding` setting that selects this encoding.
+const Encoding = "flatten"
+
+const (
+	ArraysJSON  = "json"
+	ArraysJoin  = "join"
+	ArraysIndex = "index"
+	ArraysDrop  = "drop"
+
+	timestampFormat = "2006-01-02T15:04:05.000Z"
+)
+
+var types = map[string]bool{
+	"string": true, "int": true, "long": true, "double": true, "boolean": true, "timestamp": true, "json": true,
+}
+
+// Config of the `flatten` setting of an output.
+type Config struct {
+	Separator      string      `config:"separator"`
+	Arrays         string      `config:"arrays"`
+	ArraySeparator string      `config:"array_separator"`
+	Types          []FieldType `config:"types"`
+	DropUndeclared bool        `config:"drop_undeclared"`
+}
+
+// FieldType declares the type the value of a field is coerced to.
+type FieldType struct {
+	// Path of the field in the event, e.g. "http.response.status_code"
+	Field string `config:"field"`
+	Type  string `config:"type"`
+}
+
+// DefaultConfig is the config of an output that doesn't set `flatten`.
+var DefaultConfig = Config{
+	Separator:      "_",
+	Arrays:         ArraysJSON,
+	ArraySeparator: ",",
+}
+
+func (c *Config) Validate() error {
+	if c.Separator == "" {
+		return errors.New("flatten.separator must not be empty")
+	}
+	switch c.Arrays {
+	case ArraysJSON, ArraysJoin, ArraysIndex, ArraysDrop:
+	default:
+		return fmt.Errorf("invalid flatten.arrays %q: must be json, join, index or drop", c.Arrays)
+	}
+	fields := map[string]bool{}
+	for _, t := range c.Types {
+		if t.Field == "" {
+			return errors.New("flatten.types need a field")
+		}
+		if !types[t.Type] {
+			return fmt.Errorf("invalid type %q of %s: must be string, int, long, double, boolean, timestamp or json", t.Type, t.Field)
+		}
+		if fields[t.Field] {
+			return fmt.Errorf("type of %s is declared twice", t.Field)
+		}
+		fields[t.Field] = true
+	}
+	if c.DropUndeclared && len(c.Types) == 0 {
+		return errors.New("flatten.drop_undeclared requires flatten.types")
+	}
+	return nil
+}
+
+// Encoder encodes events to flat JSON objects. It implements codec.Codec, and is safe for concurrent use.
+type Encoder struct {
+	config  Config
+	types   map[string]string
+	metrics *metrics.Metrics
+}
+
+// New returns the encoder of an output.
+func New(c Config, m *metrics.Metrics) *Encoder {
+	e := &Encoder{config: c, types: map[string]string{}, metrics: m}
+	for _, t := range c.Types {
+		e.types[t.Field] = t.Type
+	}
+	return e
+}
+
+// Encode flattens the event, with `@timestamp` as `timestamp` and `@metadata` as `metadata`, as column names can't
+// start with @, and encodes it to JSON with sorted keys. Events with fields whose keys collide, e.g. `a.b` and `a_b`,
+// or `timestamp` and `@timestamp`, fail with a *CollisionError, whatever the order of their fields.
+func (e *Encoder) Encode(_ string, event *beat.Event) ([]byte, error) {
+	f := flattening{out: map[string]interface{}{}, paths: map[string]string{}, prefix: "@"}
+	var err error
+	if len(event.Meta) > 0 {
+		err = e.flatten(&f, "metadata", "metadata", event.Meta)
+	}
+	if err == nil {
+		err = e.flatten(&f, "timestamp", "timestamp", event.Timestamp)
+	}
+	if err == nil {
+		f.prefix = ""
+		err = e.flatten(&f, "", "", event.Fields)
+	}
+	if err != nil {
+		e.metrics.FlattenKeyCollision()
+		return nil, err
+	}
+	return marshal(f.out)
+}
+
+// CollisionError is the error of an event with two fields of the same flattened key.
+type CollisionError struct {
+	Key string
+	// Paths of the fields in the event, sorted
+	Paths [2]string
+}
+
+func (e *CollisionError) Error() string {
+	return fmt.Sprintf("fields %s and %s are both flattened to %s", e.Paths[0], e.Paths[1], e.Key)
+}
+
+// flattening is the flat object of an event, along with the path each of its keys comes from.
+type flattening struct {
+	out   map[string]interface{}
+	paths map[string]string
+	// Of the paths of @timestamp and @metadata
+	prefix string
+}
+
+func (f *flattening) set(path, key string, v interface{}) error {
+	path = f.prefix + path
+	if other, ok := f.paths[key]; ok {
+		paths := [2]string{other, path}
+		if paths[1] < paths[0] {
+			paths[0], paths[1] = paths[1], paths[0]
+		}
+		return &CollisionError{Key: key, Paths: paths}
+	}
+	f.out[key] = v
+	f.paths[key] = path
+	return nil
+}
+
+func (e *Encoder) flatten(f *flattening, path, key string, v interface{}) error {
+	if t, ok := e.types[path]; ok {
+		return f.set(path, key, e.coerce(path, t, v))
+	}
+	if m, ok := toMap(v); ok {
+		for k, sub := range m {
+			if err := e.flatten(f, join(path, ".", k), join(key, e.config.Separator, k), sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if e.config.DropUndeclared {
+		return nil
+	}
+	if items, ok := toSlice(v); ok {
+		return e.flattenArray(f, path, key, items)
+	}
+	if isNonFinite(v) {
+		// NaN and infinite numbers can't be encoded to JSON
+		e.metrics.FlattenCoercionFailure()
+		return f.set(path, key, nil)
+	}
+	return f.set(path, key, scalar(v))
+}
+
+func (e *Encoder) flattenArray(f *flattening, path, key string, items []interface{}) error {
+	switch e.config.Arrays {
+	case ArraysIndex:
+		for i, item := range items {
+			if err := e.flatten(f, join(path, ".", strconv.Itoa(i)), join(key, e.config.Separator, strconv.Itoa(i)), item); err != nil {
+				return err
+			}
+		}
+	case ArraysDrop:
+	default:
+		return f.set(path, key, e.arrayString(items))
+	}
+	return nil
+}
+
+// arrayString renders an array as a string, to keep the type of its key stable.
+func (e *Encoder) arrayString(items []interface{}) string {
+	if e.config.Arrays == ArraysJoin {
+		values := make([]string, len(items))
+		for i, item := range items {
+			values[i], _ = toString(item)
+		}
+		return strings.Join(values, e.config.ArraySeparator)
+	}
+	return jsonString(items)
+}
+
+// coerce converts the value to the declared type, or to null when it can't be.
+func (e *Encoder) coerce(path, t string, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	var coerced interface{}
+	ok := false
+	switch t {
+	case "string":
+		if items, isSlice := toSlice(v); isSlice {
+			coerced, ok = e.arrayString(items), true
+		} else {
+			coerced, ok = toString(v)
+		}
+	case "int", "long":
+		coerced, ok = toInt(v)
+	case "double":
+		coerced, ok = toFloat(v)
+	case "boolean":
+		coerced, ok = toBool(v)
+	case "timestamp":
+		coerced, ok = toTimestamp(v)
+	case "json":
+		b, err := marshal(v)
+		coerced, ok = string(b), err == nil
+	}
+	if !ok {
+		e.metrics.FlattenCoercionFailure()
+		return nil
+	}
+	return coerced
+}
+
+func join(prefix, separator, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + separator + key
+}
+
+func scalar(v interface{}) interface{} {
+	if ts, ok := toTime(v); ok {
+		return ts.UTC().Format(timestampFormat)
+	}
+	return v
+}
+
+func jsonString(v interface{}) string {
+	b, err := marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// marshal encodes v to JSON without escaping HTML, as the JSON encoding of libbeat.
+func marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+func isNonFinite(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	if k := rv.Kind(); k == reflect.Float32 || k == reflect.Float64 {
+		return math.IsNaN(rv.Float()) || math.IsInf(rv.Float(), 0)
+	}
+	return false
+}
+
+func toString(v interface{}) (string, bool) {
+	if isNonFinite(v) {
+		return "", false
+	}
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case bool:
+		return strconv.FormatBool(x), true
+	}
+	if ts, ok := toTime(v); ok {
+		return ts.UTC().Format(timestampFormat), true
+	}
+	if _, ok := toMap(v); ok {
+		return jsonString(v), true
+	}
+	if f, ok := toFloat(v); ok {
+		if n, ok := toInt(v); ok {
+			return strconv.FormatInt(n, 10), true
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), true
+	}
+	return fmt.Sprint(v), true
+}
+
+func toInt(v interface{}) (int64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := rv.Uint()
+		return int64(n), n <= 1<<63-1
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		return int64(f), float64(int64(f)) == f
+	case reflect.String:
+		n, err := strconv.ParseInt(strings.TrimSpace(rv.String()), 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), !isNonFinite(v)
+	case reflect.String:
+		f, err := strconv.ParseFloat(strings.TrimSpace(rv.String()), 64)
+		return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+	}
+	if n, ok := toInt(v); ok {
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func toBool(v interface{}) (bool, bool) {
+	switch x := v.(type) {
+	case bool:
+		return x, true
+	case string:
+		b, err := strconv.ParseBool(x)
+		return b, err == nil
+	}
+	return false, false
+}
+
+func toTimestamp(v interface{}) (string, bool) {
+	if ts, ok := toTime(v); ok {
+		return ts.UTC().Format(timestampFormat), true
+	}
+	if s, ok := v.(string); ok {
+		ts, err := time.Parse(time.RFC3339Nano, s)
+		return ts.UTC().Format(timestampFormat), err == nil
+	}
+	return "", false
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch ts := v.(type) {
+	case time.Time:
+		return ts, true
+	case common.Time:
+		return time.Time(ts), true
+	}
+	return time.Time{}, false
+}
+
+func toMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case common.MapStr:
+		return m, true
+	case map[string]interface{}:
+		return m, true
+	}
+	rv := reflect.ValueOf(v)
+	if v == nil || rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	m := make(map[string]interface{}, rv.Len())
+	for _, k := range rv.MapKeys() {
+		m[k.String()] = rv.MapIndex(k).Interface()
+	}
+	return m, true
+}
+
+func toSlice(v interface{}) ([]interface{}, bool) {
+	if items, ok := v.([]interface{}); ok {
+		return items, true
+	}
+	rv := reflect.ValueOf(v)
+	if v == nil || (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, false
+	}
+	items := make([]interface{}, rv.Len())
+	for i := range items {
+		items[i] = rv.Index(i).Interface()
+	}
+	return items, true
+}
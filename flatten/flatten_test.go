@@ -0,0 +1,148 @@
+package flatten
+
+import (
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/monitoring"
+	"github.com/s12v/awsbeats/metrics"
+	"math"
+	"testing"
+	"time"
+)
+
+func encode(t *testing.T, c Config, event *beat.Event) string {
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := New(c, nil).Encode("filebeat", event)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return string(b)
+}
+
+func testEvent() *beat.Event {
+	return &beat.Event{
+		Timestamp: time.Unix(1, 0),
+		Meta:      common.MapStr{"_id": "abc"},
+		Fields: common.MapStr{
+			"message": "hello",
+			"http":    common.MapStr{"response": common.MapStr{"status_code": "404", "bytes": 12.5}},
+			"tags":    []string{"a", "b"},
+			"labels":  map[string]string{"env": "prod"},
+		},
+	}
+}
+
+func TestEncode(t *testing.T) {
+	got := encode(t, DefaultConfig, testEvent())
+	expected := `{"http_response_bytes":12.5,"http_response_status_code":"404","labels_env":"prod","message":"hello",` +
+		`"metadata__id":"abc","tags":"[\"a\",\"b\"]","timestamp":"1970-01-01T00:00:01.000Z"}`
+	if got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestEncodeWithTypes(t *testing.T) {
+	c := DefaultConfig
+	c.Separator = "."
+	c.Arrays = ArraysJoin
+	c.Types = []FieldType{
+		{Field: "http.response.status_code", Type: "int"},
+		{Field: "http.response.bytes", Type: "long"},
+		{Field: "labels", Type: "json"},
+		{Field: "message", Type: "boolean"},
+		{Field: "tags", Type: "string"},
+	}
+	got := encode(t, c, testEvent())
+	expected := `{"http.response.bytes":null,"http.response.status_code":404,"labels":"{\"env\":\"prod\"}","message":null,` +
+		`"metadata._id":"abc","tags":"a,b","timestamp":"1970-01-01T00:00:01.000Z"}`
+	if got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	c.DropUndeclared = true
+	got = encode(t, c, testEvent())
+	expected = `{"http.response.bytes":null,"http.response.status_code":404,"labels":"{\"env\":\"prod\"}","message":null,"tags":"a,b"}`
+	if got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestEncodeArrays(t *testing.T) {
+	event := &beat.Event{Timestamp: time.Unix(1, 0), Fields: common.MapStr{
+		"hosts": []interface{}{common.MapStr{"name": "a"}, common.MapStr{"name": "b"}},
+	}}
+
+	c := DefaultConfig
+	c.Arrays = ArraysIndex
+	if got := encode(t, c, event); got != `{"hosts_0_name":"a","hosts_1_name":"b","timestamp":"1970-01-01T00:00:01.000Z"}` {
+		t.Errorf("unexpected record %s", got)
+	}
+	c.Arrays = ArraysDrop
+	if got := encode(t, c, event); got != `{"timestamp":"1970-01-01T00:00:01.000Z"}` {
+		t.Errorf("unexpected record %s", got)
+	}
+}
+
+func TestEncodeNonFinite(t *testing.T) {
+	m := metrics.Get("test_flatten")
+	failures := func() int64 {
+		reg := monitoring.Default.GetRegistry("libbeat.outputs.test_flatten")
+		return monitoring.CollectFlatSnapshot(reg, monitoring.Full, false).Ints["flatten.coercion_failures"]
+	}
+	before := failures()
+	c := DefaultConfig
+	c.Types = []FieldType{{Field: "ratio", Type: "double"}, {Field: "label", Type: "string"}, {Field: "raw", Type: "json"}}
+	event := &beat.Event{Timestamp: time.Unix(1, 0), Fields: common.MapStr{
+		"ratio":   math.Inf(1),
+		"label":   math.NaN(),
+		"raw":     []float64{math.Inf(-1)},
+		"pct":     common.Float(math.NaN()),
+		"message": "<a&b>",
+	}}
+	b, err := New(c, m).Encode("filebeat", event)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{"label":null,"message":"<a&b>","pct":null,"ratio":null,"raw":null,"timestamp":"1970-01-01T00:00:01.000Z"}`
+	if string(b) != expected {
+		t.Errorf("expected %s, got %s", expected, b)
+	}
+	if n := failures() - before; n != 4 {
+		t.Errorf("expected 4 coercion failures, got %d", n)
+	}
+}
+
+func TestEncodeCollisions(t *testing.T) {
+	cases := map[string]common.MapStr{
+		"a.b and a_b":                    {"a": common.MapStr{"b": 1}, "a_b": 2},
+		"@timestamp and timestamp":       {"timestamp": "now"},
+		"@metadata._id and metadata._id": {"metadata": common.MapStr{"_id": "x"}},
+	}
+	for paths, fields := range cases {
+		event := &beat.Event{Timestamp: time.Unix(1, 0), Meta: common.MapStr{"_id": "abc"}, Fields: fields}
+		// Whatever the order the fields are flattened in
+		for i := 0; i < 10; i++ {
+			_, err := New(DefaultConfig, nil).Encode("filebeat", event)
+			if c, ok := err.(*CollisionError); !ok || c.Paths[0]+" and "+c.Paths[1] != paths {
+				t.Fatalf("expected a collision of %s, got %v", paths, err)
+			}
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalid := []Config{
+		{Separator: "", Arrays: ArraysJSON},
+		{Separator: "_", Arrays: "flatten"},
+		{Separator: "_", Arrays: ArraysJSON, Types: []FieldType{{Field: "a", Type: "struct"}}},
+		{Separator: "_", Arrays: ArraysJSON, Types: []FieldType{{Field: "a", Type: "int"}, {Field: "a", Type: "long"}}},
+		{Separator: "_", Arrays: ArraysJSON, DropUndeclared: true},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", c)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Package metrics holds the monitoring metrics of the AWS outputs.
+// They are registered under `libbeat.outputs.<output>`, so they show up in the beat's HTTP monitoring endpoint and
+// are shipped by x-pack monitoring along with the other libbeat metrics.
+package metrics
+
+import (
+	"github.com/elastic/beats/libbeat/monitoring"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Upper bounds of the API call latency buckets, in milliseconds
+	latencyBuckets = []int64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+	// Upper bounds of the records per request buckets
+	recordsBuckets = []int64{1, 5, 10, 25, 50, 100, 250, 500}
+
+	mu       sync.Mutex
+	registry = map[string]*Metrics{}
+)
+
+// Metrics of a single output type.
+// A nil *Metrics records nothing.
+type Metrics struct {
+	apiLatency           *Histogram
+	recordsPerRequest    *Histogram
+	bytesSent            *monitoring.Int
+	throttledRecords     *monitoring.Int
+	failedRecords        *Counters
+	retriedEvents        *monitoring.Int
+	partitionKeyFailures *monitoring.Int
+	partitionKeyFallback *monitoring.Int
+	filteredEvents       *monitoring.Int
+	spoolSegments        *monitoring.Int
+	spoolBytes           *monitoring.Int
+	spooledRecords       *monitoring.Int
+	drainedRecords       *monitoring.Int
+	corruptedSegments    *monitoring.Int
+	sdkRetries           *Counters
+	encodeCacheHits      *monitoring.Int
+	encodeCacheEntries   *monitoring.Int
+	schemaMismatches     *monitoring.Int
+	coercionFailures     *monitoring.Int
+	keyCollisions        *monitoring.Int
+}
+
+// Get returns the metrics of the given output, registering them under `libbeat.outputs.<output>` on first use.
+// Metrics survive the output being reloaded, as libbeat doesn't allow registering a metric twice.
+func Get(output string) *Metrics {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if m, ok := registry[output]; ok {
+		return m
+	}
+
+	libbeat := monitoring.Default.GetRegistry("libbeat")
+	if libbeat == nil {
+		libbeat = monitoring.Default.NewRegistry("libbeat")
+	}
+	reg := libbeat.NewRegistry("outputs." + output)
+	m := &Metrics{
+		apiLatency:           NewHistogram(reg.NewRegistry("api.latency_ms"), latencyBuckets),
+		recordsPerRequest:    NewHistogram(reg.NewRegistry("records_per_request"), recordsBuckets),
+		bytesSent:            monitoring.NewInt(reg, "bytes_sent"),
+		throttledRecords:     monitoring.NewInt(reg, "records.throttled"),
+		failedRecords:        NewCounters(reg.NewRegistry("records.failed")),
+		retriedEvents:        monitoring.NewInt(reg, "events.retried"),
+		partitionKeyFailures: monitoring.NewInt(reg, "partition_key.failures"),
+		partitionKeyFallback: monitoring.NewInt(reg, "partition_key.fallbacks"),
+		filteredEvents:       monitoring.NewInt(reg, "events.filtered"),
+		spoolSegments:        monitoring.NewInt(reg, "spool.segments"),
+		spoolBytes:           monitoring.NewInt(reg, "spool.bytes"),
+		spooledRecords:       monitoring.NewInt(reg, "spool.records.written"),
+		drainedRecords:       monitoring.NewInt(reg, "spool.records.drained"),
+		corruptedSegments:    monitoring.NewInt(reg, "spool.corrupted"),
+		sdkRetries:           NewCounters(reg.NewRegistry("api.retries")),
+		encodeCacheHits:      monitoring.NewInt(reg, "encode_cache.hits"),
+		encodeCacheEntries:   monitoring.NewInt(reg, "encode_cache.entries"),
+		schemaMismatches:     monitoring.NewInt(reg, "schema.mismatches"),
+		coercionFailures:     monitoring.NewInt(reg, "flatten.coercion_failures"),
+		keyCollisions:        monitoring.NewInt(reg, "flatten.key_collisions"),
+	}
+	registry[output] = m
+	return m
+}
+
+// Request records an API call sending the given number of records and bytes.
+func (m *Metrics) Request(latency time.Duration, records int, bytes int) {
+	if m == nil {
+		return
+	}
+	m.apiLatency.Observe(int64(latency / time.Millisecond))
+	m.recordsPerRequest.Observe(int64(records))
+	m.bytesSent.Add(int64(bytes))
+}
+
+// FailedRecords records n records rejected with the given error code.
+func (m *Metrics) FailedRecords(code string, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.failedRecords.Add(code, int64(n))
+}
+
+// ThrottledRecords records n records rejected because the destination is over its throughput limit.
+func (m *Metrics) ThrottledRecords(n int) {
+	if m == nil {
+		return
+	}
+	m.throttledRecords.Add(int64(n))
+}
+
+// RetriedEvents records n events handed back to the pipeline to be sent again.
+func (m *Metrics) RetriedEvents(n int) {
+	if m == nil {
+		return
+	}
+	m.retriedEvents.Add(int64(n))
+}
+
+// PartitionKeyFailure records an event whose partition key couldn't be determined.
+func (m *Metrics) PartitionKeyFailure() {
+	if m == nil {
+		return
+	}
+	m.partitionKeyFailures.Inc()
+}
+
+// PartitionKeyFallback records an event given a random partition key because its partition key couldn't be determined.
+func (m *Metrics) PartitionKeyFallback() {
+	if m == nil {
+		return
+	}
+	m.partitionKeyFallback.Inc()
+}
+
+// FilteredEvent records an event dropped because it doesn't meet the output's `when` condition.
+func (m *Metrics) FilteredEvent() {
+	if m == nil {
+		return
+	}
+	m.filteredEvents.Inc()
+}
+
+// SDKRetry records an API call retried by the AWS SDK after failing with the given error code.
+func (m *Metrics) SDKRetry(code string) {
+	if m == nil {
+		return
+	}
+	m.sdkRetries.Add(code, 1)
+}
+
+// Spool records the current number of segments and bytes in the spool.
+func (m *Metrics) Spool(segments int, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.spoolSegments.Set(int64(segments))
+	m.spoolBytes.Set(bytes)
+}
+
+// SpooledRecords records n records written to the spool.
+func (m *Metrics) SpooledRecords(n int) {
+	if m == nil {
+		return
+	}
+	m.spooledRecords.Add(int64(n))
+}
+
+// DrainedRecords records n spooled records sent to the destination.
+func (m *Metrics) DrainedRecords(n int) {
+	if m == nil {
+		return
+	}
+	m.drainedRecords.Add(int64(n))
+}
+
+// CorruptedSegment records a spool segment dropped because it couldn't be read back.
+func (m *Metrics) CorruptedSegment() {
+	if m == nil {
+		return
+	}
+	m.corruptedSegments.Inc()
+}
+
+// EncodeCacheHit records a retried event sent as it was encoded the first time.
+func (m *Metrics) EncodeCacheHit() {
+	if m == nil {
+		return
+	}
+	m.encodeCacheHits.Inc()
+}
+
+// EncodeCacheEntries records the current number of events in the encode cache.
+func (m *Metrics) EncodeCacheEntries(n int) {
+	if m == nil {
+		return
+	}
+	m.encodeCacheEntries.Set(int64(n))
+}
+
+// SchemaMismatch records an event dropped because it doesn't fit the schema of the output.
+func (m *Metrics) SchemaMismatch() {
+	if m == nil {
+		return
+	}
+	m.schemaMismatches.Inc()
+}
+
+// FlattenCoercionFailure records a value sent as null because it couldn't be coerced to the declared type of its field.
+func (m *Metrics) FlattenCoercionFailure() {
+	if m == nil {
+		return
+	}
+	m.coercionFailures.Inc()
+}
+
+// FlattenKeyCollision records an event dropped because two of its fields have the same flattened key.
+func (m *Metrics) FlattenKeyCollision() {
+	if m == nil {
+		return
+	}
+	m.keyCollisions.Inc()
+}
+
+// Histogram counts observations into buckets, reported Prometheus-style as `le_<bound>` counters of the observations
+// less than or equal to the bound, next to the `count`, `sum` and `max` of all observations.
+type Histogram struct {
+	bounds  []int64
+	buckets []*monitoring.Int
+	count   *monitoring.Int
+	sum     *monitoring.Int
+	max     *monitoring.Int
+	mu      sync.Mutex
+}
+
+// NewHistogram registers a histogram with the given bucket bounds, in ascending order, in reg.
+func NewHistogram(reg *monitoring.Registry, bounds []int64) *Histogram {
+	h := &Histogram{
+		bounds:  bounds,
+		buckets: make([]*monitoring.Int, len(bounds)),
+		count:   monitoring.NewInt(reg, "count"),
+		sum:     monitoring.NewInt(reg, "sum"),
+		max:     monitoring.NewInt(reg, "max"),
+	}
+	for i, bound := range bounds {
+		h.buckets[i] = monitoring.NewInt(reg, "le_"+strconv.FormatInt(bound, 10))
+	}
+	return h
+}
+
+// Observe adds a value to the histogram.
+func (h *Histogram) Observe(v int64) {
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i].Inc()
+		}
+	}
+	h.count.Inc()
+	h.sum.Add(v)
+
+	h.mu.Lock()
+	if v > h.max.Get() {
+		h.max.Set(v)
+	}
+	h.mu.Unlock()
+}
+
+// Counters is a set of counters keyed by a name only known at runtime, like an error code.
+type Counters struct {
+	reg      *monitoring.Registry
+	mu       sync.Mutex
+	counters map[string]*monitoring.Int
+}
+
+// NewCounters returns an empty set of counters registered in reg.
+func NewCounters(reg *monitoring.Registry) *Counters {
+	return &Counters{reg: reg, counters: map[string]*monitoring.Int{}}
+}
+
+// Add adds n to the counter of the given name, registering it on first use.
+func (c *Counters) Add(name string, n int64) {
+	// Dots would nest the counter into sub-registries
+	name = strings.Replace(name, ".", "_", -1)
+	if name == "" {
+		name = "unknown"
+	}
+
+	c.mu.Lock()
+	counter, ok := c.counters[name]
+	if !ok {
+		counter = monitoring.NewInt(c.reg, name)
+		c.counters[name] = counter
+	}
+	c.mu.Unlock()
+
+	counter.Add(n)
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"github.com/elastic/beats/libbeat/monitoring"
+	"testing"
+	"time"
+)
+
+func snapshot(t *testing.T, output string) map[string]int64 {
+	reg := monitoring.Default.GetRegistry("libbeat.outputs." + output)
+	if reg == nil {
+		t.Fatalf("metrics of %s aren't registered", output)
+	}
+	return monitoring.CollectFlatSnapshot(reg, monitoring.Full, false).Ints
+}
+
+func TestGetIsIdempotent(t *testing.T) {
+	if Get("test_idempotent") != Get("test_idempotent") {
+		t.Errorf("expected the same metrics")
+	}
+}
+
+// The registry is global, so tests check the increase of counters for -count to work
+func delta(before, after map[string]int64, name string) int64 {
+	return after[name] - before[name]
+}
+
+func TestRequest(t *testing.T) {
+	m := Get("test_request")
+	before := snapshot(t, "test_request")
+	m.Request(30*time.Millisecond, 20, 1000)
+	m.Request(2*time.Second, 500, 3000)
+
+	ints := snapshot(t, "test_request")
+	expected := map[string]int64{
+		"api.latency_ms.count":       2,
+		"api.latency_ms.sum":         2030,
+		"api.latency_ms.le_25":       0,
+		"api.latency_ms.le_50":       1,
+		"api.latency_ms.le_2500":     2,
+		"records_per_request.le_25":  1,
+		"records_per_request.le_500": 2,
+		"records_per_request.count":  2,
+		"bytes_sent":                 4000,
+	}
+	for name, value := range expected {
+		if d := delta(before, ints, name); d != value {
+			t.Errorf("unexpected increase of %s: %d", name, d)
+		}
+	}
+	if ints["api.latency_ms.max"] != 2000 {
+		t.Errorf("unexpected value of api.latency_ms.max: %d", ints["api.latency_ms.max"])
+	}
+}
+
+func TestFailedRecords(t *testing.T) {
+	m := Get("test_failed")
+	before := snapshot(t, "test_failed")
+	m.FailedRecords("ProvisionedThroughputExceededException", 3)
+	m.FailedRecords("InternalFailure", 1)
+	m.FailedRecords("ProvisionedThroughputExceededException", 2)
+	m.FailedRecords("some.code", 1)
+	m.ThrottledRecords(5)
+	m.RetriedEvents(6)
+	m.PartitionKeyFailure()
+	m.PartitionKeyFallback()
+
+	ints := snapshot(t, "test_failed")
+	expected := map[string]int64{
+		"records.failed.ProvisionedThroughputExceededException": 5,
+		"records.failed.InternalFailure":                        1,
+		"records.failed.some_code":                              1,
+		"records.throttled":                                     5,
+		"events.retried":                                        6,
+		"partition_key.failures":                                1,
+		"partition_key.fallbacks":                               1,
+	}
+	for name, value := range expected {
+		if d := delta(before, ints, name); d != value {
+			t.Errorf("unexpected increase of %s: %d", name, d)
+		}
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	m.Request(time.Second, 1, 1)
+	m.FailedRecords("foo", 1)
+	m.ThrottledRecords(1)
+	m.RetriedEvents(1)
+	m.PartitionKeyFailure()
+	m.PartitionKeyFallback()
+}
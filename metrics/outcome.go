@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/elastic/beats/libbeat/publisher"
+)
+
+// DropObserver is implemented by batches that keep track of which of their events an output drops, like the batches
+// the fanout output hands to its outputs.
+type DropObserver interface {
+	DroppedEvent(event *publisher.Event)
+}
+
+// Outcome is what happened to the events of a batch, once the response to the request sending them has been handled.
+// Every event of the batch is either acked, failed or dropped.
+type Outcome struct {
+	// Events accepted by the destination
+	Acked int
+	// Events rejected by the destination, or not sent because the request failed, which are handed back to the beat
+	// to be retried
+	Failed int
+	// Of the failed events, those rejected because the destination was over its throughput limits
+	Throttled int
+	// Events that can't be sent at all, e.g. because they can't be encoded
+	Dropped int
+	// Bytes of the records sent to the destination, whether they were accepted or not
+	Bytes int
+	// Error of the request as a whole, if any
+	Err error
+}
+
+// Report reports the outcome to the beat's observer, which accounts for it in the `libbeat.output` metrics, and to
+// the output's own metrics.
+func (o Outcome) Report(observer outputs.Observer, m *Metrics) {
+	observer.Acked(o.Acked)
+	observer.Failed(o.Failed)
+	observer.Dropped(o.Dropped)
+	observer.ErrTooMany(o.Throttled)
+	observer.WriteBytes(o.Bytes)
+	if o.Err != nil {
+		observer.WriteError(o.Err)
+	}
+	m.RetriedEvents(o.Failed)
+}
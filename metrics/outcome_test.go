@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/elastic/beats/libbeat/outputs"
+	"testing"
+)
+
+type recordingObserver struct {
+	outputs.Observer
+	acked, failed, dropped, tooMany, bytes, writeErrors int
+}
+
+func (o *recordingObserver) Acked(n int)      { o.acked += n }
+func (o *recordingObserver) Failed(n int)     { o.failed += n }
+func (o *recordingObserver) Dropped(n int)    { o.dropped += n }
+func (o *recordingObserver) ErrTooMany(n int) { o.tooMany += n }
+func (o *recordingObserver) WriteBytes(n int) { o.bytes += n }
+func (o *recordingObserver) WriteError(error) { o.writeErrors++ }
+
+func TestReport(t *testing.T) {
+	m := Get("test_outcome")
+	before := snapshot(t, "test_outcome")
+	observer := &recordingObserver{Observer: outputs.NewNilObserver()}
+	Outcome{Acked: 7, Failed: 3, Throttled: 2, Dropped: 1, Bytes: 100}.Report(observer, m)
+	Outcome{Failed: 5, Bytes: 50, Err: errors.New("boom")}.Report(observer, m)
+
+	expected := recordingObserver{acked: 7, failed: 8, dropped: 1, tooMany: 2, bytes: 150, writeErrors: 1}
+	expected.Observer = observer.Observer
+	if *observer != expected {
+		t.Errorf("unexpected observations: %+v", *observer)
+	}
+	if retried := delta(before, snapshot(t, "test_outcome"), "events.retried"); retried != 8 {
+		t.Errorf("unexpected number of retried events: %d", retried)
+	}
+}
@@ -0,0 +1,493 @@
+package schema
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/elastic/beats/libbeat/common"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// avroType is a parsed Avro schema, see https://avro.apache.org/docs/1.11.1/specification/
+type avroType struct {
+	// A primitive type, "record", "enum", "array", "map", "fixed" or "union"
+	kind    string
+	logical string
+	// Full name of named types
+	name     string
+	fields   []avroField
+	symbols  []string
+	items    *avroType
+	values   *avroType
+	size     int
+	branches []*avroType
+}
+
+type avroField struct {
+	name       string
+	typ        *avroType
+	def        interface{}
+	hasDefault bool
+}
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true, "float": true, "double": true, "bytes": true, "string": true,
+}
+
+// parseAvro parses an Avro schema in its JSON form.
+func parseAvro(definition string) (*avroType, error) {
+	var raw interface{}
+	if err := json.Unmarshal([]byte(definition), &raw); err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %v", err)
+	}
+	p := avroParser{named: map[string]*avroType{}}
+	t, err := p.parse(raw, "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %v", err)
+	}
+	return t, nil
+}
+
+type avroParser struct {
+	named map[string]*avroType
+}
+
+func fullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+func (p *avroParser) parse(raw interface{}, namespace string) (*avroType, error) {
+	switch r := raw.(type) {
+	case string:
+		if avroPrimitives[r] {
+			return &avroType{kind: r}, nil
+		}
+		if t, ok := p.named[fullName(r, namespace)]; ok {
+			return t, nil
+		}
+		if t, ok := p.named[r]; ok {
+			return t, nil
+		}
+		return nil, fmt.Errorf("unknown type %q", r)
+	case []interface{}:
+		t := &avroType{kind: "union"}
+		for _, b := range r {
+			branch, err := p.parse(b, namespace)
+			if err != nil {
+				return nil, err
+			}
+			if branch.kind == "union" {
+				return nil, fmt.Errorf("unions can't contain unions")
+			}
+			t.branches = append(t.branches, branch)
+		}
+		return t, nil
+	case map[string]interface{}:
+		return p.parseComplex(r, namespace)
+	}
+	return nil, fmt.Errorf("invalid type %v", raw)
+}
+
+func (p *avroParser) parseComplex(r map[string]interface{}, namespace string) (*avroType, error) {
+	kind, ok := r["type"].(string)
+	if !ok {
+		// e.g. {"type": {"type": "array", "items": "string"}}
+		return p.parse(r["type"], namespace)
+	}
+	logical, _ := r["logicalType"].(string)
+	if avroPrimitives[kind] {
+		return &avroType{kind: kind, logical: logical}, nil
+	}
+
+	t := &avroType{kind: kind, logical: logical}
+	switch kind {
+	case "record", "error", "enum", "fixed":
+		name, _ := r["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("%s without a name", kind)
+		}
+		if ns, ok := r["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+		t.name = fullName(name, namespace)
+		if i := strings.LastIndex(t.name, "."); i >= 0 {
+			namespace = t.name[:i]
+		}
+		// Registered before its fields, which may refer to it
+		p.named[t.name] = t
+	}
+
+	switch kind {
+	case "record", "error":
+		t.kind = "record"
+		fields, _ := r["fields"].([]interface{})
+		for _, f := range fields {
+			fm, _ := f.(map[string]interface{})
+			name, _ := fm["name"].(string)
+			if name == "" {
+				return nil, fmt.Errorf("field of record %s without a name", t.name)
+			}
+			ft, err := p.parse(fm["type"], namespace)
+			if err != nil {
+				return nil, fmt.Errorf("field %s of record %s: %v", name, t.name, err)
+			}
+			def, hasDefault := fm["default"]
+			t.fields = append(t.fields, avroField{name: name, typ: ft, def: def, hasDefault: hasDefault})
+		}
+	case "enum":
+		symbols, _ := r["symbols"].([]interface{})
+		for _, s := range symbols {
+			symbol, _ := s.(string)
+			t.symbols = append(t.symbols, symbol)
+		}
+	case "array":
+		items, err := p.parse(r["items"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		t.items = items
+	case "map":
+		values, err := p.parse(r["values"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		t.values = values
+	case "fixed":
+		size, _ := r["size"].(float64)
+		t.size = int(size)
+	default:
+		return nil, fmt.Errorf("unknown type %q", kind)
+	}
+	return t, nil
+}
+
+// MismatchError is the error of an event that doesn't fit the schema.
+type MismatchError struct {
+	// Path of the value that doesn't fit, e.g. "http.response.status_code"
+	Path string
+	Err  string
+}
+
+func (e *MismatchError) Error() string {
+	if e.Path == "" {
+		return "event doesn't fit the schema: " + e.Err
+	}
+	return fmt.Sprintf("event doesn't fit the schema at %s: %s", e.Path, e.Err)
+}
+
+func mismatch(path string, format string, args ...interface{}) error {
+	return &MismatchError{Path: path, Err: fmt.Sprintf(format, args...)}
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// encode appends the Avro binary encoding of v to b.
+func (t *avroType) encode(b []byte, v interface{}, path string) ([]byte, error) {
+	switch t.kind {
+	case "null":
+		if v != nil {
+			return b, mismatch(path, "expected null, got %T", v)
+		}
+		return b, nil
+	case "boolean":
+		x, ok := v.(bool)
+		if !ok {
+			return b, mismatch(path, "expected a boolean, got %T", v)
+		}
+		if x {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case "int", "long":
+		n, ok := t.toInt(v)
+		if !ok {
+			return b, mismatch(path, "expected an integer, got %T", v)
+		}
+		if t.kind == "int" && (n < math.MinInt32 || n > math.MaxInt32) {
+			return b, mismatch(path, "%d is out of the range of int", n)
+		}
+		return appendLong(b, n), nil
+	case "float":
+		f, ok := toFloat(v)
+		if !ok {
+			return b, mismatch(path, "expected a number, got %T", v)
+		}
+		var buf [4]byte
+		binary.LittleEndian.PutUint32(buf[:], math.Float32bits(float32(f)))
+		return append(b, buf[:]...), nil
+	case "double":
+		f, ok := toFloat(v)
+		if !ok {
+			return b, mismatch(path, "expected a number, got %T", v)
+		}
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(f))
+		return append(b, buf[:]...), nil
+	case "string":
+		s, ok := toString(v)
+		if !ok {
+			return b, mismatch(path, "expected a string, got %T", v)
+		}
+		b = appendLong(b, int64(len(s)))
+		return append(b, s...), nil
+	case "bytes":
+		x, ok := toBytes(v)
+		if !ok {
+			return b, mismatch(path, "expected bytes, got %T", v)
+		}
+		b = appendLong(b, int64(len(x)))
+		return append(b, x...), nil
+	case "fixed":
+		x, ok := toBytes(v)
+		if !ok || len(x) != t.size {
+			return b, mismatch(path, "expected %d bytes of %s", t.size, t.name)
+		}
+		return append(b, x...), nil
+	case "enum":
+		s, _ := v.(string)
+		for i, symbol := range t.symbols {
+			if s == symbol {
+				return appendLong(b, int64(i)), nil
+			}
+		}
+		return b, mismatch(path, "%v is not a symbol of %s", v, t.name)
+	case "array":
+		return t.encodeArray(b, v, path)
+	case "map":
+		return t.encodeMap(b, v, path)
+	case "record":
+		return t.encodeRecord(b, v, path)
+	case "union":
+		return t.encodeUnion(b, v, path)
+	}
+	return b, fmt.Errorf("unsupported type %s", t.kind)
+}
+
+func (t *avroType) encodeRecord(b []byte, v interface{}, path string) ([]byte, error) {
+	m, ok := toMap(v)
+	if !ok {
+		return b, mismatch(path, "expected an object for %s, got %T", t.name, v)
+	}
+	var err error
+	for _, f := range t.fields {
+		value, present := m[f.name]
+		switch {
+		case present:
+			b, err = f.typ.encode(b, value, join(path, f.name))
+		case f.hasDefault:
+			b, err = f.typ.encodeDefault(b, f.def, join(path, f.name))
+		case f.typ.nullable():
+			// Missing optional fields are null, whether or not the schema says so with a default
+			b, err = f.typ.encode(b, nil, join(path, f.name))
+		default:
+			return b, mismatch(join(path, f.name), "missing")
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	return b, nil
+}
+
+// encodeDefault encodes the default value of a field, which is of the first branch of a union.
+func (t *avroType) encodeDefault(b []byte, def interface{}, path string) ([]byte, error) {
+	if t.kind == "union" {
+		b = appendLong(b, 0)
+		return t.branches[0].encode(b, def, path)
+	}
+	return t.encode(b, def, path)
+}
+
+func (t *avroType) nullable() bool {
+	if t.kind == "null" {
+		return true
+	}
+	for _, branch := range t.branches {
+		if branch.kind == "null" {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *avroType) encodeUnion(b []byte, v interface{}, path string) ([]byte, error) {
+	kinds := make([]string, len(t.branches))
+	for i, branch := range t.branches {
+		// The value is encoded after the index of the first branch it fits
+		encoded, err := branch.encode(appendLong(b, int64(i)), v, path)
+		if err == nil {
+			return encoded, nil
+		}
+		if _, ok := err.(*MismatchError); !ok {
+			return b, err
+		}
+		kinds[i] = branch.kind
+		if branch.name != "" {
+			kinds[i] = branch.name
+		}
+	}
+	return b, mismatch(path, "%T fits none of %s", v, strings.Join(kinds, ", "))
+}
+
+func (t *avroType) encodeArray(b []byte, v interface{}, path string) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if v == nil || (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) {
+		return b, mismatch(path, "expected an array, got %T", v)
+	}
+	var err error
+	if n := rv.Len(); n > 0 {
+		b = appendLong(b, int64(n))
+		for i := 0; i < n; i++ {
+			if b, err = t.items.encode(b, rv.Index(i).Interface(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return b, err
+			}
+		}
+	}
+	return appendLong(b, 0), nil
+}
+
+func (t *avroType) encodeMap(b []byte, v interface{}, path string) ([]byte, error) {
+	m, ok := toMap(v)
+	if !ok {
+		return b, mismatch(path, "expected an object, got %T", v)
+	}
+	if len(m) > 0 {
+		// Sorted, so that an event is always encoded to the same bytes
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = appendLong(b, int64(len(keys)))
+		var err error
+		for _, k := range keys {
+			b = appendLong(b, int64(len(k)))
+			b = append(b, k...)
+			if b, err = t.values.encode(b, m[k], join(path, k)); err != nil {
+				return b, err
+			}
+		}
+	}
+	return appendLong(b, 0), nil
+}
+
+func appendLong(b []byte, n int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], n)]...)
+}
+
+// toInt converts integers, integral floats, as decoded from JSON, and times, for the timestamp and date logical types.
+func (t *avroType) toInt(v interface{}) (int64, bool) {
+	if ts, ok := toTime(v); ok {
+		switch t.logical {
+		case "timestamp-millis":
+			return ts.UnixNano() / int64(time.Millisecond), true
+		case "timestamp-micros":
+			return ts.UnixNano() / int64(time.Microsecond), true
+		case "date":
+			return ts.Unix() / (24 * 60 * 60), true
+		}
+		return 0, false
+	}
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int8:
+		return int64(n), true
+	case int16:
+		return int64(n), true
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint8:
+		return int64(n), true
+	case uint16:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint:
+		return int64(n), uint64(n) <= math.MaxInt64
+	case uint64:
+		return int64(n), n <= math.MaxInt64
+	case float32:
+		return int64(n), float32(int64(n)) == n
+	case float64:
+		return int64(n), float64(int64(n)) == n
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	if n, ok := (&avroType{}).toInt(v); ok {
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// toString converts strings, and times, formatted as by the JSON encoding of events.
+func toString(v interface{}) (string, bool) {
+	if s, ok := v.(string); ok {
+		return s, true
+	}
+	if ts, ok := toTime(v); ok {
+		return ts.UTC().Format("2006-01-02T15:04:05.000Z"), true
+	}
+	return "", false
+}
+
+func toBytes(v interface{}) ([]byte, bool) {
+	switch x := v.(type) {
+	case []byte:
+		return x, true
+	case string:
+		return []byte(x), true
+	}
+	return nil, false
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch ts := v.(type) {
+	case time.Time:
+		return ts, true
+	case common.Time:
+		return time.Time(ts), true
+	}
+	return time.Time{}, false
+}
+
+func toMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case common.MapStr:
+		return m, true
+	case map[string]interface{}:
+		return m, true
+	}
+	rv := reflect.ValueOf(v)
+	if v == nil || rv.Kind() != reflect.Map || rv.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	m := make(map[string]interface{}, rv.Len())
+	for _, k := range rv.MapKeys() {
+		m[k.String()] = rv.MapIndex(k).Interface()
+	}
+	return m, true
+}
@@ -0,0 +1,100 @@
+package schema
+
+import (
+	"bytes"
+	"github.com/elastic/beats/libbeat/common"
+	"testing"
+	"time"
+)
+
+func encode(t *testing.T, definition string, v interface{}) ([]byte, error) {
+	s, err := parseAvro(definition)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return s.encode(nil, v, "")
+}
+
+func TestEncodeAvro(t *testing.T) {
+	cases := []struct {
+		definition string
+		value      interface{}
+		expected   []byte
+	}{
+		{`"long"`, 1, []byte{0x02}},
+		{`"long"`, int64(-1), []byte{0x01}},
+		{`"int"`, float64(64), []byte{0x80, 0x01}},
+		{`"boolean"`, true, []byte{0x01}},
+		{`"double"`, 1, []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+		{`"string"`, "foo", []byte{0x06, 'f', 'o', 'o'}},
+		{`"bytes"`, []byte{1}, []byte{0x02, 0x01}},
+		{`["null", "string"]`, nil, []byte{0x00}},
+		{`["null", "string"]`, "a", []byte{0x02, 0x02, 'a'}},
+		{`{"type": "array", "items": "long"}`, []int{1, 2}, []byte{0x04, 0x02, 0x04, 0x00}},
+		{`{"type": "array", "items": "long"}`, []interface{}{}, []byte{0x00}},
+		{`{"type": "map", "values": "long"}`, common.MapStr{"b": 2, "a": 1}, []byte{0x04, 0x02, 'a', 0x02, 0x02, 'b', 0x04, 0x00}},
+		{`{"type": "enum", "name": "E", "symbols": ["A", "B"]}`, "B", []byte{0x02}},
+		{`{"type": "fixed", "name": "F", "size": 2}`, "ab", []byte{'a', 'b'}},
+		{`{"type": "long", "logicalType": "timestamp-millis"}`, time.Unix(1, 0), []byte{0xd0, 0x0f}},
+		{`"string"`, common.Time(time.Unix(0, 0)), append([]byte{0x30}, "1970-01-01T00:00:00.000Z"...)},
+	}
+	for _, c := range cases {
+		b, err := encode(t, c.definition, c.value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.definition, err)
+		} else if !bytes.Equal(b, c.expected) {
+			t.Errorf("%s: expected %x, got %x", c.definition, c.expected, b)
+		}
+	}
+}
+
+func TestEncodeAvroRecord(t *testing.T) {
+	definition := `{
+		"type": "record", "name": "Event", "namespace": "awsbeats",
+		"fields": [
+			{"name": "message", "type": "string"},
+			{"name": "level", "type": "string", "default": "info"},
+			{"name": "host", "type": ["null", {"type": "record", "name": "Host", "fields": [{"name": "name", "type": "string"}]}]},
+			{"name": "parent", "type": ["null", "Host"]},
+			{"name": "tags", "type": {"type": "array", "items": "string"}, "default": []}
+		]
+	}`
+	b, err := encode(t, definition, common.MapStr{"message": "a", "host": common.MapStr{"name": "h"}, "ignored": 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []byte{0x02, 'a', 0x08, 'i', 'n', 'f', 'o', 0x02, 0x02, 'h', 0x00, 0x00}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("expected %x, got %x", expected, b)
+	}
+}
+
+func TestEncodeAvroMismatch(t *testing.T) {
+	definition := `{"type": "record", "name": "Event", "fields": [
+		{"name": "http", "type": {"type": "record", "name": "HTTP", "fields": [{"name": "status", "type": "int"}]}}
+	]}`
+	cases := map[string]common.MapStr{
+		"http.status": {"http": common.MapStr{"status": "200"}},
+		"http":        {"message": "a"},
+	}
+	for path, v := range cases {
+		_, err := encode(t, definition, v)
+		if m, ok := err.(*MismatchError); !ok || m.Path != path {
+			t.Errorf("expected a mismatch at %s, got %v", path, err)
+		}
+	}
+	if _, err := encode(t, `"int"`, int64(1)<<40); err == nil {
+		t.Errorf("expected an int out of range to fail")
+	}
+	if _, err := encode(t, `["null", "long"]`, "a"); err == nil {
+		t.Errorf("expected a value fitting no branch to fail")
+	}
+}
+
+func TestParseInvalidAvro(t *testing.T) {
+	for _, definition := range []string{`{`, `"Unknown"`, `{"type": "record", "fields": []}`, `[["null"]]`, `{"type": "array", "items": "Unknown"}`} {
+		if _, err := parseAvro(definition); err == nil {
+			t.Errorf("expected %s to be invalid", definition)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Package schema encodes events to Avro or Protobuf records against a schema, loaded from a local file or resolved
+// from the AWS Glue Schema Registry, as an alternative to the JSON encoding of libbeat.
+// Records of a schema of the registry start with the header of the Glue wire format, so that consumers using the
+// Glue Schema Registry libraries, Kinesis Data Analytics or Firehose record format conversion can decode them.
+package schema
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/golang/protobuf/proto"
+	"github.com/s12v/awsbeats/metrics"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+const (
+	// As per https://github.com/awslabs/aws-glue-schema-registry: a header version, a compression byte and the UUID
+	// of the schema version
+	glueHeaderVersion = 3
+	glueNoCompression = 0
+)
+
+// glueAPI is the part of the Glue API the codec calls, implemented by *glue.Glue.
+type glueAPI interface {
+	GetSchemaVersion(input *glue.GetSchemaVersionInput) (*glue.GetSchemaVersionOutput, error)
+	GetSchemaByDefinition(input *glue.GetSchemaByDefinitionInput) (*glue.GetSchemaByDefinitionOutput, error)
+}
+
+// encoder is a parsed schema, which encodes the values of events.
+type encoder interface {
+	encode(b []byte, v interface{}, path string) ([]byte, error)
+}
+
+// Codec encodes events to Avro or Protobuf records. It's shared by the clients of an output, and safe for concurrent
+// use. A nil *Codec stands for the JSON encoding.
+type Codec struct {
+	encoding   string
+	config     SchemaConfig
+	definition string
+	glue       glueAPI
+	deadLetter *deadLetter
+	metrics    *metrics.Metrics
+
+	mu       sync.Mutex
+	resolved bool
+	schema   encoder
+	header   []byte
+	users    int
+}
+
+var newGlue = func(sess *session.Session) glueAPI {
+	return glue.New(sess)
+}
+
+// New returns the codec of an output, or nil for the JSON encoding. The schema of a local file is parsed right away,
+// while the registry is only called by Resolve.
+func New(c Config, sess *session.Session, info beat.Info, m *metrics.Metrics) (*Codec, error) {
+	if c.Encoding != EncodingAvro && c.Encoding != EncodingProtobuf {
+		return nil, nil
+	}
+	codec := &Codec{encoding: c.Encoding, config: c.Schema, metrics: m}
+	if c.Schema.File != "" {
+		definition, err := ioutil.ReadFile(c.Schema.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema.file: %v", err)
+		}
+		codec.definition = string(definition)
+		if codec.schema, err = codec.parse(codec.definition); err != nil {
+			return nil, fmt.Errorf("schema.file %s: %v", c.Schema.File, err)
+		}
+	}
+	if c.Schema.usesRegistry() {
+		codec.glue = newGlue(sess)
+	} else {
+		codec.resolved = true
+	}
+	if c.DeadLetter.Path != "" {
+		codec.deadLetter = newDeadLetter(c.DeadLetter, info)
+	}
+	return codec, nil
+}
+
+// Acquire keeps the codec open for one more connected client.
+func (c *Codec) Acquire() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users++
+}
+
+// Close releases the codec for one of its clients, and closes the dead letter file once none is left. The file is
+// opened again if events are written to it after.
+func (c *Codec) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.users == 0 {
+		return nil
+	}
+	c.users--
+	if c.users > 0 {
+		return nil
+	}
+	return c.deadLetter.close()
+}
+
+// Resolve looks the schema up in the registry, once it succeeded.
+func (c *Codec) Resolve() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resolved {
+		return nil
+	}
+
+	definition, versionID, err := c.lookUp()
+	if err != nil {
+		return fmt.Errorf("failed to resolve the schema: %v", err)
+	}
+	uuid, err := parseUUID(versionID)
+	if err != nil {
+		return fmt.Errorf("invalid schema version ID %q: %v", versionID, err)
+	}
+	if c.schema == nil {
+		if c.schema, err = c.parse(definition); err != nil {
+			return fmt.Errorf("schema version %s: %v", versionID, err)
+		}
+	}
+	c.header = append([]byte{glueHeaderVersion, glueNoCompression}, uuid...)
+	if s, ok := c.schema.(*protoSchema); ok {
+		// Which message of the schema the records are
+		c.header = append(c.header, proto.EncodeVarint(uint64(s.index))...)
+	}
+	c.resolved = true
+	logp.NewLogger("schema").Infof("Encoding events with schema version %s", versionID)
+	return nil
+}
+
+func (c *Codec) parse(definition string) (encoder, error) {
+	// Not returned as they are, for the encoder to be nil on errors
+	if c.encoding == EncodingProtobuf {
+		s, err := parseProtobuf(definition, c.config.Message)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	t, err := parseAvro(definition)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// dataFormat is the data format of the schema in the registry.
+func (c *Codec) dataFormat() string {
+	if c.encoding == EncodingProtobuf {
+		return glue.DataFormatProtobuf
+	}
+	return glue.DataFormatAvro
+}
+
+func (c *Codec) lookUp() (definition, versionID string, err error) {
+	schemaID := &glue.SchemaId{RegistryName: aws.String(c.config.registry()), SchemaName: aws.String(c.config.Name)}
+	if c.definition != "" {
+		// The version of the registry that the local file is
+		out, err := c.glue.GetSchemaByDefinition(&glue.GetSchemaByDefinitionInput{
+			SchemaId:         schemaID,
+			SchemaDefinition: aws.String(c.definition),
+		})
+		if err != nil {
+			return "", "", err
+		}
+		if status := aws.StringValue(out.Status); status != glue.SchemaVersionStatusAvailable {
+			return "", "", fmt.Errorf("schema.file is version %s of schema %s, which is %s", aws.StringValue(out.SchemaVersionId), c.config.Name, status)
+		}
+		if format := aws.StringValue(out.DataFormat); format != c.dataFormat() {
+			return "", "", fmt.Errorf("schema %s is %s, not %s", c.config.Name, format, c.dataFormat())
+		}
+		return c.definition, aws.StringValue(out.SchemaVersionId), nil
+	}
+
+	in := &glue.GetSchemaVersionInput{}
+	if c.config.VersionID != "" {
+		in.SchemaVersionId = aws.String(c.config.VersionID)
+	} else {
+		in.SchemaId = schemaID
+		in.SchemaVersionNumber = &glue.SchemaVersionNumber{LatestVersion: aws.Bool(c.config.Version == 0)}
+		if c.config.Version != 0 {
+			in.SchemaVersionNumber.VersionNumber = aws.Int64(c.config.Version)
+		}
+	}
+	out, err := c.glue.GetSchemaVersion(in)
+	if err != nil {
+		return "", "", err
+	}
+	if status := aws.StringValue(out.Status); status != glue.SchemaVersionStatusAvailable {
+		return "", "", fmt.Errorf("schema version %s is %s", aws.StringValue(out.SchemaVersionId), status)
+	}
+	if format := aws.StringValue(out.DataFormat); format != c.dataFormat() {
+		return "", "", fmt.Errorf("schema version %s is %s, not %s", aws.StringValue(out.SchemaVersionId), format, c.dataFormat())
+	}
+	return aws.StringValue(out.SchemaDefinition), aws.StringValue(out.SchemaVersionId), nil
+}
+
+// Encode encodes the event to an Avro or Protobuf record, behind the Glue header for a schema of the registry. Events that don't
+// fit the schema fail with a *MismatchError, and are written to the dead letter file, if any.
+func (c *Codec) Encode(index string, event *beat.Event) ([]byte, error) {
+	c.mu.Lock()
+	resolved, schema, header := c.resolved, c.schema, c.header
+	c.mu.Unlock()
+	if !resolved {
+		return nil, errors.New("schema isn't resolved yet")
+	}
+
+	b, err := schema.encode(append([]byte(nil), header...), value(event), "")
+	if err != nil {
+		if _, ok := err.(*MismatchError); ok {
+			c.metrics.SchemaMismatch()
+			c.deadLetter.write(event, err)
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// value is what an event is encoded from: its fields, along with `timestamp` and `metadata`, as the names of Avro and
+// Protobuf fields can't start with @, unless the event has fields of the same names.
+func value(event *beat.Event) common.MapStr {
+	v := make(common.MapStr, len(event.Fields)+2)
+	v["timestamp"] = event.Timestamp
+	if event.Meta != nil {
+		v["metadata"] = event.Meta
+	}
+	for k, f := range event.Fields {
+		v[k] = f
+	}
+	return v
+}
+
+func parseUUID(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 16 {
+		return nil, errors.New("not a UUID")
+	}
+	return b, nil
+}
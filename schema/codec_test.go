@@ -0,0 +1,206 @@
+package schema
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/s12v/awsbeats/awsconfig"
+	"github.com/s12v/awsbeats/awstest"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const eventSchema = `{"type": "record", "name": "Event", "fields": [
+	{"name": "timestamp", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+	{"name": "message", "type": "string"}
+]}`
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return dir
+}
+
+func newCodec(t *testing.T, s *awstest.Server, c Config) *Codec {
+	sess, err := awsconfig.NewSession(s.Config(), beat.Info{}, "schema")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	codec, err := New(c, sess, beat.Info{Version: "7.5.0"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return codec
+}
+
+func event(message interface{}) *beat.Event {
+	return &beat.Event{Timestamp: time.Unix(1, 0), Fields: common.MapStr{"message": message}}
+}
+
+// Timestamp of 1s and message "a"
+var encodedEvent = []byte{0xd0, 0x0f, 0x02, 'a'}
+
+func TestNewWithJSON(t *testing.T) {
+	codec, err := New(DefaultConfig, nil, beat.Info{}, nil)
+	if codec != nil || err != nil {
+		t.Errorf("expected no codec, got %v, %v", codec, err)
+	}
+	if err := codec.Resolve(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEncodeWithSchemaFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "event.avsc")
+	ioutil.WriteFile(file, []byte(eventSchema), 0600)
+
+	codec, err := New(Config{Encoding: EncodingAvro, Schema: SchemaConfig{File: file}}, nil, beat.Info{}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := codec.Encode("filebeat", event("a"))
+	if err != nil || !bytes.Equal(b, encodedEvent) {
+		t.Errorf("unexpected record %x: %v", b, err)
+	}
+
+	if _, err := New(Config{Encoding: EncodingAvro, Schema: SchemaConfig{File: filepath.Join(dir, "none")}}, nil, beat.Info{}, nil); err == nil {
+		t.Errorf("expected a missing file to fail")
+	}
+}
+
+func TestEncodeWithRegistry(t *testing.T) {
+	s := awstest.NewServer()
+	defer s.Close()
+	s.CreateSchemaVersion(defaultRegistry, "events", `"string"`)
+	id := s.CreateSchemaVersion(defaultRegistry, "events", eventSchema)
+	uuid, _ := parseUUID(id)
+
+	codec := newCodec(t, s, Config{Encoding: EncodingAvro, Schema: SchemaConfig{Name: "events"}})
+	if _, err := codec.Encode("filebeat", event("a")); err == nil {
+		t.Errorf("expected encoding to fail before the schema is resolved")
+	}
+	if err := codec.Resolve(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := codec.Encode("filebeat", event("a"))
+	expected := append(append([]byte{3, 0}, uuid...), encodedEvent...)
+	if err != nil || !bytes.Equal(b, expected) {
+		t.Errorf("expected %x, got %x: %v", expected, b, err)
+	}
+}
+
+func TestResolveSchemaFileVersion(t *testing.T) {
+	s := awstest.NewServer()
+	defer s.Close()
+	id := s.CreateSchemaVersion("reg", "events", eventSchema)
+	s.CreateSchemaVersion("reg", "events", `"string"`)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "event.avsc")
+	ioutil.WriteFile(file, []byte(eventSchema), 0600)
+
+	codec := newCodec(t, s, Config{Encoding: EncodingAvro, Schema: SchemaConfig{File: file, Registry: "reg", Name: "events"}})
+	if err := codec.Resolve(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	uuid, _ := parseUUID(id)
+	if !bytes.Equal(codec.header[2:], uuid) {
+		t.Errorf("expected the version of the file, got %x", codec.header)
+	}
+
+	unknown := newCodec(t, s, Config{Encoding: EncodingAvro, Schema: SchemaConfig{File: file, Name: "other"}})
+	if err := unknown.Resolve(); err == nil {
+		t.Errorf("expected a schema missing from the registry to fail")
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	s := awstest.NewServer()
+	defer s.Close()
+	id := s.CreateSchemaVersion(defaultRegistry, "events", eventSchema)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead", "letters.ndjson")
+
+	codec := newCodec(t, s, Config{
+		Encoding:   EncodingAvro,
+		Schema:     SchemaConfig{VersionID: id},
+		DeadLetter: DeadLetterConfig{Path: path, MaxSize: 200},
+	})
+	codec.Acquire()
+	codec.Acquire()
+	if err := codec.Resolve(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := codec.Encode("filebeat", event(i)); err == nil {
+			t.Fatalf("expected a mismatch")
+		}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lines := 0
+	for ; scanner.Scan(); lines++ {
+		var letter struct {
+			Error string
+			Event map[string]interface{}
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil || letter.Error == "" || letter.Event["message"] == nil {
+			t.Errorf("unexpected dead letter %s: %v", scanner.Bytes(), err)
+		}
+	}
+	if lines == 0 || lines == 3 {
+		t.Errorf("expected the file to be rotated, got %d lines", lines)
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("expected a rotated file: %v", err)
+	}
+
+	// Closed with the last client
+	codec.Close()
+	if codec.deadLetter.file == nil {
+		t.Errorf("expected the dead letter file to be open while a client is left")
+	}
+	codec.Close()
+	if codec.deadLetter.file != nil {
+		t.Errorf("expected the dead letter file to be closed")
+	}
+}
+
+func TestEncodeProtobufWithRegistry(t *testing.T) {
+	s := awstest.NewServer()
+	defer s.Close()
+	id := s.CreateSchemaVersionOfFormat(defaultRegistry, "events", "PROTOBUF", eventProto)
+	s.CreateSchemaVersion(defaultRegistry, "avro", eventSchema)
+	uuid, _ := parseUUID(id)
+
+	codec := newCodec(t, s, Config{Encoding: EncodingProtobuf, Schema: SchemaConfig{Name: "events", Message: "Event.Host"}})
+	if err := codec.Resolve(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := codec.Encode("filebeat", &beat.Event{Timestamp: time.Unix(1, 0), Fields: common.MapStr{"name": "h"}})
+	// The header, the index of awsbeats.Event.Host among the messages, and the message
+	expected := append(append([]byte{3, 0}, uuid...), 0x02, 0x0a, 0x01, 'h')
+	if err != nil || !bytes.Equal(b, expected) {
+		t.Errorf("expected %x, got %x: %v", expected, b, err)
+	}
+
+	avro := newCodec(t, s, Config{Encoding: EncodingProtobuf, Schema: SchemaConfig{Name: "avro"}})
+	if err := avro.Resolve(); err == nil {
+		t.Errorf("expected an Avro schema to fail")
+	}
+}
@@ -0,0 +1,107 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	EncodingJSON     = "json"
+	EncodingAvro     = "avro"
+	EncodingProtobuf = "protobuf"
+
+	// Registry of the schemas of an account that don't set one
+	defaultRegistry = "default-registry"
+)
+
+// Config of the encoding of an output, inlined in its config.
+type Config struct {
+	Encoding   string           `config:"encoding"`
+	Schema     SchemaConfig     `config:"schema"`
+	DeadLetter DeadLetterConfig `config:"dead_letter"`
+}
+
+// SchemaConfig tells where the schema of the records is: in a local file, in the Glue Schema Registry, or both, in
+// which case the version of the registry with the definition of the file is used.
+type SchemaConfig struct {
+	File     string `config:"file"`
+	Registry string `config:"registry"`
+	Name     string `config:"name"`
+	// Version number of the schema, or 0 for its latest version
+	Version   int64  `config:"version"`
+	VersionID string `config:"version_id"`
+	// Full name of the Protobuf message of the records, or "" for the first message of the schema
+	Message string `config:"message"`
+}
+
+// DeadLetterConfig of the file events that don't fit the schema are written to.
+type DeadLetterConfig struct {
+	Path    string `config:"path"`
+	MaxSize int64  `config:"max_size"`
+}
+
+// DefaultConfig is the config of an output that doesn't set its encoding.
+var DefaultConfig = Config{
+	Encoding: EncodingJSON,
+	DeadLetter: DeadLetterConfig{
+		MaxSize: 100 * 1024 * 1024,
+	},
+}
+
+// Validate validates the settings of the schema-bound encodings. Other encodings are validated by the output, which
+// knows which ones it supports.
+func (c *Config) Validate() error {
+	switch c.Encoding {
+	case EncodingAvro, EncodingProtobuf:
+	default:
+		return nil
+	}
+
+	if c.DeadLetter.MaxSize < 0 {
+		return errors.New("dead_letter.max_size must not be negative")
+	}
+
+	s := c.Schema
+	if s.Message != "" && c.Encoding != EncodingProtobuf {
+		return errors.New("schema.message requires the protobuf encoding")
+	}
+	if s.VersionID != "" {
+		if s.File != "" || s.Name != "" || s.Version != 0 {
+			return errors.New("schema.version_id can't be combined with schema.file, schema.name or schema.version")
+		}
+		if _, err := parseUUID(s.VersionID); err != nil {
+			return fmt.Errorf("invalid schema.version_id: %v", err)
+		}
+		return nil
+	}
+	if s.File == "" && s.Name == "" {
+		return fmt.Errorf("%s encoding requires schema.file, schema.name or schema.version_id", c.Encoding)
+	}
+	if s.Name == "" && (s.Registry != "" || s.Version != 0) {
+		return errors.New("schema.registry and schema.version require schema.name")
+	}
+	if s.File != "" && s.Version != 0 {
+		return errors.New("schema.version can't be combined with schema.file, whose version is looked up")
+	}
+	if s.Version < 0 {
+		return errors.New("schema.version must not be negative")
+	}
+	return nil
+}
+
+// Binary tells whether records are binary rather than JSON objects.
+func (c *Config) Binary() bool {
+	return c.Encoding == EncodingAvro || c.Encoding == EncodingProtobuf
+}
+
+// usesRegistry tells whether the schema is resolved from the Glue Schema Registry, and records carry the Glue header.
+func (s *SchemaConfig) usesRegistry() bool {
+	return s.Name != "" || s.VersionID != ""
+}
+
+func (s *SchemaConfig) registry() string {
+	if s.Registry == "" {
+		return defaultRegistry
+	}
+	return s.Registry
+}
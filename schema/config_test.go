@@ -0,0 +1,38 @@
+package schema
+
+import (
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := []Config{
+		DefaultConfig,
+		{Encoding: EncodingAvro, Schema: SchemaConfig{File: "event.avsc"}},
+		{Encoding: EncodingAvro, Schema: SchemaConfig{File: "event.avsc", Registry: "reg", Name: "events"}},
+		{Encoding: EncodingAvro, Schema: SchemaConfig{Name: "events", Version: 2}},
+		{Encoding: EncodingAvro, Schema: SchemaConfig{VersionID: "00000001-0000-4000-8000-000000000001"}},
+		{Encoding: EncodingProtobuf, Schema: SchemaConfig{File: "event.proto", Message: "awsbeats.Event"}},
+		{Encoding: EncodingProtobuf, Schema: SchemaConfig{Name: "events"}},
+	}
+	for _, c := range valid {
+		if err := c.Validate(); err != nil {
+			t.Errorf("unexpected error of %+v: %v", c, err)
+		}
+	}
+
+	invalid := []Config{
+		{Encoding: EncodingProtobuf},
+		{Encoding: EncodingAvro, Schema: SchemaConfig{File: "event.avsc", Message: "Event"}},
+		{Encoding: EncodingAvro},
+		{Encoding: EncodingAvro, Schema: SchemaConfig{File: "event.avsc", Registry: "reg"}},
+		{Encoding: EncodingAvro, Schema: SchemaConfig{File: "event.avsc", Name: "events", Version: 1}},
+		{Encoding: EncodingAvro, Schema: SchemaConfig{Name: "events", VersionID: "00000001-0000-4000-8000-000000000001"}},
+		{Encoding: EncodingAvro, Schema: SchemaConfig{VersionID: "1"}},
+		{Encoding: EncodingAvro, Schema: SchemaConfig{File: "event.avsc"}, DeadLetter: DeadLetterConfig{MaxSize: -1}},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", c)
+		}
+	}
+}
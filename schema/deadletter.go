@@ -0,0 +1,109 @@
+package schema
+
+import (
+	"encoding/json"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/logp"
+	jsoncodec "github.com/elastic/beats/libbeat/outputs/codec/json"
+	"github.com/elastic/beats/libbeat/paths"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// deadLetter appends the events that don't fit the schema to a file, as JSON lines of the error and the event as the
+// JSON encoding would have sent it. The file is rotated to `<path>.1` once it's over its max size.
+// A relative path is resolved against the data path of the beat, like the spool.
+// A nil *deadLetter drops the events.
+type deadLetter struct {
+	config  DeadLetterConfig
+	encoder *jsoncodec.Encoder
+	log     *logp.Logger
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func newDeadLetter(c DeadLetterConfig, info beat.Info) *deadLetter {
+	c.Path = paths.Resolve(paths.Data, c.Path)
+	return &deadLetter{
+		config:  c,
+		encoder: jsoncodec.New(info.Version, jsoncodec.Config{}),
+		log:     logp.NewLogger("schema"),
+	}
+}
+
+func (d *deadLetter) write(event *beat.Event, reason error) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	encoded, err := d.encoder.Encode("", event)
+	if err != nil {
+		d.log.Warnf("Failed to encode a dead letter: %v", err)
+		return
+	}
+	msg, _ := json.Marshal(reason.Error())
+	line := make([]byte, 0, len(encoded)+len(msg)+22)
+	line = append(line, `{"error":`...)
+	line = append(line, msg...)
+	line = append(line, `,"event":`...)
+	line = append(line, encoded...)
+	line = append(line, "}\n"...)
+
+	if err := d.open(int64(len(line))); err != nil {
+		d.log.Warnf("Failed to open dead letter file %s: %v", d.config.Path, err)
+		return
+	}
+	n, err := d.file.Write(line)
+	d.size += int64(n)
+	if err != nil {
+		d.log.Warnf("Failed to write dead letter file %s: %v", d.config.Path, err)
+	}
+}
+
+// close closes the file, if it's open.
+func (d *deadLetter) close() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+// open opens the file, rotating it first if n more bytes would take it over its max size.
+func (d *deadLetter) open(n int64) error {
+	if d.file != nil && d.config.MaxSize > 0 && d.size+n > d.config.MaxSize && d.size > 0 {
+		d.file.Close()
+		d.file = nil
+		if err := os.Rename(d.config.Path, d.config.Path+".1"); err != nil {
+			return err
+		}
+	}
+	if d.file != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(d.config.Path), 0750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(d.config.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	d.file, d.size = f, info.Size()
+	return nil
+}
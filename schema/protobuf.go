@@ -0,0 +1,88 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/jhump/protoreflect/dynamic"
+	"sort"
+)
+
+// Name the definition of a schema is parsed as. It can only import the well-known types of google/protobuf.
+const protoFile = "schema.proto"
+
+// protoSchema is a parsed Protobuf schema, with the message events are encoded to.
+type protoSchema struct {
+	message *desc.MessageDescriptor
+	// Index of the message among all the messages of the schema, nested ones included, sorted by full name, which
+	// follows the header of records in the Glue wire format
+	index int
+}
+
+// Fields of events that aren't in the message are left out
+var protoUnmarshaler = &jsonpb.Unmarshaler{AllowUnknownFields: true}
+
+// parseProtobuf parses a Protobuf schema, and picks the message of the given name, relative to the package of the
+// schema or not, or else the first message of the schema.
+func parseProtobuf(definition, message string) (*protoSchema, error) {
+	parser := protoparse.Parser{Accessor: protoparse.FileContentsFromMap(map[string]string{protoFile: definition})}
+	files, err := parser.ParseFiles(protoFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Protobuf schema: %v", err)
+	}
+	file := files[0]
+
+	var messages []*desc.MessageDescriptor
+	var walk func([]*desc.MessageDescriptor)
+	walk = func(mds []*desc.MessageDescriptor) {
+		for _, md := range mds {
+			messages = append(messages, md)
+			walk(md.GetNestedMessageTypes())
+		}
+	}
+	walk(file.GetMessageTypes())
+	if len(messages) == 0 {
+		return nil, errors.New("invalid Protobuf schema: no message")
+	}
+
+	md := messages[0]
+	if message != "" {
+		md = file.FindMessage(message)
+		if md == nil && file.GetPackage() != "" {
+			md = file.FindMessage(file.GetPackage() + "." + message)
+		}
+		if md == nil || md.IsMapEntry() {
+			return nil, fmt.Errorf("no message %s in the Protobuf schema", message)
+		}
+	}
+	names := make([]string, len(messages))
+	for i, m := range messages {
+		names[i] = m.GetFullyQualifiedName()
+	}
+	sort.Strings(names)
+	return &protoSchema{message: md, index: sort.SearchStrings(names, md.GetFullyQualifiedName())}, nil
+}
+
+// encode appends the Protobuf binary encoding of v to b. Values are mapped to the fields of the message as by the JSON
+// mapping of Protobuf, see https://protobuf.dev/programming-guides/proto3/#json, and map entries are sorted by key.
+func (s *protoSchema) encode(b []byte, v interface{}, path string) ([]byte, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return b, mismatch(path, "%v", err)
+	}
+	m := dynamic.NewMessage(s.message)
+	if err := m.UnmarshalJSONPB(protoUnmarshaler, js); err != nil {
+		return b, mismatch(path, "%v", err)
+	}
+	if err := m.ValidateRecursive(); err != nil {
+		return b, mismatch(path, "%v", err)
+	}
+	out, err := m.MarshalAppendDeterministic(b)
+	if err != nil {
+		return b, mismatch(path, "%v", err)
+	}
+	return out, nil
+}
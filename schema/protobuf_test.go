@@ -0,0 +1,193 @@
+package schema
+
+import (
+	"bytes"
+	"github.com/elastic/beats/libbeat/common"
+	"testing"
+	"time"
+)
+
+const eventProto = `
+syntax = "proto3";
+package awsbeats;
+
+import "google/protobuf/timestamp.proto";
+
+option java_package = "com.github.s12v.awsbeats";
+
+// An event
+message Event {
+	google.protobuf.Timestamp timestamp = 1;
+	string message = 2;
+	Level level = 3 [deprecated = true];
+	repeated int32 codes = 4;
+	repeated string tags = 5;
+	map<string, int64> counts = 6;
+	Host host = 7;
+	oneof source {
+		string file = 8;
+		int32 port = 9;
+	}
+	sint64 delta = 10;
+	repeated int32 unpacked = 11 [packed = false];
+	int64 time = 12;
+	reserved 13 to 15;
+
+	message Host {
+		string name = 1;
+	}
+}
+
+enum Level {
+	INFO = 0;
+	WARN = 1;
+}
+
+service Events {
+	rpc Put (Event) returns (Event) {}
+}
+`
+
+func encodeProto(t *testing.T, definition, message string, v interface{}) ([]byte, error) {
+	s, err := parseProtobuf(definition, message)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return s.encode(nil, v, "")
+}
+
+func TestEncodeProtobuf(t *testing.T) {
+	cases := []struct {
+		value    common.MapStr
+		expected []byte
+	}{
+		{common.MapStr{}, nil},
+		{common.MapStr{"timestamp": time.Unix(1, 2)}, []byte{0x0a, 0x04, 0x08, 0x01, 0x10, 0x02}},
+		{common.MapStr{"message": "testing"}, []byte{0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}},
+		{common.MapStr{"level": "WARN"}, []byte{0x18, 0x01}},
+		{common.MapStr{"level": 1}, []byte{0x18, 0x01}},
+		{common.MapStr{"codes": []int{3, 270, 86942}}, []byte{0x22, 0x06, 0x03, 0x8e, 0x02, 0x9e, 0xa7, 0x05}},
+		{common.MapStr{"codes": []int{}}, nil},
+		{common.MapStr{"tags": []string{"a", "b"}}, []byte{0x2a, 0x01, 'a', 0x2a, 0x01, 'b'}},
+		{common.MapStr{"counts": common.MapStr{"b": 2, "a": 1}}, []byte{0x32, 0x05, 0x0a, 0x01, 'a', 0x10, 0x01, 0x32, 0x05, 0x0a, 0x01, 'b', 0x10, 0x02}},
+		{common.MapStr{"host": common.MapStr{"name": "h"}}, []byte{0x3a, 0x03, 0x0a, 0x01, 'h'}},
+		{common.MapStr{"port": 80}, []byte{0x48, 0x50}},
+		{common.MapStr{"delta": -1}, []byte{0x50, 0x01}},
+		{common.MapStr{"unpacked": []int{1, 2}}, []byte{0x58, 0x01, 0x58, 0x02}},
+		{common.MapStr{"time": "1000"}, []byte{0x60, 0xe8, 0x07}},
+		{common.MapStr{"message": nil, "ignored": 1}, nil},
+	}
+	for _, c := range cases {
+		b, err := encodeProto(t, eventProto, "", c.value)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", c.value, err)
+		} else if !bytes.Equal(b, c.expected) {
+			t.Errorf("%v: expected %x, got %x", c.value, c.expected, b)
+		}
+	}
+}
+
+func TestEncodeProtobufScalars(t *testing.T) {
+	definition := `
+		message Scalars {
+			optional double double = 1;
+			optional float float = 2;
+			optional int32 int32 = 3;
+			optional uint32 uint32 = 4;
+			optional fixed32 fixed32 = 5;
+			optional sfixed64 sfixed64 = 6;
+			optional bool bool = 7;
+			optional bytes bytes = 8;
+			repeated int64 longs = 9;
+			required string required = 10;
+		}`
+	cases := []struct {
+		value    common.MapStr
+		expected []byte
+	}{
+		{common.MapStr{"double": 1}, []byte{0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+		{common.MapStr{"float": 1}, []byte{0x15, 0, 0, 0x80, 0x3f}},
+		{common.MapStr{"int32": -1}, []byte{0x18, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{common.MapStr{"uint32": 150}, []byte{0x20, 0x96, 0x01}},
+		{common.MapStr{"fixed32": 1}, []byte{0x2d, 0x01, 0, 0, 0}},
+		{common.MapStr{"sfixed64": -1}, []byte{0x31, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{common.MapStr{"bool": true}, []byte{0x38, 0x01}},
+		{common.MapStr{"bytes": []byte{1}}, []byte{0x42, 0x01, 0x01}},
+		// Not packed, as of proto2
+		{common.MapStr{"longs": []int{1, 2}}, []byte{0x48, 0x01, 0x48, 0x02}},
+	}
+	for _, c := range cases {
+		c.value["required"] = "r"
+		expected := append(c.expected, 0x52, 0x01, 'r')
+		b, err := encodeProto(t, definition, "", c.value)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", c.value, err)
+		} else if !bytes.Equal(b, expected) {
+			t.Errorf("%v: expected %x, got %x", c.value, expected, b)
+		}
+	}
+}
+
+func TestEncodeProtobufMismatch(t *testing.T) {
+	for _, v := range []common.MapStr{
+		{"message": 1},
+		{"level": "DEBUG"},
+		{"codes": []interface{}{1, "a"}},
+		{"host": common.MapStr{"name": true}},
+		{"host": "h"},
+		{"timestamp": "yesterday"},
+	} {
+		if _, err := encodeProto(t, eventProto, "", v); err == nil {
+			t.Errorf("%v: expected a mismatch", v)
+		} else if _, ok := err.(*MismatchError); !ok {
+			t.Errorf("%v: expected a mismatch, got %v", v, err)
+		}
+	}
+	if _, err := encodeProto(t, `syntax = "proto3"; message M { map<int32, string> m = 1; }`, "", common.MapStr{"m": common.MapStr{"a": "b"}}); err == nil {
+		t.Errorf("expected a map key that isn't an integer to fail")
+	}
+	if _, err := encodeProto(t, `message M { required string r = 1; }`, "", common.MapStr{}); err == nil {
+		t.Errorf("expected a missing required field to fail")
+	}
+	if _, err := encodeProto(t, `syntax = "proto3"; message M { uint32 n = 1; }`, "", common.MapStr{"n": -1}); err == nil {
+		t.Errorf("expected a negative uint32 to fail")
+	}
+}
+
+func TestParseProtobufMessage(t *testing.T) {
+	// Sorted by full name: awsbeats.Event, awsbeats.Event.CountsEntry, awsbeats.Event.Host
+	for message, index := range map[string]int{"": 0, "Event": 0, "awsbeats.Event.Host": 2, "Event.Host": 2} {
+		s, err := parseProtobuf(eventProto, message)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", message, err)
+		} else if s.index != index {
+			t.Errorf("%s: expected index %d, got %d", message, index, s.index)
+		}
+	}
+	for _, message := range []string{"Level", "Event.CountsEntry", "Other"} {
+		if _, err := parseProtobuf(eventProto, message); err == nil {
+			t.Errorf("expected message %s to be missing", message)
+		}
+	}
+}
+
+func TestParseInvalidProtobuf(t *testing.T) {
+	for _, definition := range []string{
+		``,
+		`message M {`,
+		`message M { Unknown u = 1; }`,
+		`message M { string a = 1; string b = 1; }`,
+		`message M { string a = 0; }`,
+		`message M { map<double, string> m = 1; }`,
+		`syntax = "proto4"; message M {}`,
+		`import "other.proto"; message M {}`,
+		`message M {} message M {}`,
+		`enum E {}`,
+		`message M { string s = 1 }`,
+		`/* message M {}`,
+	} {
+		if _, err := parseProtobuf(definition, ""); err == nil {
+			t.Errorf("expected %s to be invalid", definition)
+		}
+	}
+}
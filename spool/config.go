@@ -0,0 +1,42 @@
+package spool
+
+import (
+	"errors"
+	"github.com/elastic/beats/libbeat/common/cfgtype"
+	"runtime"
+	"time"
+)
+
+// Config of the spool of an output, set under `spool` in the output settings.
+type Config struct {
+	Enabled       bool             `config:"enabled"`
+	Path          string           `config:"path"`
+	MaxSize       cfgtype.ByteSize `config:"max_size"`
+	RetryInterval time.Duration    `config:"retry_interval"`
+}
+
+// DefaultConfig is the spool config of an output that doesn't set any of it.
+var DefaultConfig = Config{
+	MaxSize:       1 << 30,
+	RetryInterval: 10 * time.Second,
+}
+
+func (c *Config) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	if runtime.GOOS == "windows" {
+		return errUnsupported
+	}
+
+	if c.MaxSize <= 0 {
+		return errors.New("spool.max_size must be positive")
+	}
+
+	if c.RetryInterval <= 0 {
+		return errors.New("spool.retry_interval must be positive")
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const lockFile = "spool.lock"
+
+// The spool relies on flock and directory syncs, which Windows doesn't have
+var errUnsupported = errors.New("spool isn't supported on Windows")
+
+// unlockDir releases the lock of a spool directory. The lock file is left in place, as removing it could let a process
+// waiting on the old file and one creating a new file both hold the lock.
+func unlockDir(f *os.File) error {
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to release spool lock: %v", err)
+	}
+	return nil
+}
+
+// lockOwner returns the pid written to a lock file, or 0 if it can't be read.
+func lockOwner(path string) int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
@@ -0,0 +1,144 @@
+package spool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A segment file holds the records of one batch:
+//
+//	magic "AWSBSPL1"
+//	uint32 number of records
+//	for each record: uint32 length of the partition key, partition key, uint32 length of the data, data
+//	uint32 CRC-32C of everything above
+//
+// Integers are big endian.
+var segmentMagic = []byte("AWSBSPL1")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorrupt means that a segment file can't be read back as it was written, e.g. because the host crashed while the
+// file was being flushed.
+var errCorrupt = errors.New("corrupt segment")
+
+func encodeSegment(records []Record) []byte {
+	var buf bytes.Buffer
+	buf.Write(segmentMagic)
+	writeUint32(&buf, len(records))
+	for _, record := range records {
+		writeUint32(&buf, len(record.PartitionKey))
+		buf.WriteString(record.PartitionKey)
+		writeUint32(&buf, len(record.Data))
+		buf.Write(record.Data)
+	}
+	writeUint32(&buf, int(crc32.Checksum(buf.Bytes(), crcTable)))
+	return buf.Bytes()
+}
+
+func decodeSegment(b []byte) ([]Record, error) {
+	if len(b) < len(segmentMagic)+8 || !bytes.Equal(b[:len(segmentMagic)], segmentMagic) {
+		return nil, errCorrupt
+	}
+	body, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return nil, errCorrupt
+	}
+
+	r := bytes.NewReader(body[len(segmentMagic):])
+	n, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0, n)
+	for i := 0; i < n; i++ {
+		key, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		data, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, Record{PartitionKey: string(key), Data: data})
+	}
+	if r.Len() != 0 {
+		return nil, errCorrupt
+	}
+	return records, nil
+}
+
+// writeSegment writes a segment file atomically, so that a crash leaves either the previous content or the new one.
+func writeSegment(path string, records []Record) (int64, error) {
+	b := encodeSegment(records)
+	tmp := path + tmpSuffix
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return 0, err
+	}
+	return int64(len(b)), nil
+}
+
+func readSegment(path string) ([]Record, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSegment(b)
+}
+
+func writeUint32(buf *bytes.Buffer, n int) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n))
+	buf.Write(b[:])
+}
+
+func readUint32(r *bytes.Reader) (int, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, errCorrupt
+	}
+	n := binary.BigEndian.Uint32(b[:])
+	if int64(n) > int64(r.Len()) {
+		return 0, errCorrupt
+	}
+	return int(n), nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errCorrupt
+	}
+	return b, nil
+}
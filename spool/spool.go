@@ -0,0 +1,297 @@
+// Package spool keeps the records that an output couldn't send in a log of segment files on disk, to send them once
+// the destination can be reached again.
+// Each segment holds the records of one batch, and is checksummed so that a segment damaged by a crash is detected
+// when the spool is drained.
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/paths"
+	"github.com/s12v/awsbeats/metrics"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentSuffix = ".seg"
+	tmpSuffix     = ".tmp"
+)
+
+// ErrFull means that a batch doesn't fit in the spool without exceeding its max size.
+var ErrFull = errors.New("spool is full")
+
+// Record is a record as it is sent to the destination.
+type Record struct {
+	PartitionKey string
+	Data         []byte
+}
+
+// SendFunc sends records to the destination, and returns those that failed.
+type SendFunc func(records []Record) ([]Record, error)
+
+// Spool is a log of segments, appended to by every worker of an output and drained oldest first.
+type Spool struct {
+	dir           string
+	maxSize       int64
+	retryInterval time.Duration
+	metrics       *metrics.Metrics
+	now           func() time.Time
+
+	mu        sync.Mutex
+	segments  []segment
+	size      int64
+	next      uint64
+	nextDrain time.Time
+	users     int
+	lock      *os.File
+
+	// Held while draining, so that segments are sent one at a time in order
+	draining chan struct{}
+}
+
+type segment struct {
+	id   uint64
+	size int64
+}
+
+// Open opens the spool of the given output, creating its directory if needed. Segments left by a previous run are
+// kept, to be drained first.
+// The directory is locked until the spool is closed by the caller and every user acquired since, so that two beats
+// can't share a spool.
+func Open(config Config, output string, m *metrics.Metrics) (*Spool, error) {
+	dir := config.Path
+	if dir == "" {
+		dir = filepath.Join("spool", output)
+	}
+	dir = paths.Resolve(paths.Data, dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %v", err)
+	}
+
+	s := &Spool{
+		dir:           dir,
+		maxSize:       int64(config.MaxSize),
+		retryInterval: config.RetryInterval,
+		metrics:       m,
+		now:           time.Now,
+		draining:      make(chan struct{}, 1),
+	}
+	if err := s.Acquire(); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if len(s.segments) > 0 {
+		logp.NewLogger("spool").Infof("spool %s holds %d segments (%d bytes) to be sent", dir, len(s.segments), s.size)
+	}
+	s.observe()
+	return s, nil
+}
+
+// Acquire keeps the spool open for one more user, locking its directory again if the spool had been closed.
+func (s *Spool) Acquire() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users == 0 {
+		lock, err := lockDir(s.dir)
+		if err != nil {
+			return err
+		}
+		s.lock = lock
+	}
+	s.users++
+	return nil
+}
+
+// Close releases the spool for one of its users, and unlocks its directory once none is left.
+func (s *Spool) Close() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users == 0 {
+		return nil
+	}
+	s.users--
+	if s.users > 0 {
+		return nil
+	}
+	lock := s.lock
+	s.lock = nil
+	return unlockDir(lock)
+}
+
+func (s *Spool) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read spool directory: %v", err)
+	}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasSuffix(name, tmpSuffix) {
+			// Left by a crash while writing, the batch was never ACKed
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, segment{id: id, size: f.Size()})
+		s.size += f.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+	if n := len(s.segments); n > 0 {
+		s.next = s.segments[n-1].id + 1
+	}
+	return nil
+}
+
+func (s *Spool) path(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// Empty tells whether all spooled records have been sent.
+func (s *Spool) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.segments) == 0
+}
+
+// Append writes the records as a new segment at the end of the spool. It fails with ErrFull rather than exceeding the
+// max size of the spool.
+func (s *Spool) Append(records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size+encodedSize(records) > s.maxSize {
+		return ErrFull
+	}
+	id := s.next
+	size, err := writeSegment(s.path(id), records)
+	if err != nil {
+		return fmt.Errorf("failed to write spool segment: %v", err)
+	}
+	s.next++
+	if len(s.segments) == 0 {
+		// Records are spooled because the destination just failed, give it some time before sending them again
+		s.nextDrain = s.now().Add(s.retryInterval)
+	}
+	s.segments = append(s.segments, segment{id: id, size: size})
+	s.size += size
+	s.metrics.SpooledRecords(len(records))
+	s.observe()
+	return nil
+}
+
+// Drain sends the spooled segments oldest first, until the spool is empty or a segment can't be sent in full.
+// The records of a segment that failed are kept at the head of the spool, and draining is only attempted again after
+// the retry interval. Drain returns right away when another worker is already draining.
+func (s *Spool) Drain(send SendFunc) error {
+	select {
+	case s.draining <- struct{}{}:
+		defer func() { <-s.draining }()
+	default:
+		return nil
+	}
+
+	s.mu.Lock()
+	if s.now().Before(s.nextDrain) {
+		s.mu.Unlock()
+		return nil
+	}
+	s.mu.Unlock()
+
+	for {
+		s.mu.Lock()
+		if len(s.segments) == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		head := s.segments[0]
+		s.mu.Unlock()
+
+		records, err := readSegment(s.path(head.id))
+		if err != nil {
+			logp.NewLogger("spool").Errorf("dropping spool segment %s: %v", s.path(head.id), err)
+			s.metrics.CorruptedSegment()
+			s.remove(head)
+			continue
+		}
+
+		failed, err := send(records)
+		s.metrics.DrainedRecords(len(records) - len(failed))
+		if len(failed) == 0 {
+			s.remove(head)
+			continue
+		}
+
+		if len(failed) < len(records) {
+			if err := s.rewrite(head, failed); err != nil {
+				return err
+			}
+		}
+		s.mu.Lock()
+		s.nextDrain = s.now().Add(s.retryInterval)
+		s.mu.Unlock()
+		if err == nil {
+			err = fmt.Errorf("%d spooled records failed", len(failed))
+		}
+		return err
+	}
+}
+
+// remove deletes the head segment of the spool.
+func (s *Spool) remove(head segment) {
+	if err := os.Remove(s.path(head.id)); err != nil && !os.IsNotExist(err) {
+		logp.NewLogger("spool").Errorf("failed to remove spool segment: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.segments = s.segments[1:]
+	s.size -= head.size
+	s.observe()
+}
+
+// rewrite replaces the records of the head segment with those that are still to be sent.
+func (s *Spool) rewrite(head segment, records []Record) error {
+	size, err := writeSegment(s.path(head.id), records)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite spool segment: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.segments[0].size = size
+	s.size += size - head.size
+	s.observe()
+	return nil
+}
+
+func (s *Spool) observe() {
+	s.metrics.Spool(len(s.segments), s.size)
+}
+
+func encodedSize(records []Record) int64 {
+	size := int64(len(segmentMagic) + 8)
+	for _, record := range records {
+		size += int64(8 + len(record.PartitionKey) + len(record.Data))
+	}
+	return size
+}
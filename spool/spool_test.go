@@ -0,0 +1,212 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openTestSpool(t *testing.T, dir string, maxSize int64) *Spool {
+	s, err := Open(Config{Enabled: true, Path: dir, MaxSize: 1 << 20, RetryInterval: time.Minute}, "test", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.maxSize = maxSize
+	return s
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func records(data ...string) []Record {
+	records := make([]Record, len(data))
+	for i, d := range data {
+		records[i] = Record{PartitionKey: "key-" + d, Data: []byte(d)}
+	}
+	return records
+}
+
+func TestSegmentRoundTrip(t *testing.T) {
+	in := append(records("a", "bb"), Record{})
+	out, err := decodeSegment(encodeSegment(in))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(out) != 3 || out[1].PartitionKey != "key-bb" || string(out[1].Data) != "bb" || len(out[2].Data) != 0 {
+		t.Errorf("unexpected records: %v", out)
+	}
+
+	b := encodeSegment(in)
+	b[len(segmentMagic)+6] ^= 1
+	if _, err := decodeSegment(b); err != errCorrupt {
+		t.Errorf("expected a corrupt segment, got %v", err)
+	}
+	if _, err := decodeSegment(encodeSegment(in)[:20]); err != errCorrupt {
+		t.Errorf("expected a truncated segment to be corrupt, got %v", err)
+	}
+}
+
+func TestDrainInOrderAcrossRestarts(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openTestSpool(t, dir, 1<<20)
+	for _, batch := range [][]Record{records("a", "b"), records("c"), records("d")} {
+		if err := s.Append(batch); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// A new spool picks up where the previous one stopped
+	s.Close()
+	s = openTestSpool(t, dir, 1<<20)
+	if s.Empty() || len(s.segments) != 3 || s.next != 3 {
+		t.Fatalf("unexpected segments after reopening: %v", s.segments)
+	}
+	var sent []string
+	err := s.Drain(func(records []Record) ([]Record, error) {
+		for _, r := range records {
+			sent = append(sent, string(r.Data))
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(sent, []string{"a", "b", "c", "d"}) {
+		t.Errorf("unexpected records sent: %v", sent)
+	}
+	if !s.Empty() || s.size != 0 {
+		t.Errorf("expected an empty spool, got %d segments of %d bytes", len(s.segments), s.size)
+	}
+	s.Close()
+	// The lock file stays
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix)); len(files) != 0 {
+		t.Errorf("expected no segment files left, got %d", len(files))
+	}
+}
+
+func TestDrainKeepsFailedRecords(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(1000, 0)
+	s := openTestSpool(t, dir, 1<<20)
+	s.now = func() time.Time { return now }
+	s.Append(records("a", "b", "c"))
+	s.Append(records("d"))
+
+	// Records just spooled aren't sent before the retry interval
+	calls := 0
+	send := func(records []Record) ([]Record, error) {
+		calls++
+		return records[1:2], nil
+	}
+	s.Drain(send)
+	if calls != 0 {
+		t.Fatalf("expected no attempt within the retry interval")
+	}
+
+	now = now.Add(time.Minute)
+	if err := s.Drain(send); err == nil {
+		t.Errorf("expected an error for a partially sent segment")
+	}
+	if calls != 1 || len(s.segments) != 2 {
+		t.Fatalf("unexpected state: %d calls, %d segments", calls, len(s.segments))
+	}
+	if left, _ := readSegment(s.path(s.segments[0].id)); len(left) != 1 || string(left[0].Data) != "b" {
+		t.Errorf("unexpected records left in the head segment: %v", left)
+	}
+
+	now = now.Add(time.Minute)
+	err := s.Drain(func(records []Record) ([]Record, error) {
+		return records, errors.New("unreachable")
+	})
+	if err == nil || err.Error() != "unreachable" || len(s.segments) != 2 {
+		t.Errorf("unexpected result: %v, %d segments", err, len(s.segments))
+	}
+}
+
+func TestDrainDropsCorruptSegments(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openTestSpool(t, dir, 1<<20)
+	s.Append(records("a"))
+	s.Append(records("b"))
+	ioutil.WriteFile(s.path(0), []byte("AWSBSPL1 torn write"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "00000000000000000002.seg.tmp"), []byte("torn"), 0600)
+
+	s.Close()
+	s = openTestSpool(t, dir, 1<<20)
+	if _, err := os.Stat(filepath.Join(dir, "00000000000000000002.seg.tmp")); !os.IsNotExist(err) {
+		t.Errorf("expected temporary files to be removed")
+	}
+	var sent []string
+	s.Drain(func(records []Record) ([]Record, error) {
+		sent = append(sent, string(records[0].Data))
+		return nil, nil
+	})
+	if !reflect.DeepEqual(sent, []string{"b"}) || !s.Empty() {
+		t.Errorf("unexpected records sent: %v", sent)
+	}
+}
+
+func TestAppendToFullSpool(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openTestSpool(t, dir, encodedSize(records("a"))*2)
+	if err := s.Append(records("a")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Append(records("b", "c")); err != ErrFull {
+		t.Errorf("expected the spool to be full, got %v", err)
+	}
+	if err := s.Append(records("d")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openTestSpool(t, dir, 1<<20)
+	if _, err := Open(Config{Path: dir}, "test", nil); err == nil {
+		t.Fatalf("expected a spool in use not to be opened")
+	}
+
+	// Locked as long as a user is left
+	if err := s.Acquire(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s.Close()
+	if _, err := Open(Config{Path: dir}, "test", nil); err == nil {
+		t.Fatalf("expected a spool in use not to be opened")
+	}
+	s.Close()
+	s.Close()
+	s = openTestSpool(t, dir, 1<<20)
+	s.Close()
+
+	// A lock file left by a crash is taken over, even if it holds the pid of this process, as after a container restart
+	for _, content := range []string{"not a pid\n", fmt.Sprintf("%d\n", os.Getpid()), "1\n"} {
+		ioutil.WriteFile(filepath.Join(dir, lockFile), []byte(content), 0600)
+		s = openTestSpool(t, dir, 1<<20)
+		if pid := lockOwner(filepath.Join(dir, lockFile)); pid != os.Getpid() {
+			t.Errorf("expected the lock to be taken over, got pid %d", pid)
+		}
+		s.Close()
+	}
+}
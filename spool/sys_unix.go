@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+package spool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// lockDir takes an exclusive flock on the lock file of a spool directory, and writes the pid of the process to it for
+// information. The lock goes away with the process, so a lock file left by a crash, or by a previous run with the same
+// pid in a restarted container, doesn't keep the spool locked.
+func lockDir(dir string) (*os.File, error) {
+	path := filepath.Join(dir, lockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool lock: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("spool %s is in use by process %d", dir, lockOwner(path))
+		}
+		return nil, fmt.Errorf("failed to lock spool: %v", err)
+	}
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to write spool lock: %v", err)
+	}
+	return f, nil
+}
+
+// syncDir flushes a directory, so that the files created or renamed in it survive a crash of the host.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+package spool
+
+import "os"
+
+func lockDir(dir string) (*os.File, error) {
+	return nil, errUnsupported
+}
+
+func syncDir(dir string) error {
+	return errUnsupported
+}
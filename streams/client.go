@@ -11,37 +11,108 @@ import (
 	"github.com/elastic/beats/libbeat/outputs/codec"
 	"github.com/elastic/beats/libbeat/outputs/codec/json"
 	"github.com/elastic/beats/libbeat/publisher"
+	"github.com/s12v/awsbeats/awsconfig"
+	"github.com/s12v/awsbeats/awsmetadata"
+	"github.com/s12v/awsbeats/bufpool"
+	"github.com/s12v/awsbeats/dedup"
+	"github.com/s12v/awsbeats/eventcache"
+	"github.com/s12v/awsbeats/eventfilter"
+	"github.com/s12v/awsbeats/metrics"
+	"github.com/s12v/awsbeats/schema"
+	"github.com/s12v/awsbeats/spool"
 	"time"
 )
 
+const (
+	// As per https://docs.aws.amazon.com/streams/latest/dev/service-sizes-and-limits.html
+	maxRecordsPerShardPerSecond = 1000
+)
+
 type client struct {
-	streams              kinesisStreamsClient
+	streams              API
 	streamName           string
+	streamARN            string
+	streamByARN          bool
+	region               string
 	partitionKeyProvider PartitionKeyProvider
 	beatName             string
 	encoder              codec.Codec
 	timeout              time.Duration
 	observer             outputs.Observer
+	rateLimit            int
+	limiter              *rateLimiter
+	describeInterval     time.Duration
+	describeAttemptedAt  time.Time
+	stream               *streamInfo
+	ordered              bool
+	sequenceNumbers      *sequenceNumbers
+	metrics              *metrics.Metrics
+	spool                *spool.Spool
+	spoolAcquired        bool
+	cache                *eventcache.Cache
+	filter               *eventfilter.Filter
+	metadata             *awsmetadata.Stamper
+	addEventID           bool
+	schema               *schema.Codec
+	schemaAcquired       bool
+	// Of the batch being published, if it keeps track of the events that are dropped
+	drops metrics.DropObserver
 }
 
-type kinesisStreamsClient interface {
+// API is the part of the Kinesis Data Streams API the output calls, implemented by *kinesis.Kinesis and wrapped by
+// middlewares.
+type API interface {
 	PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
+	PutRecord(input *kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error)
+	DescribeStreamSummary(input *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error)
+}
+
+// streamInfo is what DescribeStreamSummary told us about the destination stream.
+type streamInfo struct {
+	status         string
+	mode           string
+	openShards     int64
+	encryption     string
+	retentionHours int64
+	describedAt    time.Time
 }
 
 func newClient(sess *session.Session, config *StreamsConfig, observer outputs.Observer, beat beat.Info) (*client, error) {
 	partitionKeyProvider := createPartitionKeyProvider(config)
+	streamName := config.DeliveryStreamName
+	if config.StreamARN != "" {
+		// Validated along with the config
+		arn, _ := awsconfig.ParseResourceARN(config.StreamARN, "kinesis", "stream")
+		streamName = arn.Name
+	}
 	client := &client{
-		streams:              kinesis.New(sess),
-		streamName:           config.DeliveryStreamName,
+		streams:              wrap(kinesis.New(sess)),
+		streamName:           streamName,
+		streamARN:            config.StreamARN,
+		streamByARN:          config.StreamARN != "",
+		region:               aws.StringValue(sess.Config.Region),
 		partitionKeyProvider: partitionKeyProvider,
 		beatName:             beat.Beat,
 		encoder: json.New(beat.Version, json.Config{
 			Pretty:     false,
 			EscapeHTML: false,
 		}),
-		timeout:  config.Timeout,
-		observer: observer,
+		timeout:          config.Timeout,
+		observer:         observer,
+		rateLimit:        config.RateLimit,
+		limiter:          newRateLimiter(float64(config.RateLimit)),
+		describeInterval: config.DescribeInterval,
+		ordered:          config.Ordered,
+		sequenceNumbers:  newSequenceNumbers(),
+		metrics:          metrics.Get("streams"),
 	}
+	filter, err := eventfilter.New(config.Filter)
+	if err != nil {
+		return nil, err
+	}
+	client.filter = filter
+	client.addEventID = config.AddEventID
+	client.metadata = awsmetadata.New(config.AWSMetadata, client.streamName, client.region)
 
 	return client, nil
 }
@@ -50,7 +121,10 @@ func createPartitionKeyProvider(config *StreamsConfig) PartitionKeyProvider {
 	if config.PartitionKeyProvider == "xid" {
 		return newXidPartitionKeyProvider()
 	} else {
-		return newFieldPartitionKeyProvider(config.PartitionKey)
+		provider := newFieldPartitionKeyProvider(config.PartitionKey)
+		provider.fallback = config.PartitionKeyFallback == "xid"
+		provider.metrics = metrics.Get("streams")
+		return provider
 	}
 }
 
@@ -59,16 +133,166 @@ func (client client) String() string {
 }
 
 func (client *client) Close() error {
-	return nil
+	err := client.releaseSpool()
+	if serr := client.releaseSchema(); err == nil {
+		err = serr
+	}
+	return err
 }
 
 func (client *client) Connect() error {
+	if err := client.acquireSpool(); err != nil {
+		return err
+	}
+	client.acquireSchema()
+	if err := client.schema.Resolve(); err != nil {
+		return err
+	}
+	err := client.describeStream()
+	if _, ok := err.(*unavailableError); err != nil && !ok && client.spool != nil {
+		// Events are spooled until the stream can be reached
+		logp.NewLogger("streams").Warnf("spooling events until the stream can be described: %v", err)
+		return nil
+	}
+	return err
+}
+
+// acquireSchema keeps the schema codec, and its dead letter file, open while the client is connected.
+func (client *client) acquireSchema() {
+	if client.schemaAcquired {
+		return
+	}
+	client.schema.Acquire()
+	client.schemaAcquired = true
+}
+
+func (client *client) releaseSchema() error {
+	if !client.schemaAcquired {
+		return nil
+	}
+	client.schemaAcquired = false
+	return client.schema.Close()
+}
+
+// describeStream fetches the stream summary, fails unless the stream is ready to receive records, and adjusts the
+// rate limit to the stream's capacity.
+func (client *client) describeStream() error {
+	client.describeAttemptedAt = time.Now()
+	name, arn := client.streamID()
+	res, err := client.streams.DescribeStreamSummary(&kinesis.DescribeStreamSummaryInput{
+		StreamName: name,
+		StreamARN:  arn,
+	})
+	if err != nil {
+		if err, ok := client.apiError("DescribeStreamSummary", err).(*unavailableError); ok {
+			return err
+		}
+		return fmt.Errorf("failed to describe stream %s: %v", client.streamName, err)
+	}
+
+	summary := res.StreamDescriptionSummary
+	info := &streamInfo{
+		status:         aws.StringValue(summary.StreamStatus),
+		mode:           kinesis.StreamModeProvisioned,
+		openShards:     aws.Int64Value(summary.OpenShardCount),
+		encryption:     aws.StringValue(summary.EncryptionType),
+		retentionHours: aws.Int64Value(summary.RetentionPeriodHours),
+		describedAt:    time.Now(),
+	}
+	if summary.StreamModeDetails != nil {
+		info.mode = aws.StringValue(summary.StreamModeDetails.StreamMode)
+	}
+	switch info.status {
+	case kinesis.StreamStatusActive, kinesis.StreamStatusUpdating:
+	case kinesis.StreamStatusCreating:
+		return fmt.Errorf("stream %s is still being created", client.streamName)
+	case kinesis.StreamStatusDeleting:
+		return fmt.Errorf("stream %s is being deleted", client.streamName)
+	default:
+		return fmt.Errorf("stream %s is in unexpected status %s", client.streamName, info.status)
+	}
+	if !client.streamByARN {
+		client.streamARN = aws.StringValue(summary.StreamARN)
+	}
+
+	if client.stream != nil && client.stream.mode != info.mode {
+		logp.NewLogger("streams").Infof("stream %s switched from %s to %s mode", client.streamName, client.stream.mode, info.mode)
+	}
+	client.stream = info
+	client.limiter.setRate(client.recordsPerSecond())
+
+	logp.NewLogger("streams").Infof(
+		"stream %s: status=%s mode=%s open_shards=%d encryption=%s retention=%dh rate_limit=%.0f/s",
+		client.streamName, info.status, info.mode, info.openShards, info.encryption, info.retentionHours, client.limiter.getRate(),
+	)
 	return nil
 }
 
+// streamID returns the name and ARN to address the stream with in requests. A stream configured by its ARN is only
+// addressed by it, which is how streams of other accounts are written to.
+func (client *client) streamID() (name *string, arn *string) {
+	if client.streamByARN {
+		return nil, aws.String(client.streamARN)
+	}
+	return aws.String(client.streamName), nil
+}
+
+// recordsPerSecond is the rate the output is allowed to send at.
+// An explicit `rate_limit` wins. Otherwise provisioned streams are limited to what their open shards accept, while
+// on-demand streams scale on their own and aren't limited at all.
+// Parallelism isn't derived from the mode, as libbeat fixes the workers and batch size of the output when creating it,
+// before the stream is described.
+func (client *client) recordsPerSecond() float64 {
+	if client.rateLimit > 0 {
+		return float64(client.rateLimit)
+	}
+	if client.stream == nil || client.stream.mode == kinesis.StreamModeOnDemand {
+		return 0
+	}
+	return float64(client.stream.openShards * maxRecordsPerShardPerSecond)
+}
+
+// refreshStream re-describes the stream once the last summary is older than `describe_interval`, so that mode and
+// resharding changes are picked up without a restart.
+// A stream that couldn't be described on connect, which only happens with a spool, is described again at the same
+// interval until it succeeds.
+func (client *client) refreshStream() {
+	interval := client.describeInterval
+	if client.stream != nil {
+		if interval <= 0 || time.Since(client.stream.describedAt) < interval {
+			return
+		}
+	} else {
+		if client.spool == nil {
+			return
+		}
+		if interval <= 0 {
+			interval = defaultConfig.DescribeInterval
+		}
+		if time.Since(client.describeAttemptedAt) < interval {
+			return
+		}
+	}
+	if err := client.describeStream(); err != nil {
+		logp.NewLogger("streams").Warnf("failed to refresh stream summary: %v", err)
+	}
+}
+
 func (client *client) Publish(batch publisher.Batch) error {
+	client.refreshStream()
 	events := batch.Events()
-	rest, _ := client.publishEvents(events)
+	client.drops, _ = batch.(metrics.DropObserver)
+	defer func() { client.drops = nil }()
+	var rest []publisher.Event
+	var err error
+	if client.ordered {
+		rest, err = client.publishEventsOrdered(events)
+	} else if client.spool != nil {
+		rest, err = client.publishEventsSpooled(events)
+	} else {
+		rest, err = client.publishEvents(events)
+	}
+	client.cache.Release(events, rest)
 	if len(rest) == 0 {
 		// We have to ACK only when all the submission succeeded
 		// Ref: https://github.com/elastic/beats/blob/c4af03c51373c1de7daaca660f5d21b3f602771c/libbeat/outputs/elasticsearch/client.go#L232
@@ -78,100 +302,185 @@ func (client *client) Publish(batch publisher.Batch) error {
 		// Ref: https://github.com/elastic/beats/blob/c4af03c51373c1de7daaca660f5d21b3f602771c/libbeat/outputs/elasticsearch/client.go#L234
 		batch.RetryEvents(rest)
 	}
+	if _, ok := err.(*unavailableError); ok {
+		// Go back to connecting, which waits with backoff until the stream is usable again
+		return err
+	}
 	// This shouldn't be an error object according to other official beats' implementations
 	// Ref: https://github.com/elastic/beats/blob/c4af03c51373c1de7daaca660f5d21b3f602771c/libbeat/outputs/kafka/client.go#L119
 	return nil
 }
 
 func (client *client) publishEvents(events []publisher.Event) ([]publisher.Event, error) {
-	observer := client.observer
-	observer.NewBatch(len(events))
+	client.observer.NewBatch(len(events))
 
 	logp.Debug("kinesis", "received events: %v", events)
-	okEvents, records, dropped := client.mapEvents(events)
-	if dropped > 0 {
-		logp.Debug("kinesis", "sent %d records: %v", len(records), records)
-		observer.Dropped(dropped)
-		observer.Acked(len(okEvents))
-	}
+	records, carried, dropped := client.mapEvents(events)
 	logp.Debug("kinesis", "mapped to records: %v", records)
+	return client.publishRecords(records, carried, dropped)
+}
+
+// failEvents retries all the events of a batch that can't be sent at all.
+func (client *client) failEvents(events []publisher.Event, err error) []publisher.Event {
+	client.observer.NewBatch(len(events))
+	metrics.Outcome{Failed: len(events), Err: err}.Report(client.observer, client.metrics)
+	return events
+}
+
+func (client *client) publishRecords(records []*kinesis.PutRecordsRequestEntry, carried recordEvents, dropped int) ([]publisher.Event, error) {
+	outcome := metrics.Outcome{Dropped: dropped}
+	if len(records) == 0 {
+		outcome.Report(client.observer, client.metrics)
+		return []publisher.Event{}, nil
+	}
+
 	res, err := client.putKinesisRecords(records)
-	failed := collectFailedEvents(res, events)
+	failed := collectFailedEvents(res, carried)
+	outcome.Throttled = countThrottled(res, carried)
+	spooled := 0
 	if err != nil && len(failed) == 0 {
-		failed = events
+		failed = carried.all()
+		if isThrottled(errorCode(err)) {
+			outcome.Throttled = len(failed)
+		}
+		if _, ok := err.(*unavailableError); !ok {
+			err = fmt.Errorf("failed to put records: %v", err)
+			if client.spool != nil && client.spoolRecords(records) {
+				// Sent later on, and only acked then
+				spooled, failed = len(failed), nil
+				outcome.Throttled = 0
+			}
+		}
+		outcome.Err = err
 	}
+	outcome.Acked = carried.count() - len(failed) - spooled
+	outcome.Failed = len(failed)
+	outcome.Bytes = recordsSize(records)
+	outcome.Report(client.observer, client.metrics)
 	if len(failed) > 0 {
 		logp.Info("retrying %d events on error: %v", len(failed), err)
 	}
 	return failed, err
 }
 
-func (client *client) mapEvents(events []publisher.Event) ([]publisher.Event, []*kinesis.PutRecordsRequestEntry, int) {
+// dropped tells the batch being published that one of its events is dropped.
+func (client *client) dropped(event *publisher.Event) {
+	if client.drops != nil {
+		client.drops.DroppedEvent(event)
+	}
+}
+
+// mapEvents turns the events into records, along with the events each record carries. Events that can't be mapped are
+// dropped.
+func (client *client) mapEvents(events []publisher.Event) ([]*kinesis.PutRecordsRequestEntry, recordEvents, int) {
 	dropped := 0
 	records := make([]*kinesis.PutRecordsRequestEntry, 0, len(events))
-	okEvents := make([]publisher.Event, 0, len(events))
+	carried := make(recordEvents, 0, len(events))
+	meta := client.metadata.Batch()
 	for i := range events {
-		event := events[i]
-		record, err := client.mapEvent(&event)
+		if !client.filter.Match(&events[i].Content) {
+			// Acked as dropped, without being sent
+			client.metrics.FilteredEvent()
+			client.dropped(&events[i])
+			dropped++
+			continue
+		}
+		if client.addEventID {
+			// Encoded into the record, which retries reuse, along with the metadata it's kept in
+			dedup.EnsureID(&events[i].Content)
+		}
+		record, err := client.mapEvent(&events[i], meta)
 		if err != nil {
-			logp.Debug("kinesis", "failed to map event(%v): %v", event, err)
+			logp.Debug("kinesis", "failed to map event(%v): %v", events[i], err)
+			client.dropped(&events[i])
 			dropped++
 		} else {
-			okEvents = append(okEvents, event)
 			records = append(records, record)
+			// Sliced rather than copied, capped so that it can't be appended to
+			carried = append(carried, events[i:i+1:i+1])
 		}
 	}
-	return okEvents, records, dropped
+	return records, carried, dropped
 }
 
-func (client *client) mapEvent(event *publisher.Event) (*kinesis.PutRecordsRequestEntry, error) {
-	var buf []byte
+func (client *client) mapEvent(event *publisher.Event, meta *awsmetadata.Batch) (*kinesis.PutRecordsRequestEntry, error) {
+	if record, ok := client.cache.Get(&event.Content); ok {
+		// Retried events are sent as they were the first time, to the same shard
+		return &kinesis.PutRecordsRequestEntry{Data: meta.Stamp(record.Data, record.Attempt), PartitionKey: aws.String(record.PartitionKey)}, nil
+	}
+
+	var buf *bufpool.Buffer
 	{
-		serializedEvent, err := client.encoder.Encode(client.beatName, &event.Content)
+		serializedEvent, err := client.encoder.Encode(client.beatName, client.filter.Fields(&event.Content))
 		if err != nil {
 			logp.Critical("Unable to encode event: %v", err)
 			return nil, err
 		}
+		// Binary records of a schema aren't delimited
+		delimited := client.schema == nil
+		size := len(serializedEvent)
+		if delimited {
+			size++
+		}
 		// See https://github.com/elastic/beats/blob/5a6630a8bc9b9caf312978f57d1d9193bdab1ac7/libbeat/outputs/kafka/client.go#L163-L164
 		// You need to copy the byte data like this. Otherwise you see strange issues like all the records sent in a same batch has the same Data.
-		buf = make([]byte, len(serializedEvent)+1)
-		copy(buf, serializedEvent)
+		buf = bufpool.Get(size)
+		copy(buf.B, serializedEvent)
 		// Firehose doesn't automatically add trailing new-line on after each record.
 		// This ends up a stream->firehose->s3 pipeline to produce useless s3 objects.
 		// No ndjson, but a sequence of json objects without separators...
 		// Fix it just adding a new-line.
 		//
 		// See https://stackoverflow.com/questions/43010117/writing-properly-formatted-json-to-s3-to-load-in-athena-redshift
-		buf[len(buf)-1] = byte('\n')
+		if delimited {
+			buf.B[len(buf.B)-1] = byte('\n')
+		}
 	}
 
 	partitionKey, err := client.partitionKeyProvider.PartitionKeyFor(event)
 	if err != nil {
+		buf.Release()
+		client.metrics.PartitionKeyFailure()
 		return nil, fmt.Errorf("failed to get parititon key: %v", err)
 	}
 
-	return &kinesis.PutRecordsRequestEntry{Data: buf, PartitionKey: aws.String(partitionKey)}, nil
+	client.cache.Put(&event.Content, eventcache.Record{PartitionKey: partitionKey, Data: buf.B}, buf)
+	return &kinesis.PutRecordsRequestEntry{Data: meta.Stamp(buf.B, 1), PartitionKey: aws.String(partitionKey)}, nil
 }
 func (client *client) putKinesisRecords(records []*kinesis.PutRecordsRequestEntry) (*kinesis.PutRecordsOutput, error) {
+	client.limiter.wait(len(records))
+	name, arn := client.streamID()
 	request := kinesis.PutRecordsInput{
-		StreamName: &client.streamName,
+		StreamName: name,
+		StreamARN:  arn,
 		Records:    records,
 	}
+	start := time.Now()
 	res, err := client.streams.PutRecords(&request)
+	client.observeRequest(time.Since(start), records, err)
 	if err != nil {
-		return res, fmt.Errorf("failed to put records: %v", err)
+		return res, client.apiError("PutRecords", err)
 	}
+	client.observeFailedEntries(res)
 	return res, nil
 }
 
-func collectFailedEvents(res *kinesis.PutRecordsOutput, events []publisher.Event) []publisher.Event {
-	if res.FailedRecordCount != nil && *res.FailedRecordCount > 0 {
+// collectFailedEvents returns the events carried by the records that PutRecords failed to put.
+// Entries of the response are matched to records by their index in the request.
+func collectFailedEvents(res *kinesis.PutRecordsOutput, carried recordEvents) []publisher.Event {
+	if res != nil && res.FailedRecordCount != nil && *res.FailedRecordCount > 0 {
 		failedEvents := make([]publisher.Event, 0)
 		records := res.Records
+		if len(records) != len(carried) {
+			logp.NewLogger("streams").Warnf("kinesis returned %d entries for %d records", len(records), len(carried))
+		}
 		for i, r := range records {
+			if i >= len(carried) {
+				break
+			}
 			if r == nil {
 				// See https://github.com/s12v/awsbeats/issues/27 for more info
-				logp.NewLogger("streams").Warn("no record returned from kinesis for event: ", events[i])
+				logp.NewLogger("streams").Warn("no record returned from kinesis for events: ", carried[i])
 				continue
 			}
 			if r.ErrorCode == nil {
@@ -179,7 +488,7 @@ func collectFailedEvents(res *kinesis.PutRecordsOutput, events []publisher.Event
 				continue
 			}
 			if *r.ErrorCode != "" {
-				failedEvents = append(failedEvents, events[i])
+				failedEvents = append(failedEvents, carried[i]...)
 			}
 		}
 		logp.Warn("Retrying %d events", len(failedEvents))
@@ -187,3 +496,26 @@ func collectFailedEvents(res *kinesis.PutRecordsOutput, events []publisher.Event
 	}
 	return []publisher.Event{}
 }
+
+// recordEvents holds the events carried by each record of a request, at the index of the record.
+// Responses refer to records by their index in the request, which only matches the index of the original events as long
+// as each event makes exactly one record.
+type recordEvents [][]publisher.Event
+
+// all returns the events carried by all the records, in order.
+func (r recordEvents) all() []publisher.Event {
+	events := make([]publisher.Event, 0, r.count())
+	for _, carried := range r {
+		events = append(events, carried...)
+	}
+	return events
+}
+
+// count returns the number of events carried by all the records.
+func (r recordEvents) count() int {
+	n := 0
+	for _, carried := range r {
+		n += len(carried)
+	}
+	return n
+}
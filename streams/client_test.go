@@ -3,12 +3,25 @@ package streams
 import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/elastic/beats/libbeat/beat"
 	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/conditions"
 	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/elastic/beats/libbeat/outputs/codec/json"
 	"github.com/elastic/beats/libbeat/publisher"
+	"github.com/s12v/awsbeats/awsconfig"
+	"github.com/s12v/awsbeats/awsmetadata"
+	"github.com/s12v/awsbeats/awstest"
+	"github.com/s12v/awsbeats/dedup"
+	"github.com/s12v/awsbeats/eventcache"
+	"github.com/s12v/awsbeats/eventfilter"
+	"github.com/s12v/awsbeats/schema"
+	"strings"
 	"testing"
+	"time"
 )
 
 type StubCodec struct {
@@ -21,14 +34,62 @@ func (c StubCodec) Encode(index string, event *beat.Event) ([]byte, error) {
 }
 
 type StubClient struct {
-	out *kinesis.PutRecordsOutput
-	err error
+	out         *kinesis.PutRecordsOutput
+	err         error
+	summary     *kinesis.DescribeStreamSummaryOutput
+	describeErr error
 }
 
 func (c StubClient) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
 	return c.out, c.err
 }
 
+func (c StubClient) PutRecord(input *kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error) {
+	return &kinesis.PutRecordOutput{SequenceNumber: aws.String("1")}, c.err
+}
+
+func (c StubClient) DescribeStreamSummary(input *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	return c.summary, c.describeErr
+}
+
+type stubBatch struct {
+	events  []publisher.Event
+	acked   bool
+	retried []publisher.Event
+}
+
+func (b *stubBatch) Events() []publisher.Event                { return b.events }
+func (b *stubBatch) ACK()                                     { b.acked = true }
+func (b *stubBatch) Drop()                                    {}
+func (b *stubBatch) Retry()                                   { b.retried = b.events }
+func (b *stubBatch) RetryEvents(events []publisher.Event)     { b.retried = events }
+func (b *stubBatch) Cancelled()                               {}
+func (b *stubBatch) CancelledEvents(events []publisher.Event) {}
+
+// countingObserver counts the events reported to the beat's observer.
+type countingObserver struct {
+	outputs.Observer
+	acked, failed, dropped, tooMany, bytes int
+}
+
+func (o *countingObserver) Acked(n int)      { o.acked += n }
+func (o *countingObserver) Failed(n int)     { o.failed += n }
+func (o *countingObserver) Dropped(n int)    { o.dropped += n }
+func (o *countingObserver) ErrTooMany(n int) { o.tooMany += n }
+func (o *countingObserver) WriteBytes(n int) { o.bytes += n }
+
+func streamSummary(status string, mode string, shards int64) *kinesis.DescribeStreamSummaryOutput {
+	return &kinesis.DescribeStreamSummaryOutput{
+		StreamDescriptionSummary: &kinesis.StreamDescriptionSummary{
+			StreamStatus:         aws.String(status),
+			StreamModeDetails:    &kinesis.StreamModeDetails{StreamMode: aws.String(mode)},
+			OpenShardCount:       aws.Int64(shards),
+			EncryptionType:       aws.String(kinesis.EncryptionTypeKms),
+			RetentionPeriodHours: aws.Int64(24),
+		},
+	}
+}
+
 func TestCreateXidPartitionKeyProvider(t *testing.T) {
 	fieldForPartitionKey := "mypartitionkey"
 	expectedPartitionKey := "foobar"
@@ -67,7 +128,7 @@ func TestMapEvent(t *testing.T) {
 	provider := newFieldPartitionKeyProvider(fieldForPartitionKey)
 	client := client{encoder: StubCodec{dat: []byte("boom")}, partitionKeyProvider: provider}
 	event := &publisher.Event{Content: beat.Event{Fields: common.MapStr{fieldForPartitionKey: expectedPartitionKey}}}
-	record, err := client.mapEvent(event)
+	record, err := client.mapEvent(event, nil)
 
 	if err != nil {
 		t.Fatalf("uenxpected error: %v", err)
@@ -91,14 +152,14 @@ func TestMapEvents(t *testing.T) {
 	client := client{encoder: StubCodec{dat: []byte("boom")}, partitionKeyProvider: provider}
 	event := publisher.Event{Content: beat.Event{Fields: common.MapStr{fieldForPartitionKey: expectedPartitionKey}}}
 	events := []publisher.Event{event}
-	okEvents, records, _ := client.mapEvents(events)
+	records, carried, _ := client.mapEvents(events)
 
 	if len(records) != 1 {
 		t.Errorf("Expected 1 records, got %v", len(records))
 	}
 
-	if len(okEvents) != 1 {
-		t.Errorf("Expected 1 ok events, got %v", len(okEvents))
+	if carried.count() != 1 {
+		t.Errorf("Expected 1 ok events, got %v", carried.count())
 	}
 
 	if string(records[0].Data) != "boom\n" {
@@ -106,6 +167,55 @@ func TestMapEvents(t *testing.T) {
 	}
 }
 
+func TestMapEventsWithEventID(t *testing.T) {
+	client := client{
+		encoder:              json.New("7.5.0", json.Config{}),
+		partitionKeyProvider: newXidPartitionKeyProvider(),
+		addEventID:           true,
+	}
+	events := []publisher.Event{
+		{Content: beat.Event{Fields: common.MapStr{"message": "a"}}},
+		{Content: beat.Event{Fields: common.MapStr{"message": "b"}, Meta: common.MapStr{"_id": "given"}}},
+	}
+
+	records, _, _ := client.mapEvents(events)
+	id, err := dedup.ID(records[0].Data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if given, _ := dedup.ID(records[1].Data); given != "given" {
+		t.Errorf("expected @metadata._id to be kept, got %q", given)
+	}
+
+	// Encoded again, as without a cache, the retried event keeps its ID
+	retried, _, _ := client.mapEvents(events[:1])
+	if again, _ := dedup.ID(retried[0].Data); again != id {
+		t.Errorf("expected the ID %q to be stable, got %q", id, again)
+	}
+}
+
+func TestMapEventsWithAWSMetadata(t *testing.T) {
+	client := client{
+		encoder:              StubCodec{dat: []byte(`{"message":"boom"}`)},
+		partitionKeyProvider: newXidPartitionKeyProvider(),
+		cache:                eventcache.New(nil),
+		metadata:             awsmetadata.New(awsmetadata.Config{Enabled: true, Field: "awsbeats"}, "foo", "eu-central-1"),
+	}
+	events := []publisher.Event{{Content: beat.Event{Fields: common.MapStr{"message": "boom"}}}}
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		records, _, _ := client.mapEvents(events)
+		data := string(records[0].Data)
+		if !strings.HasPrefix(data, `{"message":"boom","awsbeats":{"stream":"foo","region":"eu-central-1",`) ||
+			!strings.HasSuffix(data, fmt.Sprintf(`"attempt":%d}}`+"\n", attempt)) {
+			t.Errorf("unexpected record of attempt %d: %s", attempt, data)
+		}
+	}
+	if r, _ := client.cache.Get(&events[0].Content); string(r.Data) != `{"message":"boom"}`+"\n" {
+		t.Errorf("expected the cached record not to be stamped: %s", r.Data)
+	}
+}
+
 func TestPublishEvents(t *testing.T) {
 	fieldForPartitionKey := "mypartitionkey"
 	expectedPartitionKey := "foobar"
@@ -113,6 +223,7 @@ func TestPublishEvents(t *testing.T) {
 	client := client{
 		partitionKeyProvider: provider,
 		observer:             outputs.NewNilObserver(),
+		limiter:              newRateLimiter(0),
 	}
 	event := publisher.Event{Content: beat.Event{Fields: common.MapStr{fieldForPartitionKey: expectedPartitionKey}}}
 	events := []publisher.Event{event}
@@ -225,6 +336,336 @@ func TestPublishEvents(t *testing.T) {
 	}
 }
 
+func TestPublishEventsAccounting(t *testing.T) {
+	newClient := func(streams API) (*client, *countingObserver) {
+		observer := &countingObserver{Observer: outputs.NewNilObserver()}
+		return &client{
+			streams:              streams,
+			partitionKeyProvider: newFieldPartitionKeyProvider("key"),
+			encoder:              StubCodec{dat: []byte("boom")},
+			observer:             observer,
+			limiter:              newRateLimiter(0),
+		}, observer
+	}
+	events := []publisher.Event{
+		{Content: beat.Event{Fields: common.MapStr{"key": "a"}}},
+		{Content: beat.Event{Fields: common.MapStr{"key": "b"}}},
+		{Content: beat.Event{Fields: common.MapStr{"key": "c"}}},
+		{Content: beat.Event{Fields: common.MapStr{}}},
+	}
+
+	{
+		// Partial failure: one record throttled, one failed otherwise, the event without a key dropped
+		client, observer := newClient(StubClient{out: &kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{
+				{SequenceNumber: aws.String("1")},
+				{ErrorCode: aws.String(kinesis.ErrCodeProvisionedThroughputExceededException)},
+				{ErrorCode: aws.String("InternalFailure")},
+			},
+			FailedRecordCount: aws.Int64(2),
+		}})
+		rest, _ := client.publishEvents(events)
+		if len(rest) != 2 {
+			t.Errorf("unexpected number of remaining events: %d", len(rest))
+		}
+		expected := countingObserver{Observer: observer.Observer, acked: 1, failed: 2, dropped: 1, tooMany: 1, bytes: 3 * len("boom\na")}
+		if *observer != expected {
+			t.Errorf("unexpected observations: %+v", *observer)
+		}
+	}
+
+	{
+		// The whole request is throttled
+		client, observer := newClient(StubClient{err: awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "slow down", nil)})
+		rest, err := client.publishEvents(events)
+		if err == nil || len(rest) != 3 {
+			t.Errorf("unexpected result: %d events, %v", len(rest), err)
+		}
+		expected := countingObserver{Observer: observer.Observer, failed: 3, dropped: 1, tooMany: 3, bytes: 3 * len("boom\na")}
+		if *observer != expected {
+			t.Errorf("unexpected observations: %+v", *observer)
+		}
+	}
+
+	{
+		// Nothing is sent when every event is dropped
+		client, observer := newClient(StubClient{err: fmt.Errorf("unexpected request")})
+		rest, err := client.publishEvents(events[3:])
+		if err != nil || len(rest) != 0 {
+			t.Errorf("unexpected result: %d events, %v", len(rest), err)
+		}
+		expected := countingObserver{Observer: observer.Observer, dropped: 1}
+		if *observer != expected {
+			t.Errorf("unexpected observations: %+v", *observer)
+		}
+	}
+}
+
+func TestPublishEventsRetriesEventsOfFailedRecords(t *testing.T) {
+	client := client{
+		partitionKeyProvider: newFieldPartitionKeyProvider("key"),
+		encoder:              StubCodec{dat: []byte("boom")},
+		observer:             outputs.NewNilObserver(),
+		limiter:              newRateLimiter(0),
+		streams: StubClient{out: &kinesis.PutRecordsOutput{
+			Records: []*kinesis.PutRecordsResultEntry{
+				{SequenceNumber: aws.String("1")},
+				{ErrorCode: aws.String("InternalFailure")},
+			},
+			FailedRecordCount: aws.Int64(1),
+		}},
+	}
+	// The second event has no partition key, so the second record carries the third event
+	events := []publisher.Event{
+		{Content: beat.Event{Fields: common.MapStr{"key": "a"}}},
+		{Content: beat.Event{Fields: common.MapStr{}}},
+		{Content: beat.Event{Fields: common.MapStr{"key": "c"}}},
+	}
+	rest, err := client.publishEvents(events)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rest) != 1 || rest[0].Content.Fields["key"] != "c" {
+		t.Errorf("unexpected events to retry: %v", rest)
+	}
+}
+
+// throttlingClient throttles every record of the first PutRecords call, and records the partition keys of all calls.
+type throttlingClient struct {
+	StubClient
+	calls [][]string
+}
+
+func (c *throttlingClient) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	var keys []string
+	out := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for _, record := range input.Records {
+		keys = append(keys, aws.StringValue(record.PartitionKey))
+		entry := &kinesis.PutRecordsResultEntry{SequenceNumber: aws.String("1")}
+		if len(c.calls) == 0 {
+			entry = &kinesis.PutRecordsResultEntry{ErrorCode: aws.String(kinesis.ErrCodeProvisionedThroughputExceededException)}
+			*out.FailedRecordCount++
+		}
+		out.Records = append(out.Records, entry)
+	}
+	c.calls = append(c.calls, keys)
+	return out, nil
+}
+
+func TestRetriedEventsKeepTheirRecord(t *testing.T) {
+	streams := &throttlingClient{}
+	client := client{
+		streams:              streams,
+		partitionKeyProvider: newXidPartitionKeyProvider(),
+		encoder:              dataCodec{},
+		observer:             outputs.NewNilObserver(),
+		limiter:              newRateLimiter(0),
+		cache:                eventcache.New(nil),
+	}
+	batch := &stubBatch{events: []publisher.Event{orderedEvent("k", "a"), orderedEvent("k", "b")}}
+	client.Publish(batch)
+	if len(batch.retried) != 2 || client.cache.Len() != 2 {
+		t.Fatalf("expected both events to be retried and cached, got %d, %d", len(batch.retried), client.cache.Len())
+	}
+
+	retry := &stubBatch{events: batch.retried}
+	client.Publish(retry)
+	if !retry.acked || len(streams.calls) != 2 {
+		t.Fatalf("expected the retried events to be acked")
+	}
+	if fmt.Sprint(streams.calls[0]) != fmt.Sprint(streams.calls[1]) {
+		t.Errorf("expected the retried records to keep their partition keys, got %v", streams.calls)
+	}
+	if client.cache.Len() != 0 {
+		t.Errorf("expected acked events to be evicted, got %d", client.cache.Len())
+	}
+}
+
+func TestCollectFailedEvents(t *testing.T) {
+	a := publisher.Event{Content: beat.Event{Fields: common.MapStr{"n": 1}}}
+	b := publisher.Event{Content: beat.Event{Fields: common.MapStr{"n": 2}}}
+	c := publisher.Event{Content: beat.Event{Fields: common.MapStr{"n": 3}}}
+	res := &kinesis.PutRecordsOutput{
+		Records: []*kinesis.PutRecordsResultEntry{
+			{ErrorCode: aws.String("InternalFailure")},
+			{SequenceNumber: aws.String("1")},
+			{ErrorCode: aws.String("InternalFailure")},
+		},
+		FailedRecordCount: aws.Int64(2),
+	}
+
+	// A record carrying several events fails them all, and entries without a record are ignored
+	failed := collectFailedEvents(res, recordEvents{{a, b}, {c}})
+	if len(failed) != 2 || failed[0].Content.Fields["n"] != 1 || failed[1].Content.Fields["n"] != 2 {
+		t.Errorf("unexpected failed events: %v", failed)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	{
+		// Provisioned streams are limited to what their open shards accept
+		client := client{streamName: "foo", limiter: newRateLimiter(0)}
+		client.streams = StubClient{summary: streamSummary(kinesis.StreamStatusActive, kinesis.StreamModeProvisioned, 4)}
+		if err := client.Connect(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if client.stream.openShards != 4 || client.stream.mode != kinesis.StreamModeProvisioned {
+			t.Errorf("unexpected stream info: %+v", client.stream)
+		}
+		if rate := client.limiter.getRate(); rate != 4000 {
+			t.Errorf("unexpected rate limit: %v", rate)
+		}
+	}
+
+	{
+		// On-demand streams aren't limited
+		client := client{streamName: "foo", limiter: newRateLimiter(0)}
+		client.streams = StubClient{summary: streamSummary(kinesis.StreamStatusActive, kinesis.StreamModeOnDemand, 4)}
+		if err := client.Connect(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rate := client.limiter.getRate(); rate != 0 {
+			t.Errorf("unexpected rate limit: %v", rate)
+		}
+	}
+
+	{
+		// An explicit rate limit wins over the one derived from the stream
+		client := client{streamName: "foo", rateLimit: 100, limiter: newRateLimiter(100)}
+		client.streams = StubClient{summary: streamSummary(kinesis.StreamStatusActive, kinesis.StreamModeProvisioned, 4)}
+		if err := client.Connect(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rate := client.limiter.getRate(); rate != 100 {
+			t.Errorf("unexpected rate limit: %v", rate)
+		}
+	}
+
+	{
+		client := client{streamName: "foo", limiter: newRateLimiter(0)}
+		client.streams = StubClient{summary: streamSummary(kinesis.StreamStatusDeleting, kinesis.StreamModeProvisioned, 4)}
+		if err := client.Connect(); err == nil {
+			t.Errorf("expected an error for a deleting stream")
+		}
+	}
+
+	{
+		client := client{streamName: "foo", limiter: newRateLimiter(0)}
+		client.streams = StubClient{summary: streamSummary(kinesis.StreamStatusCreating, kinesis.StreamModeProvisioned, 4)}
+		if err := client.Connect(); err == nil {
+			t.Errorf("expected an error for a stream being created")
+		}
+	}
+
+	{
+		client := client{streamName: "foo", region: "eu-central-1", limiter: newRateLimiter(0)}
+		client.streams = StubClient{describeErr: awserr.New(kinesis.ErrCodeResourceNotFoundException, "Stream foo not found", nil)}
+		err := client.Connect()
+		if err == nil || err.Error() != "stream foo does not exist in region eu-central-1" {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+// addressRecordingClient records how requests address the stream.
+type addressRecordingClient struct {
+	StubClient
+	names, arns []string
+}
+
+func (c *addressRecordingClient) record(name, arn *string) {
+	c.names = append(c.names, aws.StringValue(name))
+	c.arns = append(c.arns, aws.StringValue(arn))
+}
+
+func (c *addressRecordingClient) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	c.record(input.StreamName, input.StreamARN)
+	return &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0), Records: []*kinesis.PutRecordsResultEntry{{}}}, nil
+}
+
+func (c *addressRecordingClient) PutRecord(input *kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error) {
+	c.record(input.StreamName, input.StreamARN)
+	return &kinesis.PutRecordOutput{SequenceNumber: aws.String("1")}, nil
+}
+
+func (c *addressRecordingClient) DescribeStreamSummary(input *kinesis.DescribeStreamSummaryInput) (*kinesis.DescribeStreamSummaryOutput, error) {
+	c.record(input.StreamName, input.StreamARN)
+	return streamSummary(kinesis.StreamStatusActive, kinesis.StreamModeOnDemand, 1), nil
+}
+
+func TestStreamAddressedByARN(t *testing.T) {
+	arn := "arn:aws:kinesis:eu-central-1:123456789012:stream/foo"
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("eu-central-1")}))
+	client, err := newClient(sess, &StreamsConfig{StreamARN: arn, PartitionKey: "key"}, outputs.NewNilObserver(), beat.Info{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.streamName != "foo" {
+		t.Errorf("unexpected stream name: %s", client.streamName)
+	}
+	streams := &addressRecordingClient{}
+	client.streams = streams
+	client.encoder = dataCodec{}
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client.publishEvents([]publisher.Event{orderedEvent("k", "a")})
+	client.publishEventsOrdered([]publisher.Event{orderedEvent("k", "b")})
+	for i := range streams.arns {
+		if streams.names[i] != "" || streams.arns[i] != arn {
+			t.Errorf("request %d addressed %q by name and %q by ARN", i, streams.names[i], streams.arns[i])
+		}
+	}
+	if len(streams.arns) != 3 {
+		t.Errorf("expected 3 requests, got %d", len(streams.arns))
+	}
+}
+
+func TestPublishToUnavailableStream(t *testing.T) {
+	client := client{
+		streamName:           "foo",
+		streamARN:            "arn:aws:kinesis:eu-central-1:123456789012:stream/foo",
+		partitionKeyProvider: newXidPartitionKeyProvider(),
+		encoder:              StubCodec{dat: []byte("boom")},
+		observer:             outputs.NewNilObserver(),
+		limiter:              newRateLimiter(0),
+		streams: StubClient{
+			out: &kinesis.PutRecordsOutput{},
+			err: awserr.New(kinesis.ErrCodeAccessDeniedException, "not authorized", nil),
+		},
+	}
+	batch := &stubBatch{events: []publisher.Event{{}, {}}}
+
+	err := client.Publish(batch)
+	if err == nil || err.Error() != "AccessDenied on kinesis:PutRecords for arn:aws:kinesis:eu-central-1:123456789012:stream/foo" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if batch.acked || len(batch.retried) != 2 {
+		t.Errorf("expected all events to be retried, got acked=%v retried=%d", batch.acked, len(batch.retried))
+	}
+}
+
+func TestRefreshStream(t *testing.T) {
+	client := client{streamName: "foo", limiter: newRateLimiter(0), describeInterval: time.Minute}
+	client.streams = StubClient{summary: streamSummary(kinesis.StreamStatusActive, kinesis.StreamModeProvisioned, 1)}
+	if err := client.Connect(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	client.streams = StubClient{summary: streamSummary(kinesis.StreamStatusActive, kinesis.StreamModeOnDemand, 1)}
+	client.refreshStream()
+	if client.stream.mode != kinesis.StreamModeProvisioned {
+		t.Errorf("stream refreshed before describe_interval elapsed")
+	}
+
+	client.stream.describedAt = time.Now().Add(-2 * time.Minute)
+	client.refreshStream()
+	if client.stream.mode != kinesis.StreamModeOnDemand {
+		t.Errorf("stream not refreshed after describe_interval elapsed")
+	}
+}
+
 func TestClient_String(t *testing.T) {
 	fieldForPartitionKey := "mypartitionkey"
 	provider := newFieldPartitionKeyProvider(fieldForPartitionKey)
@@ -234,3 +675,178 @@ func TestClient_String(t *testing.T) {
 		t.Errorf("unexpected value '%v'", v)
 	}
 }
+
+// benchmarkEvents returns a batch of the default size of filebeat-like events. At 10k events/s, 200 of them are
+// mapped every second.
+func benchmarkEvents() []publisher.Event {
+	events := make([]publisher.Event, defaultBatchSize)
+	for i := range events {
+		events[i] = publisher.Event{Content: beat.Event{
+			Timestamp: time.Now(),
+			Fields: common.MapStr{
+				"message": fmt.Sprintf(`10.0.0.%d - - [19/Oct/2026:10:00:00 +0000] "GET /api/v1/items?page=2 HTTP/1.1" 200 5120 "-" "Mozilla/5.0"`, i),
+				"host":    common.MapStr{"name": "ip-10-0-0-1"},
+				"log":     common.MapStr{"file": common.MapStr{"path": "/var/log/nginx/access.log"}, "offset": i * 120},
+			},
+		}}
+	}
+	return events
+}
+
+// BenchmarkMapEvents maps batches of events that are acked right away, with the record buffers recycled by the cache,
+// or left to the garbage collector without it.
+func BenchmarkMapEvents(b *testing.B) {
+	for _, bench := range []struct {
+		name  string
+		cache *eventcache.Cache
+	}{
+		{"pooled", eventcache.New(nil)},
+		{"unpooled", nil},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			client := client{
+				partitionKeyProvider: newXidPartitionKeyProvider(),
+				encoder:              json.New("7.5.0", json.Config{}),
+				observer:             outputs.NewNilObserver(),
+				cache:                bench.cache,
+			}
+			events := benchmarkEvents()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client.mapEvents(events)
+				client.cache.Release(events, nil)
+			}
+		})
+	}
+}
+
+func TestPublishEndToEnd(t *testing.T) {
+	server := awstest.NewServer()
+	defer server.Close()
+	server.CreateStream("foo", 1)
+	config := defaultConfig
+	config.Config = server.Config()
+	config.DeliveryStreamName = "foo"
+	config.PartitionKey = "key"
+	sess, err := awsconfig.NewSession(config.Config, beat.Info{}, "streams")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	observer := &countingObserver{Observer: outputs.NewNilObserver()}
+	client, err := newClient(sess, &config, observer, beat.Info{Beat: "filebeat"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client.encoder = dataCodec{}
+	client.cache = eventcache.New(nil)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The second record is throttled, then the whole retry fails with a server error
+	server.Inject(
+		awstest.PartialFailure("PutRecords", kinesis.ErrCodeProvisionedThroughputExceededException, 1),
+		awstest.ServerError("PutRecords", 500),
+	)
+	batch := &stubBatch{events: []publisher.Event{orderedEvent("a", "1"), orderedEvent("b", "2")}}
+	for i := 0; i < 3 && !batch.acked; i++ {
+		client.Publish(batch)
+		if len(batch.retried) > 0 {
+			batch = &stubBatch{events: batch.retried}
+		}
+	}
+	if !batch.acked {
+		t.Fatalf("expected the events to be acked eventually")
+	}
+	records := server.Records("foo")
+	if len(records) != 2 || records[1].PartitionKey != "b" || string(records[1].Data) != "2\n" {
+		t.Errorf("unexpected records: %v", records)
+	}
+	if observer.acked != 2 || observer.failed != 2 || observer.tooMany != 1 {
+		t.Errorf("unexpected observations: %+v", *observer)
+	}
+}
+
+func TestPublishAvroEndToEnd(t *testing.T) {
+	server := awstest.NewServer()
+	defer server.Close()
+	server.CreateStream("foo", 1)
+	server.CreateSchemaVersion("default-registry", "events", `{"type": "record", "name": "Event", "fields": [{"name": "message", "type": "string"}]}`)
+	config := defaultConfig
+	config.Config = server.Config()
+	config.DeliveryStreamName = "foo"
+	config.PartitionKey = "key"
+	config.Codec = schema.Config{Encoding: schema.EncodingAvro, Schema: schema.SchemaConfig{Name: "events"}}
+	sess, err := awsconfig.NewSession(config.Config, beat.Info{}, "streams")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	observer := &countingObserver{Observer: outputs.NewNilObserver()}
+	client, err := newClient(sess, &config, observer, beat.Info{Beat: "filebeat"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	codec, err := schema.New(config.Codec, sess, beat.Info{}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client.encoder, client.schema = codec, codec
+	if err := client.Connect(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	batch := &stubBatch{events: []publisher.Event{
+		{Content: beat.Event{Fields: common.MapStr{"key": "a", "message": "hello"}}},
+		{Content: beat.Event{Fields: common.MapStr{"key": "b", "message": 1}}},
+	}}
+	client.Publish(batch)
+	if !batch.acked {
+		t.Fatalf("expected the batch to be acked")
+	}
+	records := server.Records("foo")
+	if len(records) != 1 || len(records[0].Data) != 18+6 || records[0].Data[0] != 3 || string(records[0].Data[18:]) != "\nhello" {
+		t.Errorf("unexpected records: %v", records)
+	}
+	if observer.acked != 1 || observer.dropped != 1 {
+		t.Errorf("unexpected observations: %+v", *observer)
+	}
+}
+
+func TestPublishFilteredEvents(t *testing.T) {
+	filter, err := eventfilter.New(eventfilter.Config{
+		DropFields: []string{"key"},
+		When:       &conditions.Config{HasFields: []string{"data"}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	streams := &addressRecordingClient{}
+	observer := &countingObserver{Observer: outputs.NewNilObserver()}
+	client := client{
+		streams:              streams,
+		partitionKeyProvider: newFieldPartitionKeyProvider("key"),
+		encoder:              json.New("7.5.0", json.Config{}),
+		observer:             observer,
+		limiter:              newRateLimiter(0),
+		filter:               filter,
+	}
+	events := []publisher.Event{
+		orderedEvent("a", "1"),
+		{Content: beat.Event{Fields: common.MapStr{"key": "b"}}},
+	}
+	records, _, dropped := client.mapEvents(events)
+	if len(records) != 1 || dropped != 1 {
+		t.Fatalf("expected the event without data to be dropped, got %d records", len(records))
+	}
+	// The partition key is taken from the whole event
+	if aws.StringValue(records[0].PartitionKey) != "a" || strings.Contains(string(records[0].Data), `"key"`) {
+		t.Errorf("unexpected record: %v", records[0])
+	}
+
+	batch := &stubBatch{events: events}
+	client.Publish(batch)
+	if !batch.acked || observer.acked != 1 || observer.dropped != 1 {
+		t.Errorf("expected the filtered event to be acked as dropped, got %+v", *observer)
+	}
+}
@@ -2,23 +2,37 @@ package streams
 
 import (
 	"errors"
+	"fmt"
+	"github.com/s12v/awsbeats/awsconfig"
+	"github.com/s12v/awsbeats/awsmetadata"
+	"github.com/s12v/awsbeats/emf"
+	"github.com/s12v/awsbeats/eventfilter"
+	"github.com/s12v/awsbeats/flatten"
+	"github.com/s12v/awsbeats/schema"
+	"github.com/s12v/awsbeats/spool"
 	"time"
 )
 
 type StreamsConfig struct {
-	Region               string        `config:"region"`
-	DeliveryStreamName   string        `config:"stream_name"`
-	PartitionKey         string        `config:"partition_key"`
-	PartitionKeyProvider string        `config:"partition_key_provider"`
-	BatchSize            int           `config:"batch_size"`
-	MaxRetries           int           `config:"max_retries"`
-	Timeout              time.Duration `config:"timeout"`
-	Backoff              backoff       `config:"backoff"`
-}
+	awsconfig.Config `config:",inline"`
+	Filter           eventfilter.Config `config:",inline"`
+	Codec            schema.Config      `config:",inline"`
 
-type backoff struct {
-	Init time.Duration
-	Max  time.Duration
+	DeliveryStreamName   string             `config:"stream_name"`
+	StreamARN            string             `config:"stream_arn"`
+	PartitionKey         string             `config:"partition_key"`
+	PartitionKeyProvider string             `config:"partition_key_provider"`
+	PartitionKeyFallback string             `config:"partition_key_fallback"`
+	BatchSize            int                `config:"batch_size"`
+	MaxRetries           int                `config:"max_retries"`
+	Workers              int                `config:"workers"`
+	RateLimit            int                `config:"rate_limit"`
+	DescribeInterval     time.Duration      `config:"describe_interval"`
+	Ordered              bool               `config:"ordered"`
+	Spool                spool.Config       `config:"spool"`
+	AWSMetadata          awsmetadata.Config `config:"add_aws_metadata"`
+	AddEventID           bool               `config:"add_event_id"`
+	EMF                  emf.Config         `config:"emf"`
 }
 
 const (
@@ -29,22 +43,63 @@ const (
 
 var (
 	defaultConfig = StreamsConfig{
-		Timeout:    90 * time.Second,
-		MaxRetries: 3,
-		Backoff: backoff{
-			Init: 1 * time.Second,
-			Max:  60 * time.Second,
-		},
+		Config:           awsconfig.DefaultConfig,
+		Codec:            schema.DefaultConfig,
+		MaxRetries:       3,
+		Workers:          1,
+		DescribeInterval: 5 * time.Minute,
+		Spool:            spool.DefaultConfig,
+		AWSMetadata:      awsmetadata.DefaultConfig,
 	}
 )
 
 func (c *StreamsConfig) Validate() error {
-	if c.Region == "" {
-		return errors.New("region is not defined")
+	if c.StreamARN != "" {
+		if c.DeliveryStreamName != "" {
+			return errors.New("stream_name and stream_arn can't be set together")
+		}
+		arn, err := awsconfig.ParseResourceARN(c.StreamARN, "kinesis", "stream")
+		if err != nil {
+			return fmt.Errorf("invalid stream_arn: %v", err)
+		}
+		if err := c.Config.UseRegionOf(arn, "stream_arn"); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Config.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Filter.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Codec.Validate(); err != nil {
+		return err
 	}
 
-	if c.DeliveryStreamName == "" {
-		return errors.New("stream_name is not defined")
+	switch c.Codec.Encoding {
+	case "", schema.EncodingJSON, schema.EncodingAvro, schema.EncodingProtobuf:
+	case emf.Encoding:
+		if err := c.EMF.Validate(); err != nil {
+			return err
+		}
+		if err := c.EMF.Required(); err != nil {
+			return err
+		}
+	case flatten.Encoding:
+		return errors.New("flatten encoding is only supported by the firehose output")
+	default:
+		return fmt.Errorf("invalid encoding %q: must be json, avro, protobuf or emf", c.Codec.Encoding)
+	}
+
+	if c.Codec.Binary() && c.AWSMetadata.Enabled {
+		return errors.New("add_aws_metadata requires the json encoding")
+	}
+
+	if c.DeliveryStreamName == "" && c.StreamARN == "" {
+		return errors.New("stream_name or stream_arn is not defined")
 	}
 
 	if c.BatchSize > maxBatchSize || c.BatchSize < 1 {
@@ -55,5 +110,33 @@ func (c *StreamsConfig) Validate() error {
 		return errors.New("invalid partition key procider: the only supported provider is `xid`")
 	}
 
+	if c.PartitionKeyFallback != "" && c.PartitionKeyFallback != "xid" {
+		return errors.New("invalid partition key fallback: the only supported fallback is `xid`")
+	}
+
+	if c.PartitionKeyFallback != "" && c.PartitionKeyProvider == "xid" {
+		return errors.New("partition_key_fallback requires records to be partitioned by `partition_key`")
+	}
+
+	if c.Workers < 0 {
+		return errors.New("workers must not be negative")
+	}
+
+	if c.Ordered && c.Workers > 1 {
+		return errors.New("ordered mode requires a single worker")
+	}
+
+	if c.Ordered && c.PartitionKeyProvider == "xid" {
+		return errors.New("ordered mode requires records to be partitioned by `partition_key`")
+	}
+
+	if c.Ordered && c.Spool.Enabled {
+		return errors.New("ordered mode can't be combined with the spool")
+	}
+
+	if c.RateLimit < 0 {
+		return errors.New("rate_limit must not be negative")
+	}
+
 	return nil
 }
@@ -1,6 +1,10 @@
 package streams
 
-import "testing"
+import (
+	"github.com/s12v/awsbeats/awsconfig"
+	"github.com/s12v/awsbeats/spool"
+	"testing"
+)
 
 func TestValidate(t *testing.T) {
 	config := &StreamsConfig{}
@@ -11,7 +15,7 @@ func TestValidate(t *testing.T) {
 }
 
 func TestValidateWithRegion(t *testing.T) {
-	config := &StreamsConfig{Region: "eu-central-1"}
+	config := &StreamsConfig{Config: awsconfig.Config{Region: "eu-central-1"}}
 	err := config.Validate()
 	if err == nil {
 		t.Errorf("Expected an error")
@@ -19,7 +23,7 @@ func TestValidateWithRegion(t *testing.T) {
 }
 
 func TestValidateWithRegionAndStreamNameAndBatchSize(t *testing.T) {
-	config := &StreamsConfig{Region: "eu-central-1", DeliveryStreamName: "foo", BatchSize: 50}
+	config := &StreamsConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 50}
 	err := config.Validate()
 	if err != nil {
 		t.Errorf("Unexpected error: %v", err)
@@ -27,7 +31,7 @@ func TestValidateWithRegionAndStreamNameAndBatchSize(t *testing.T) {
 }
 
 func TestValidateWithRegionAndStreamNameAndInvalidBatchSize501(t *testing.T) {
-	config := &StreamsConfig{Region: "eu-central-1", DeliveryStreamName: "foo", BatchSize: 501}
+	config := &StreamsConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 501}
 	err := config.Validate()
 	if err == nil {
 		t.Errorf("Expected an error")
@@ -35,7 +39,7 @@ func TestValidateWithRegionAndStreamNameAndInvalidBatchSize501(t *testing.T) {
 }
 
 func TestValidateWithRegionAndStreamNameAndInvalidBatchSize0(t *testing.T) {
-	config := &StreamsConfig{Region: "eu-central-1", DeliveryStreamName: "foo", BatchSize: 0}
+	config := &StreamsConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 0}
 	err := config.Validate()
 	if err == nil {
 		t.Errorf("Expected an error")
@@ -43,9 +47,96 @@ func TestValidateWithRegionAndStreamNameAndInvalidBatchSize0(t *testing.T) {
 }
 
 func TestValidateWithRegionAndStreamNameAndInvalidPartitionKeyProvider(t *testing.T) {
-	config := &StreamsConfig{Region: "eu-central-1", DeliveryStreamName: "foo", PartitionKeyProvider: "uuid"}
+	config := &StreamsConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", PartitionKeyProvider: "uuid"}
 	err := config.Validate()
 	if err == nil {
 		t.Errorf("Expected an error")
 	}
 }
+
+func TestValidateWithNegativeRateLimit(t *testing.T) {
+	config := &StreamsConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 50, RateLimit: -1}
+	err := config.Validate()
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestValidateWithNegativeWorkers(t *testing.T) {
+	config := &StreamsConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 50, Workers: -1}
+	err := config.Validate()
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestValidateOrderedWithWorkers(t *testing.T) {
+	config := &StreamsConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 50, Ordered: true, Workers: 2}
+	err := config.Validate()
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestValidateOrderedWithXid(t *testing.T) {
+	config := &StreamsConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 50, Ordered: true, PartitionKeyProvider: "xid"}
+	err := config.Validate()
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestValidateOrderedWithSpool(t *testing.T) {
+	config := &StreamsConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 50, Ordered: true, Spool: spool.Config{Enabled: true}}
+	err := config.Validate()
+	if err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestValidateWithStreamARN(t *testing.T) {
+	config := &StreamsConfig{StreamARN: "arn:aws:kinesis:eu-west-1:123456789012:stream/foo", BatchSize: 50}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.Region != "eu-west-1" {
+		t.Errorf("Expected the region of the ARN, got %s", config.Region)
+	}
+
+	for _, config := range []*StreamsConfig{
+		{Config: awsconfig.Config{Region: "eu-central-1"}, StreamARN: "arn:aws:kinesis:eu-west-1:123456789012:stream/foo", BatchSize: 50},
+		{StreamARN: "arn:aws:kinesis:eu-west-1:123456789012:stream/foo", DeliveryStreamName: "foo", BatchSize: 50},
+		{StreamARN: "arn:aws:firehose:eu-west-1:123456789012:deliverystream/foo", BatchSize: 50},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected an error for %+v", config)
+		}
+	}
+}
+
+func TestValidateWithFlattenEncoding(t *testing.T) {
+	config := &StreamsConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 50}
+	config.Codec.Encoding = "flatten"
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestValidateWithUnknownEncoding(t *testing.T) {
+	config := &StreamsConfig{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 50}
+	config.Codec.Encoding = "xml"
+	if err := config.Validate(); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
+
+func TestValidateWithPartitionKeyFallback(t *testing.T) {
+	for _, config := range []*StreamsConfig{
+		{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 50, PartitionKeyFallback: "random"},
+		{Config: awsconfig.Config{Region: "eu-central-1"}, DeliveryStreamName: "foo", BatchSize: 50, PartitionKeyFallback: "xid", PartitionKeyProvider: "xid"},
+	} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected an error for %+v", config)
+		}
+	}
+}
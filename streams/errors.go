@@ -0,0 +1,52 @@
+package streams
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"regexp"
+)
+
+var resourceARNPattern = regexp.MustCompile(`on resource: (arn:\S+)`)
+
+// unavailableError means that the stream can't take any record, because it is missing or we aren't allowed to write
+// to it. It makes the client go back to connecting instead of retrying the batch over and over.
+type unavailableError struct {
+	msg string
+}
+
+func (e *unavailableError) Error() string {
+	return e.msg
+}
+
+// apiError turns an error returned by a Kinesis API call into one that tells which call failed on which stream,
+// e.g. "AccessDenied on kinesis:PutRecords for arn:aws:kinesis:eu-central-1:123456789012:stream/foo".
+func (client *client) apiError(action string, err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	switch aerr.Code() {
+	case kinesis.ErrCodeResourceNotFoundException:
+		if client.streamByARN {
+			return &unavailableError{fmt.Sprintf("stream %s does not exist", client.streamARN)}
+		}
+		return &unavailableError{fmt.Sprintf("stream %s does not exist in region %s", client.streamName, client.region)}
+	case kinesis.ErrCodeAccessDeniedException, "AccessDenied":
+		return &unavailableError{fmt.Sprintf("AccessDenied on kinesis:%s for %s", action, client.streamResource(aerr))}
+	case "UnrecognizedClientException", "InvalidSignatureException", "ExpiredTokenException":
+		return &unavailableError{fmt.Sprintf("%s on kinesis:%s: check the AWS credentials: %s", aerr.Code(), action, aerr.Message())}
+	}
+	return err
+}
+
+// streamResource names the stream in an error message, preferably by the ARN.
+func (client *client) streamResource(aerr awserr.Error) string {
+	if m := resourceARNPattern.FindStringSubmatch(aerr.Message()); m != nil {
+		return m[1]
+	}
+	if client.streamARN != "" {
+		return client.streamARN
+	}
+	return fmt.Sprintf("stream %s in region %s", client.streamName, client.region)
+}
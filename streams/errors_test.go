@@ -0,0 +1,51 @@
+package streams
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"testing"
+)
+
+func TestAPIError(t *testing.T) {
+	client := client{streamName: "foo", region: "eu-central-1"}
+
+	{
+		err := client.apiError("PutRecords", awserr.New(kinesis.ErrCodeAccessDeniedException, "User: arn:aws:iam::123456789012:user/bar is not authorized to perform: kinesis:PutRecords on resource: arn:aws:kinesis:eu-central-1:123456789012:stream/foo", nil))
+		if _, ok := err.(*unavailableError); !ok {
+			t.Errorf("unexpected error type: %T", err)
+		}
+		if err.Error() != "AccessDenied on kinesis:PutRecords for arn:aws:kinesis:eu-central-1:123456789012:stream/foo" {
+			t.Errorf("unexpected message: %v", err)
+		}
+	}
+
+	{
+		err := client.apiError("PutRecords", awserr.New(kinesis.ErrCodeAccessDeniedException, "not authorized", nil))
+		if err.Error() != "AccessDenied on kinesis:PutRecords for stream foo in region eu-central-1" {
+			t.Errorf("unexpected message: %v", err)
+		}
+	}
+
+	{
+		err := client.apiError("DescribeStreamSummary", awserr.New("UnrecognizedClientException", "The security token included in the request is invalid.", nil))
+		if _, ok := err.(*unavailableError); !ok {
+			t.Errorf("unexpected error type: %T", err)
+		}
+	}
+
+	{
+		// Throttling and other transient errors are left as they are
+		original := awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+		if err := client.apiError("PutRecords", original); err != original {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+
+	{
+		original := errors.New("connection reset by peer")
+		if err := client.apiError("PutRecords", original); err != original {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package streams
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"time"
+)
+
+// observeRequest records a PutRecords or PutRecord call in the output metrics, including the records it failed for
+// as a whole.
+func (client *client) observeRequest(latency time.Duration, records []*kinesis.PutRecordsRequestEntry, err error) {
+	client.metrics.Request(latency, len(records), recordsSize(records))
+	if err != nil {
+		client.observeFailedRecords(errorCode(err), len(records))
+	}
+}
+
+// observeFailedEntries records the records that a successful PutRecords call reported as failed.
+func (client *client) observeFailedEntries(res *kinesis.PutRecordsOutput) {
+	if res == nil || aws.Int64Value(res.FailedRecordCount) == 0 {
+		return
+	}
+	for _, r := range res.Records {
+		if r != nil && aws.StringValue(r.ErrorCode) != "" {
+			client.observeFailedRecords(aws.StringValue(r.ErrorCode), 1)
+		}
+	}
+}
+
+func (client *client) observeFailedRecords(code string, n int) {
+	client.metrics.FailedRecords(code, n)
+	if isThrottled(code) {
+		client.metrics.ThrottledRecords(n)
+	}
+}
+
+// countThrottled counts the events carried by the records that a PutRecords call rejected because the stream was over
+// its throughput limits.
+func countThrottled(res *kinesis.PutRecordsOutput, carried recordEvents) int {
+	n := 0
+	if res == nil {
+		return n
+	}
+	for i, r := range res.Records {
+		if i < len(carried) && r != nil && isThrottled(aws.StringValue(r.ErrorCode)) {
+			n += len(carried[i])
+		}
+	}
+	return n
+}
+
+func recordsSize(records []*kinesis.PutRecordsRequestEntry) int {
+	size := 0
+	for _, record := range records {
+		// Both count towards the Kinesis size limits
+		size += len(record.Data) + len(aws.StringValue(record.PartitionKey))
+	}
+	return size
+}
+
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return "unknown"
+}
+
+func isThrottled(code string) bool {
+	switch code {
+	case kinesis.ErrCodeProvisionedThroughputExceededException, kinesis.ErrCodeKMSThrottlingException, kinesis.ErrCodeLimitExceededException, "ThrottlingException":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package streams
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/elastic/beats/libbeat/monitoring"
+	"github.com/s12v/awsbeats/metrics"
+	"testing"
+	"time"
+)
+
+func TestObserveRequest(t *testing.T) {
+	client := client{metrics: metrics.Get("streams_test")}
+	snapshot := func() map[string]int64 {
+		return monitoring.CollectFlatSnapshot(monitoring.Default.GetRegistry("libbeat.outputs.streams_test"), monitoring.Full, false).Ints
+	}
+	before := snapshot()
+	records := []*kinesis.PutRecordsRequestEntry{
+		{Data: []byte("foo"), PartitionKey: aws.String("a")},
+		{Data: []byte("bar"), PartitionKey: aws.String("b")},
+	}
+
+	client.observeRequest(time.Millisecond, records, nil)
+	client.observeFailedEntries(&kinesis.PutRecordsOutput{
+		FailedRecordCount: aws.Int64(1),
+		Records: []*kinesis.PutRecordsResultEntry{
+			{ErrorCode: aws.String(kinesis.ErrCodeProvisionedThroughputExceededException)},
+			{ErrorCode: aws.String("")},
+		},
+	})
+	client.observeRequest(time.Millisecond, records, awserr.New("InternalFailure", "boom", nil))
+
+	after := snapshot()
+	expected := map[string]int64{
+		"bytes_sent": 16,
+		"records.failed.ProvisionedThroughputExceededException": 1,
+		"records.failed.InternalFailure":                        2,
+		"records.throttled":                                     1,
+	}
+	for name, value := range expected {
+		if d := after[name] - before[name]; d != value {
+			t.Errorf("unexpected increase of %s: %d", name, d)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package streams
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/elastic/beats/libbeat/publisher"
+	"testing"
+)
+
+// failingAPI fails every PutRecords call, and records the middlewares it went through.
+type failingAPI struct {
+	API
+	name  string
+	calls *[]string
+}
+
+func (a failingAPI) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	*a.calls = append(*a.calls, a.name)
+	if a.API != nil {
+		return a.API.PutRecords(input)
+	}
+	return nil, errors.New("chaos")
+}
+
+func TestUse(t *testing.T) {
+	defer func() { middlewares = nil }()
+	var calls []string
+	Use(func(api API) API { return failingAPI{API: api, name: "outer", calls: &calls} })
+	Use(func(api API) API { return failingAPI{name: "inner", calls: &calls} })
+
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("eu-central-1")}))
+	client, err := newClient(sess, &StreamsConfig{DeliveryStreamName: "foo", PartitionKey: "key"}, outputs.NewNilObserver(), beat.Info{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client.encoder = dataCodec{}
+	rest, err := client.publishEvents([]publisher.Event{orderedEvent("k", "a")})
+	if err == nil || len(rest) != 1 {
+		t.Errorf("expected the event to fail, got %d events to retry and %v", len(rest), err)
+	}
+	if len(calls) != 2 || calls[0] != "outer" || calls[1] != "inner" {
+		t.Errorf("unexpected calls: %v", calls)
+	}
+}
@@ -0,0 +1,169 @@
+package streams
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/publisher"
+	"github.com/s12v/awsbeats/metrics"
+	"sync"
+	"time"
+)
+
+const (
+	// Number of partition keys whose records are sent concurrently in ordered mode
+	maxOrderedKeysInFlight = 32
+	// Number of partition keys whose last sequence number is remembered across batches in ordered mode
+	maxOrderedKeysTracked = 10000
+)
+
+// sequenceNumbers remembers the sequence number of the last record put for each partition key, to be passed as
+// SequenceNumberForOrdering of the next record with the same key.
+type sequenceNumbers struct {
+	mu   sync.Mutex
+	last map[string]*list.Element
+	// Keys by the time their last record was put, the least recent first
+	keys *list.List
+}
+
+type sequenceNumber struct {
+	partitionKey string
+	seq          string
+}
+
+func newSequenceNumbers() *sequenceNumbers {
+	return &sequenceNumbers{last: map[string]*list.Element{}, keys: list.New()}
+}
+
+func (s *sequenceNumbers) get(partitionKey string) *string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.last[partitionKey]; ok {
+		return aws.String(e.Value.(*sequenceNumber).seq)
+	}
+	return nil
+}
+
+func (s *sequenceNumbers) set(partitionKey string, seq string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.last[partitionKey]; ok {
+		e.Value.(*sequenceNumber).seq = seq
+		s.keys.MoveToBack(e)
+		return
+	}
+	if len(s.last) >= maxOrderedKeysTracked {
+		// Forget the least recent key rather than growing without bounds. Its next record is still put after the
+		// previous one, only it isn't chained to it anymore.
+		oldest := s.keys.Front()
+		s.keys.Remove(oldest)
+		delete(s.last, oldest.Value.(*sequenceNumber).partitionKey)
+	}
+	s.last[partitionKey] = s.keys.PushBack(&sequenceNumber{partitionKey: partitionKey, seq: seq})
+}
+
+// publishEventsOrdered sends the events one by one with PutRecord, chaining the records of each partition key with
+// SequenceNumberForOrdering. Records of different keys are sent concurrently, while records of the same key never
+// are. Once a record fails, the remaining records of its key aren't sent, and are retried together with it in order.
+func (client *client) publishEventsOrdered(events []publisher.Event) ([]publisher.Event, error) {
+	client.observer.NewBatch(len(events))
+
+	records, carried, dropped := client.mapEvents(events)
+
+	var keys []string
+	byKey := map[string][]int{}
+	for i, record := range records {
+		key := aws.StringValue(record.PartitionKey)
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], i)
+	}
+
+	var (
+		mu        sync.Mutex
+		firstErr  error
+		throttled int
+		sent      int
+		wg        sync.WaitGroup
+	)
+	failed := make([]bool, len(records))
+	slots := make(chan struct{}, maxOrderedKeysInFlight)
+	for _, key := range keys {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(key string, indices []int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			for n, i := range indices {
+				err := client.putKinesisRecord(records[i])
+				mu.Lock()
+				sent += recordsSize(records[i : i+1])
+				mu.Unlock()
+				if err != nil {
+					mu.Lock()
+					for _, j := range indices[n:] {
+						failed[j] = true
+					}
+					if isThrottled(errorCode(err)) {
+						for _, j := range indices[n:] {
+							throttled += len(carried[j])
+						}
+					}
+					if _, ok := err.(*unavailableError); !ok {
+						err = fmt.Errorf("failed to put record: %v", err)
+					}
+					if _, ok := firstErr.(*unavailableError); firstErr == nil || !ok {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+			}
+		}(key, byKey[key])
+	}
+	wg.Wait()
+
+	rest := make([]publisher.Event, 0)
+	for i := range records {
+		if failed[i] {
+			rest = append(rest, carried[i]...)
+		}
+	}
+	metrics.Outcome{
+		Acked:     carried.count() - len(rest),
+		Failed:    len(rest),
+		Throttled: throttled,
+		Dropped:   dropped,
+		Bytes:     sent,
+		Err:       firstErr,
+	}.Report(client.observer, client.metrics)
+	if len(rest) > 0 {
+		logp.NewLogger("streams").Infof("retrying %d events on error: %v", len(rest), firstErr)
+	}
+	return rest, firstErr
+}
+
+func (client *client) putKinesisRecord(record *kinesis.PutRecordsRequestEntry) error {
+	client.limiter.wait(1)
+	partitionKey := aws.StringValue(record.PartitionKey)
+	name, arn := client.streamID()
+	start := time.Now()
+	res, err := client.streams.PutRecord(&kinesis.PutRecordInput{
+		StreamName:                name,
+		StreamARN:                 arn,
+		Data:                      record.Data,
+		PartitionKey:              record.PartitionKey,
+		SequenceNumberForOrdering: client.sequenceNumbers.get(partitionKey),
+	})
+	client.observeRequest(time.Since(start), []*kinesis.PutRecordsRequestEntry{record}, err)
+	if err != nil {
+		return client.apiError("PutRecord", err)
+	}
+	client.sequenceNumbers.set(partitionKey, aws.StringValue(res.SequenceNumber))
+	return nil
+}
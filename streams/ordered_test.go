@@ -0,0 +1,178 @@
+package streams
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/elastic/beats/libbeat/publisher"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingClient records every PutRecord call, and fails the ones whose data is listed in failOn.
+type recordingClient struct {
+	StubClient
+	mu     sync.Mutex
+	seq    int
+	calls  []*kinesis.PutRecordInput
+	failOn map[string]bool
+}
+
+func (c *recordingClient) PutRecord(input *kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, input)
+	if c.failOn[strings.TrimSuffix(string(input.Data), "\n")] {
+		return nil, fmt.Errorf("simulated failure")
+	}
+	c.seq++
+	return &kinesis.PutRecordOutput{SequenceNumber: aws.String(strconv.Itoa(c.seq))}, nil
+}
+
+// callsFor returns the PutRecord calls for the given partition key in the order they were made.
+func (c *recordingClient) callsFor(key string) []*kinesis.PutRecordInput {
+	var calls []*kinesis.PutRecordInput
+	for _, call := range c.calls {
+		if aws.StringValue(call.PartitionKey) == key {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// dataCodec encodes an event as the value of its "data" field.
+type dataCodec struct{}
+
+func (dataCodec) Encode(index string, event *beat.Event) ([]byte, error) {
+	v, _ := event.GetValue("data")
+	return []byte(v.(string)), nil
+}
+
+func orderedEvent(key string, data string) publisher.Event {
+	return publisher.Event{Content: beat.Event{Fields: common.MapStr{"key": key, "data": data}}}
+}
+
+func newOrderedClient(streams API) *client {
+	return &client{
+		streams:              streams,
+		streamName:           "foo",
+		partitionKeyProvider: newFieldPartitionKeyProvider("key"),
+		encoder:              dataCodec{},
+		observer:             outputs.NewNilObserver(),
+		limiter:              newRateLimiter(0),
+		ordered:              true,
+		sequenceNumbers:      newSequenceNumbers(),
+	}
+}
+
+func TestPublishEventsOrdered(t *testing.T) {
+	streams := &recordingClient{}
+	client := newOrderedClient(streams)
+	events := []publisher.Event{
+		orderedEvent("a", "a1"),
+		orderedEvent("b", "b1"),
+		orderedEvent("a", "a2"),
+		orderedEvent("b", "b2"),
+		orderedEvent("a", "a3"),
+	}
+
+	rest, err := client.publishEventsOrdered(events)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rest) != 0 {
+		t.Errorf("unexpected number of remaining events: %d", len(rest))
+	}
+
+	calls := streams.callsFor("a")
+	if len(calls) != 3 {
+		t.Fatalf("expected 3 calls for key a, got %d", len(calls))
+	}
+	for i, expected := range []string{"a1", "a2", "a3"} {
+		if string(calls[i].Data) != expected+"\n" {
+			t.Errorf("unexpected record #%d: %s", i, calls[i].Data)
+		}
+	}
+	if calls[0].SequenceNumberForOrdering != nil {
+		t.Errorf("first record of a key must not be chained")
+	}
+	for i := 1; i < len(calls); i++ {
+		if calls[i].SequenceNumberForOrdering == nil {
+			t.Errorf("record #%d isn't chained to the previous one", i)
+		}
+	}
+
+	// The next batch is chained to the last record of the previous one
+	streams.calls = nil
+	if _, err := client.publishEventsOrdered([]publisher.Event{orderedEvent("a", "a4")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if streams.calls[0].SequenceNumberForOrdering == nil {
+		t.Errorf("first record of the next batch isn't chained")
+	}
+}
+
+func TestPublishEventsOrderedWithFailure(t *testing.T) {
+	streams := &recordingClient{failOn: map[string]bool{"a2": true}}
+	client := newOrderedClient(streams)
+	events := []publisher.Event{
+		orderedEvent("a", "a1"),
+		orderedEvent("b", "b1"),
+		orderedEvent("a", "a2"),
+		orderedEvent("b", "b2"),
+		orderedEvent("a", "a3"),
+	}
+
+	rest, err := client.publishEventsOrdered(events)
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// a3 must not be sent before a2 succeeded
+	if calls := streams.callsFor("a"); len(calls) != 2 {
+		t.Errorf("expected 2 calls for key a, got %d", len(calls))
+	}
+	if calls := streams.callsFor("b"); len(calls) != 2 {
+		t.Errorf("expected 2 calls for key b, got %d", len(calls))
+	}
+
+	if len(rest) != 2 {
+		t.Fatalf("unexpected number of remaining events: %d", len(rest))
+	}
+	for i, expected := range []string{"a2", "a3"} {
+		if v, _ := rest[i].Content.GetValue("data"); v != expected {
+			t.Errorf("unexpected remaining event #%d: %v", i, v)
+		}
+	}
+}
+
+func TestSequenceNumbersAreBounded(t *testing.T) {
+	seqs := newSequenceNumbers()
+	for i := 0; i < maxOrderedKeysTracked+1; i++ {
+		seqs.set(strconv.Itoa(i), "1")
+	}
+	if len(seqs.last) > maxOrderedKeysTracked {
+		t.Errorf("too many keys tracked: %d", len(seqs.last))
+	}
+	if seqs.get(strconv.Itoa(maxOrderedKeysTracked)) == nil {
+		t.Errorf("last key isn't tracked")
+	}
+	if seqs.get("0") != nil || seqs.get("1") == nil {
+		t.Errorf("expected only the least recent key to be forgotten")
+	}
+
+	// Putting a record makes its key the most recent one
+	seqs.set("1", "2")
+	seqs.set("new", "1")
+	if seqs.get("1") == nil || seqs.get("2") != nil {
+		t.Errorf("expected the least recent key to be forgotten")
+	}
+	if seq := seqs.get("1"); aws.StringValue(seq) != "2" {
+		t.Errorf("unexpected sequence number %v", seq)
+	}
+}
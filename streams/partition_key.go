@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/elastic/beats/libbeat/publisher"
 	"github.com/rs/xid"
+	"github.com/s12v/awsbeats/metrics"
 )
 
 type PartitionKeyProvider interface {
@@ -12,6 +13,9 @@ type PartitionKeyProvider interface {
 
 type fieldPartitionKeyProvider struct {
 	fieldKey string
+	// Whether events without the field get a random key, counted in the metrics, rather than failing
+	fallback bool
+	metrics  *metrics.Metrics
 }
 
 type xidPartitionKeyProvider struct {
@@ -24,6 +28,15 @@ func newFieldPartitionKeyProvider(fieldKey string) *fieldPartitionKeyProvider {
 }
 
 func (p *fieldPartitionKeyProvider) PartitionKeyFor(event *publisher.Event) (string, error) {
+	partitionKey, err := p.fieldValue(event)
+	if err != nil && p.fallback {
+		p.metrics.PartitionKeyFallback()
+		return xid.New().String(), nil
+	}
+	return partitionKey, err
+}
+
+func (p *fieldPartitionKeyProvider) fieldValue(event *publisher.Event) (string, error) {
 	rawPartitionKey, err := event.Content.GetValue(p.fieldKey)
 	if err != nil {
 		return "", fmt.Errorf("failed to get parition key: %v", err)
@@ -3,6 +3,7 @@ package streams
 import (
 	"github.com/elastic/beats/libbeat/beat"
 	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/monitoring"
 	"github.com/elastic/beats/libbeat/publisher"
 	"testing"
 )
@@ -19,3 +20,26 @@ func TestXidPartitionKey(t *testing.T) {
 		t.Fatalf("uenxpected partition key: %s", xidKey)
 	}
 }
+
+func TestFieldPartitionKeyFallback(t *testing.T) {
+	event := &publisher.Event{Content: beat.Event{Fields: common.MapStr{"foo": 1}}}
+
+	provider := createPartitionKeyProvider(&StreamsConfig{PartitionKey: "foo"})
+	if _, err := provider.PartitionKeyFor(event); err == nil {
+		t.Fatalf("expected a key that isn't a string to fail")
+	}
+
+	provider = createPartitionKeyProvider(&StreamsConfig{PartitionKey: "foo", PartitionKeyFallback: "xid"})
+	fallbacks := func() int64 {
+		reg := monitoring.Default.GetRegistry("libbeat.outputs.streams")
+		return monitoring.CollectFlatSnapshot(reg, monitoring.Full, false).Ints["partition_key.fallbacks"]
+	}
+	before := fallbacks()
+	key, err := provider.PartitionKeyFor(event)
+	if err != nil || key == "" {
+		t.Fatalf("expected a random key, got %q: %v", key, err)
+	}
+	if n := fallbacks() - before; n != 1 {
+		t.Errorf("expected 1 fallback, got %d", n)
+	}
+}
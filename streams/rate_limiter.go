@@ -0,0 +1,75 @@
+package streams
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter paces PutRecords calls so that the output doesn't push more records per second than the stream accepts.
+// A zero rate disables it.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		tokens: rate,
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+func (l *rateLimiter) setRate(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		// Nothing has been tracked while disabled, so start over with a full bucket
+		l.tokens = rate
+		l.last = time.Time{}
+	}
+	l.rate = rate
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+}
+
+func (l *rateLimiter) getRate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// wait blocks until n records can be sent without exceeding the rate.
+// The bucket holds at most one second worth of records, and a request larger than that is let through once the
+// debt it leaves behind has been paid off.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		l.sleep(delay)
+	}
+}
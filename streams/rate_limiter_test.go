@@ -0,0 +1,63 @@
+package streams
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(rate float64) (*rateLimiter, *time.Time, *time.Duration) {
+	now := time.Unix(0, 0)
+	slept := time.Duration(0)
+	limiter := newRateLimiter(rate)
+	limiter.now = func() time.Time { return now }
+	limiter.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	return limiter, &now, &slept
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter, _, slept := newTestRateLimiter(0)
+	limiter.wait(100000)
+	if *slept != 0 {
+		t.Errorf("unexpected wait: %v", *slept)
+	}
+}
+
+func TestRateLimiterWithinRate(t *testing.T) {
+	limiter, _, slept := newTestRateLimiter(1000)
+	limiter.wait(500)
+	limiter.wait(500)
+	if *slept != 0 {
+		t.Errorf("unexpected wait: %v", *slept)
+	}
+}
+
+func TestRateLimiterOverRate(t *testing.T) {
+	limiter, _, slept := newTestRateLimiter(1000)
+	limiter.wait(1000)
+	limiter.wait(500)
+	if *slept != 500*time.Millisecond {
+		t.Errorf("unexpected wait: %v", *slept)
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	limiter, now, slept := newTestRateLimiter(1000)
+	limiter.wait(1000)
+	*now = now.Add(time.Second)
+	limiter.wait(1000)
+	if *slept != 0 {
+		t.Errorf("unexpected wait: %v", *slept)
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	limiter, _, slept := newTestRateLimiter(0)
+	limiter.setRate(100)
+	limiter.wait(200)
+	if *slept != time.Second {
+		t.Errorf("unexpected wait: %v", *slept)
+	}
+}
@@ -0,0 +1,211 @@
+package streams
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/elastic/beats/libbeat/publisher"
+	"github.com/s12v/awsbeats/spool"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyClient fails every PutRecords call while down or denied, and records the data of those that went through.
+type flakyClient struct {
+	StubClient
+	down   bool
+	denied bool
+	sent   []string
+}
+
+func (c *flakyClient) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	if c.down {
+		return nil, errors.New("dial tcp: i/o timeout")
+	}
+	if c.denied {
+		return nil, awserr.New(kinesis.ErrCodeAccessDeniedException, "User is not authorized to perform: kinesis:PutRecords", nil)
+	}
+	out := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for _, record := range input.Records {
+		c.sent = append(c.sent, strings.TrimSuffix(string(record.Data), "\n"))
+		out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{SequenceNumber: aws.String("1")})
+	}
+	return out, nil
+}
+
+func TestPublishSpooledInOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp, err := spool.Open(spool.Config{Enabled: true, Path: dir, MaxSize: 1 << 20, RetryInterval: time.Nanosecond}, "streams_test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	streams := &flakyClient{StubClient: StubClient{summary: streamSummary(kinesis.StreamStatusActive, kinesis.StreamModeOnDemand, 1)}, down: true}
+	observer := &countingObserver{Observer: outputs.NewNilObserver()}
+	client := client{
+		streams:              streams,
+		partitionKeyProvider: newFieldPartitionKeyProvider("key"),
+		encoder:              dataCodec{},
+		observer:             observer,
+		limiter:              newRateLimiter(0),
+		spool:                sp,
+	}
+	publish := func(data ...string) {
+		batch := &stubBatch{}
+		for _, d := range data {
+			batch.events = append(batch.events, orderedEvent("k", d))
+		}
+		if err := client.Publish(batch); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !batch.acked || len(batch.retried) != 0 {
+			t.Errorf("expected batch %v to be acked", data)
+		}
+	}
+
+	// While the stream can't be reached, batches are spooled and acked to the pipeline
+	publish("a", "b")
+	publish("c")
+	if sp.Empty() || len(streams.sent) != 0 {
+		t.Fatalf("expected the batches to be spooled")
+	}
+	if observer.acked != 0 {
+		t.Errorf("expected spooled events not to be acked yet, got %d", observer.acked)
+	}
+
+	// Spooled records are sent first once it's back
+	streams.down = false
+	publish("d")
+	if strings.Join(streams.sent, ",") != "a,b,c,d" {
+		t.Errorf("unexpected records sent: %v", streams.sent)
+	}
+	if !sp.Empty() || observer.acked != 4 {
+		t.Errorf("expected the spool to be drained, got %d events acked", observer.acked)
+	}
+}
+
+func TestDescribeStreamAfterSpooledConnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp, err := spool.Open(spool.Config{Enabled: true, Path: dir, MaxSize: 1 << 20, RetryInterval: time.Second}, "streams_test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := client{streamName: "foo", limiter: newRateLimiter(0), describeInterval: time.Minute, spool: sp}
+	client.streams = StubClient{describeErr: errors.New("dial tcp: i/o timeout")}
+	if err := client.Connect(); err != nil {
+		t.Fatalf("expected to spool until the stream can be described, got %v", err)
+	}
+
+	client.streams = StubClient{summary: streamSummary(kinesis.StreamStatusActive, kinesis.StreamModeProvisioned, 2)}
+	client.refreshStream()
+	if client.stream != nil {
+		t.Errorf("stream described again before describe_interval elapsed")
+	}
+
+	client.describeAttemptedAt = time.Now().Add(-2 * time.Minute)
+	client.refreshStream()
+	if client.stream == nil {
+		t.Fatalf("stream not described after describe_interval elapsed")
+	}
+	if rate := client.limiter.getRate(); rate != 2000 {
+		t.Errorf("expected the rate limit of 2 shards, got %.0f", rate)
+	}
+}
+
+func TestPublishSpooledUnavailable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sp, err := spool.Open(spool.Config{Enabled: true, Path: dir, MaxSize: 1 << 20, RetryInterval: time.Nanosecond}, "streams_test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Append([]spool.Record{{PartitionKey: "k", Data: []byte("a\n")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	streams := &flakyClient{StubClient: StubClient{summary: streamSummary(kinesis.StreamStatusActive, kinesis.StreamModeOnDemand, 1)}, denied: true}
+	observer := &countingObserver{Observer: outputs.NewNilObserver()}
+	client := client{
+		streams:              streams,
+		streamName:           "foo",
+		region:               "eu-central-1",
+		partitionKeyProvider: newFieldPartitionKeyProvider("key"),
+		encoder:              dataCodec{},
+		observer:             observer,
+		limiter:              newRateLimiter(0),
+		spool:                sp,
+	}
+	time.Sleep(time.Millisecond)
+
+	// The batch isn't spooled behind records that can't be sent, the client goes back to connecting instead
+	batch := &stubBatch{events: []publisher.Event{orderedEvent("k", "b"), orderedEvent("k", "c")}}
+	if _, ok := client.Publish(batch).(*unavailableError); !ok {
+		t.Errorf("expected the stream to be unavailable")
+	}
+	if batch.acked || len(batch.retried) != 2 || observer.failed != 2 {
+		t.Errorf("expected the events to be retried, got acked=%v retried=%d", batch.acked, len(batch.retried))
+	}
+	if sp.Empty() {
+		t.Errorf("expected the spooled records to be kept")
+	}
+	if err := sp.Drain(func(records []spool.Record) ([]spool.Record, error) {
+		if len(records) != 1 {
+			t.Errorf("expected the batch not to be spooled, got %d spooled records", len(records))
+		}
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientsKeepTheSpoolLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := spool.Config{Enabled: true, Path: dir, MaxSize: 1 << 20, RetryInterval: time.Second}
+	sp, err := spool.Open(config, "streams_test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := client{streams: StubClient{summary: streamSummary(kinesis.StreamStatusActive, kinesis.StreamModeOnDemand, 1)}, limiter: newRateLimiter(0), spool: sp}
+	client.acquireSpool()
+	sp.Close()
+	if _, err := spool.Open(config, "streams_test", nil); err == nil {
+		t.Fatalf("expected the spool to be locked while a client uses it")
+	}
+
+	// Closed on errors, a client locks the spool again when connecting
+	client.Close()
+	if err := client.Connect(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := spool.Open(config, "streams_test", nil); err == nil {
+		t.Fatalf("expected the spool to be locked while a client uses it")
+	}
+
+	client.Close()
+	other, err := spool.Open(config, "streams_test", nil)
+	if err != nil {
+		t.Fatalf("expected the spool to be unlocked once its clients are closed, got %v", err)
+	}
+	other.Close()
+}
@@ -0,0 +1,74 @@
+package streams
+
+import (
+	"github.com/elastic/beats/libbeat/beat"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/outputs"
+	"github.com/s12v/awsbeats/emf"
+	"testing"
+)
+
+func TestNewWithWorkers(t *testing.T) {
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"region":        "eu-central-1",
+		"stream_name":   "foo",
+		"partition_key": "bar",
+		"workers":       3,
+	})
+	group, err := New(nil, beat.Info{Beat: "filebeat"}, outputs.NewNilObserver(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(group.Clients) != 3 {
+		t.Errorf("expected 3 clients, got %d", len(group.Clients))
+	}
+	if group.BatchSize != defaultBatchSize {
+		t.Errorf("unexpected batch size: %d", group.BatchSize)
+	}
+}
+
+func TestNewWithDefaultWorkers(t *testing.T) {
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"region":        "eu-central-1",
+		"stream_name":   "foo",
+		"partition_key": "bar",
+	})
+	group, err := New(nil, beat.Info{Beat: "filebeat"}, outputs.NewNilObserver(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(group.Clients) != 1 {
+		t.Errorf("expected 1 client, got %d", len(group.Clients))
+	}
+}
+
+func TestNewWithEMF(t *testing.T) {
+	cfg := common.MustNewConfigFrom(map[string]interface{}{
+		"region":        "eu-central-1",
+		"stream_name":   "foo",
+		"partition_key": "host.name",
+		"encoding":      "emf",
+		"emf": map[string]interface{}{
+			"namespace": "metricbeat",
+			"metrics":   []map[string]interface{}{{"field": "system.cpu.*.pct", "unit": "Percent"}},
+		},
+	})
+	group, err := New(nil, beat.Info{Beat: "metricbeat"}, outputs.NewNilObserver(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client := group.Clients[0].(interface{ Client() outputs.NetworkClient }).Client().(*client)
+	if _, ok := client.encoder.(*emf.Encoder); !ok {
+		t.Errorf("unexpected encoder %T", client.encoder)
+	}
+
+	cfg = common.MustNewConfigFrom(map[string]interface{}{
+		"region":        "eu-central-1",
+		"stream_name":   "foo",
+		"partition_key": "host.name",
+		"encoding":      "emf",
+	})
+	if _, err := New(nil, beat.Info{Beat: "metricbeat"}, outputs.NewNilObserver(), cfg); err == nil {
+		t.Errorf("expected an error without emf.namespace")
+	}
+}
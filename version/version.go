@@ -0,0 +1,6 @@
+// Package version holds the version of awsbeats, set at build time with
+// `-ldflags "-X github.com/s12v/awsbeats/version.Version=<version>"`.
+package version
+
+// Version of awsbeats
+var Version = "snapshot"